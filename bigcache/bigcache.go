@@ -1,7 +1,10 @@
 package bigcache
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"strings"
 	"time"
 )
 
@@ -15,18 +18,23 @@ const (
 type BigCache struct {
 	shards       []*cacheShard
 	lifeWindow   uint64
-	clock        clock
+	clock        Clock
 	hash         Hasher
 	config       Config
 	shardMask    uint64
 	maxShardSize uint32
 	close        chan struct{}
+	overflow     *overflowStore // 磁盘层，nil表示没有开启
+	loads        *loadGroup     // GetOrLoad 用的
 }
 
 // Response will contain metadata about the entry for which GetWithInfo(key) was called
 // 响应将包含有关调用了GetWithInfo（key）的条目的元数据
 type Response struct {
 	EntryStatus RemoveReason
+	// Timestamp is the time the entry was set, in units of Config.ClockResolution
+	// entry 写入的时间，单位是 Config.ClockResolution
+	Timestamp uint64
 }
 
 // RemoveReason is a value used to signal to the user why a particular key was removed in the OnRemove callback.
@@ -49,10 +57,13 @@ const (
 // NewBigCache initialize new instance of BigCache
 // NewBigCache 初始化新的 bigCache 实例
 func NewBigCache(config Config) (*BigCache, error) {
-	return newBigCache(config, &systemClock{})
+	if config.Clock != nil {
+		return newBigCache(config, config.Clock)
+	}
+	return newBigCache(config, newSystemClock(config.clockResolution()))
 }
 
-func newBigCache(config Config, clock clock) (*BigCache, error) {
+func newBigCache(config Config, clock Clock) (*BigCache, error) {
 
 	if !isPowerOfTwo(config.Shards) { //检查是否是2次幂
 		return nil, fmt.Errorf("Shards number must be power of two")
@@ -64,13 +75,14 @@ func newBigCache(config Config, clock clock) (*BigCache, error) {
 
 	cache := &BigCache{
 		shards:       make([]*cacheShard, config.Shards),
-		lifeWindow:   uint64(config.LifeWindow.Seconds()),
+		lifeWindow:   config.lifeWindowTicks(),
 		clock:        clock,
 		hash:         config.Hasher,
 		config:       config,
 		shardMask:    uint64(config.Shards - 1),
 		maxShardSize: uint32(config.maximumShardSizeInBytes()),
 		close:        make(chan struct{}),
+		loads:        newLoadGroup(),
 	}
 
 	var onRemove func(wrappedEntry []byte, reason RemoveReason)
@@ -84,9 +96,28 @@ func newBigCache(config Config, clock clock) (*BigCache, error) {
 		onRemove = cache.notProvidedOnRemove
 	}
 
+	if config.OverflowDir != "" {
+		overflow, err := newOverflowStore(config)
+		if err != nil {
+			return nil, fmt.Errorf("Could not create overflow store: %v", err)
+		}
+		overflow.onRemove = cache.overflowRemoved
+		cache.overflow = overflow
+	}
+
 	//初始化各个shards
 	for i := 0; i < config.Shards; i++ {
-		cache.shards[i] = initNewShard(config, onRemove, clock)
+		shard, err := initNewShard(config, i, onRemove, clock, cache.overflow)
+		if err != nil {
+			for _, initialized := range cache.shards[:i] {
+				initialized.free()
+			}
+			if cache.overflow != nil {
+				cache.overflow.close()
+			}
+			return nil, fmt.Errorf("Could not allocate shard queue: %v", err)
+		}
+		cache.shards[i] = shard
 	}
 
 	//定时cleanUp
@@ -96,8 +127,8 @@ func newBigCache(config Config, clock clock) (*BigCache, error) {
 			defer ticker.Stop()
 			for {
 				select {
-				case t := <-ticker.C:
-					cache.cleanUp(uint64(t.Unix()))
+				case <-ticker.C:
+					cache.cleanUp(uint64(clock.Epoch()))
 				case <-cache.close:
 					return
 				}
@@ -111,11 +142,27 @@ func newBigCache(config Config, clock clock) (*BigCache, error) {
 // Close is used to signal a shutdown of the cache when you are done with it.
 // This allows the cleaning goroutines to exit and ensures references are not
 // kept to the cache preventing GC of the entire cache.
+// Memory allocated by a Config.QueueStorage other than queue.HeapStorage is released, so with such a storage
+// entries are dropped and Set returns ErrCacheClosed after Close. Heap memory is left to the garbage collector and the cache stays usable.
 // Close 用于在完成缓存后发出关闭信号。
-// 这允许清理goroutines退出，并确保不会因保留对缓存的引用而阻止整个缓存的GC
+// 这允许清理goroutines退出，并确保不会因保留对缓存的引用而阻止整个缓存的GC。
+// 只释放非堆上的 QueueStorage 分配的内存，堆上的留给GC，Close之后还能用
 func (c *BigCache) Close() error {
 	close(c.close)
-	return nil
+	var err error
+	if c.config.releasesQueueMemory() {
+		for _, shard := range c.shards {
+			if freeErr := shard.free(); freeErr != nil {
+				err = freeErr
+			}
+		}
+	}
+	if c.overflow != nil {
+		if closeErr := c.overflow.close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
 }
 
 // Get reads entry for the key.
@@ -125,7 +172,41 @@ func (c *BigCache) Close() error {
 func (c *BigCache) Get(key string) ([]byte, error) {
 	hashedKey := c.hash.Sum64(key)
 	shard := c.getShard(hashedKey)
-	return shard.get(key, hashedKey)
+	entry, err := shard.get(key, hashedKey)
+	if err == ErrEntryNotFound && c.promote(shard, key, hashedKey) {
+		return shard.get(key, hashedKey)
+	}
+	return entry, err
+}
+
+// GetFunc calls fn with the entry for the key without copying it.
+// The value passed to fn is a view into the cache's memory: it is valid only until fn returns
+// and must not be modified. fn runs while the key's shard is locked for reading, so it must not
+// write to the cache. The error returned by fn is returned by GetFunc.
+// It returns an ErrEntryNotFound, without calling fn, when no entry exists for the given key.
+// GetFunc 不拷贝value，直接在分片的读锁下调用fn。value只在fn返回前有效，不能修改，fn里也不能写cache
+func (c *BigCache) GetFunc(key string, fn func(value []byte) error) error {
+	hashedKey := c.hash.Sum64(key)
+	shard := c.getShard(hashedKey)
+	err := shard.getFunc(key, hashedKey, fn)
+	if err == ErrEntryNotFound && c.promote(shard, key, hashedKey) {
+		return shard.getFunc(key, hashedKey, fn)
+	}
+	return err
+}
+
+// GetInto appends the entry for the key to dst and returns the extended buffer.
+// It does not allocate when dst has enough spare capacity.
+// It returns dst unchanged and an ErrEntryNotFound when no entry exists for the given key.
+// GetInto 把value追加到dst后面，dst容量够就不会开辟内存
+func (c *BigCache) GetInto(key string, dst []byte) ([]byte, error) {
+	hashedKey := c.hash.Sum64(key)
+	shard := c.getShard(hashedKey)
+	value, err := shard.getInto(key, hashedKey, dst)
+	if err == ErrEntryNotFound && c.promote(shard, key, hashedKey) {
+		return shard.getInto(key, hashedKey, dst)
+	}
+	return value, err
 }
 
 // GetWithInfo reads entry for the key with Response info.
@@ -135,7 +216,11 @@ func (c *BigCache) Get(key string) ([]byte, error) {
 func (c *BigCache) GetWithInfo(key string) ([]byte, Response, error) {
 	hashedKey := c.hash.Sum64(key)
 	shard := c.getShard(hashedKey)
-	return shard.getWithInfo(key, hashedKey)
+	entry, resp, err := shard.getWithInfo(key, hashedKey)
+	if err == ErrEntryNotFound && c.promote(shard, key, hashedKey) {
+		return shard.getWithInfo(key, hashedKey)
+	}
+	return entry, resp, err
 }
 
 // Set saves entry under the key
@@ -143,6 +228,10 @@ func (c *BigCache) GetWithInfo(key string) ([]byte, Response, error) {
 func (c *BigCache) Set(key string, entry []byte) error {
 	hashedKey := c.hash.Sum64(key)
 	shard := c.getShard(hashedKey)
+	if c.overflow != nil {
+		// 磁盘上的旧值作废
+		c.overflow.del(key, hashedKey)
+	}
 	return shard.set(key, hashedKey, entry)
 }
 
@@ -154,14 +243,124 @@ func (c *BigCache) Set(key string, entry []byte) error {
 func (c *BigCache) Append(key string, entry []byte) error {
 	hashedKey := c.hash.Sum64(key)
 	shard := c.getShard(hashedKey)
+	if c.overflow != nil {
+		// 在磁盘上的话先放回内存，再追加
+		c.promote(shard, key, hashedKey)
+	}
 	return shard.append(key, hashedKey, entry)
 }
 
+// Update calls fn with the value of the key, or nil and false when there is none, and stores the value fn returns
+// when it also returns true. No other write to the key's shard happens in between, so fn must not use the cache.
+// The value passed to fn is a copy owned by fn. Like Set, storing a value restarts its LifeWindow.
+// 在分片的写锁下读出key的value交给fn，fn返回true的话把它返回的值存回去。fn里不能再操作cache
+func (c *BigCache) Update(key string, fn func(value []byte, found bool) ([]byte, bool)) error {
+	return c.update(key, func(value []byte, found bool) ([]byte, bool, error) {
+		entry, store := fn(value, found)
+		return entry, store, nil
+	})
+}
+
+// Incr adds delta to the counter stored under the key and returns the new value. A missing key counts from 0.
+// Counters are stored as 8-byte big-endian integers; ErrNotCounter is returned for a value of another length.
+// 计数器加delta，返回加完的值。key不存在就从0开始，计数器存成8字节的大端整数
+func (c *BigCache) Incr(key string, delta int64) (int64, error) {
+	var counter int64
+	err := c.update(key, func(value []byte, found bool) ([]byte, bool, error) {
+		if found {
+			if len(value) != 8 {
+				return nil, false, ErrNotCounter
+			}
+			counter = int64(binary.BigEndian.Uint64(value))
+		} else {
+			value = make([]byte, 8)
+		}
+		counter += delta
+		binary.BigEndian.PutUint64(value, uint64(counter))
+		return value, true, nil
+	})
+	return counter, err
+}
+
+// Decr subtracts delta from the counter stored under the key and returns the new value, see Incr
+func (c *BigCache) Decr(key string, delta int64) (int64, error) {
+	return c.Incr(key, -delta)
+}
+
+// SetIfAbsent saves entry under the key unless the key has an entry, and reports whether it was saved
+// key不存在的时候才存，返回是否存了
+func (c *BigCache) SetIfAbsent(key string, entry []byte) (bool, error) {
+	var stored bool
+	err := c.update(key, func(value []byte, found bool) ([]byte, bool, error) {
+		stored = !found
+		return entry, stored, nil
+	})
+	return stored && err == nil, err
+}
+
+// CompareAndSwap saves new under the key if its current value equals old, and reports whether it was saved.
+// It returns false when the key has no entry.
+// 当前的value等于old的时候才换成new，返回是否换了。key不存在返回false
+func (c *BigCache) CompareAndSwap(key string, old, new []byte) (bool, error) {
+	var swapped bool
+	err := c.update(key, func(value []byte, found bool) ([]byte, bool, error) {
+		swapped = found && bytes.Equal(value, old)
+		return new, swapped, nil
+	})
+	return swapped && err == nil, err
+}
+
+// update moves the entry for the key back from the disk tier and updates it under the shard lock
+func (c *BigCache) update(key string, fn func(value []byte, found bool) ([]byte, bool, error)) error {
+	hashedKey := c.hash.Sum64(key)
+	shard := c.getShard(hashedKey)
+	if c.overflow != nil {
+		c.promote(shard, key, hashedKey)
+	}
+	return shard.update(key, hashedKey, fn)
+}
+
 // Delete removes the key
 func (c *BigCache) Delete(key string) error {
 	hashedKey := c.hash.Sum64(key)
 	shard := c.getShard(hashedKey)
-	return shard.del(hashedKey)
+	err := shard.del(key, hashedKey)
+	if c.overflow == nil {
+		return err
+	}
+	// 等key被淘汰的话先写到磁盘，才能从磁盘删掉
+	shard.waitForSpill()
+	if c.overflow.del(key, hashedKey) && err == ErrEntryNotFound {
+		return nil
+	}
+	return err
+}
+
+// DeletePrefix removes all entries whose key starts with prefix and returns their number
+// DeletePrefix 删除所有以prefix开头的key，返回删除的个数
+func (c *BigCache) DeletePrefix(prefix string) int {
+	return c.DeleteMatching(func(key string) bool {
+		return strings.HasPrefix(key, prefix)
+	})
+}
+
+// DeleteMatching removes all entries whose key satisfies match and returns their number.
+// Shards are scanned one after another, each locked only while it is scanned, so entries
+// set in an already scanned shard during the call are kept. match must not call the cache.
+// DeleteMatching 删除key满足match的所有entry。一个shard一个shard地扫描，同一时间只锁一个shard，
+// 所以调用期间写到已经扫描过的shard的entry不会被删除。match里不能调用cache的方法
+func (c *BigCache) DeleteMatching(match func(key string) bool) int {
+	deleted := 0
+	for _, shard := range c.shards {
+		deleted += shard.delMatching(match)
+	}
+	if c.overflow != nil {
+		for _, shard := range c.shards {
+			shard.waitForSpill()
+		}
+		deleted += c.overflow.delMatching(match)
+	}
+	return deleted
 }
 
 // Reset empties all cache shards
@@ -170,16 +369,26 @@ func (c *BigCache) Reset() error {
 	for _, shard := range c.shards {
 		shard.reset(c.config)
 	}
+	if c.overflow != nil {
+		for _, shard := range c.shards {
+			shard.waitForSpill()
+		}
+		c.overflow.reset()
+	}
+	c.loads.reset()
 	return nil
 }
 
-// Len computes number of entries in cache
-// Len 返回所有分片中的entries的总和
+// Len computes number of entries in cache, including entries in the disk tier
+// Len 返回所有分片中的entries的总和，包括磁盘层中的
 func (c *BigCache) Len() int {
 	var len int
 	for _, shard := range c.shards {
 		len += shard.len()
 	}
+	if c.overflow != nil {
+		len += c.overflow.len()
+	}
 	return len
 }
 
@@ -203,10 +412,56 @@ func (c *BigCache) Stats() Stats {
 		s.DelHits += tmp.DelHits
 		s.DelMisses += tmp.DelMisses
 		s.Collisions += tmp.Collisions
+		s.Compactions += tmp.Compactions
+		s.ReclaimedBytes += tmp.ReclaimedBytes
+		s.UncompressedBytes += tmp.UncompressedBytes
+		s.CompressedBytes += tmp.CompressedBytes
+		s.Removals.sum(tmp.Removals)
+		s.RemovedBytes.sum(tmp.RemovedBytes)
 	}
 	return s
 }
 
+// Compact rewrites the live entries of every shard into a fresh queue, freeing the space of deleted
+// and overwritten entries. Shards are also compacted automatically once Config.CompactionThreshold is reached.
+// Compact 压缩所有shard，回收已删除和被覆盖的entry占用的空间
+func (c *BigCache) Compact() {
+	for _, shard := range c.shards {
+		shard.forceCompact()
+	}
+}
+
+// ShardStats returns statistics of every shard, in shard order
+// ShardStats 返回每个shard的统计数据
+func (c *BigCache) ShardStats() []ShardStats {
+	stats := make([]ShardStats, len(c.shards))
+	for i, shard := range c.shards {
+		stats[i] = shard.getShardStats()
+	}
+	return stats
+}
+
+// HotKeys returns up to k keys with the highest request counts, most requested first.
+// Request counts are only kept when StatsEnabled is set; otherwise the result is empty. It is nil when k <= 0.
+// HotKeys 返回请求次数最多的k个key，需要开启 StatsEnabled。k<=0 返回nil
+func (c *BigCache) HotKeys(k int) []KeyStats {
+	if k <= 0 {
+		return nil
+	}
+	var hot []KeyStats
+	for i, shard := range c.shards {
+		for _, key := range shard.hotKeys(k) {
+			key.Shard = i
+			hot = append(hot, key)
+		}
+	}
+	sortKeyStats(hot)
+	if len(hot) > k {
+		hot = hot[:k]
+	}
+	return hot
+}
+
 // KeyMetadata returns number of times a cached resource was requested.
 //KeyMetadata返回请求缓存资源的次数。
 func (c *BigCache) KeyMetadata(key string) Metadata {
@@ -216,9 +471,10 @@ func (c *BigCache) KeyMetadata(key string) Metadata {
 }
 
 // Iterator returns iterator function to iterate over EntryInfo's from whole cache.
+// Entries in the disk tier are not visited. Options such as IterateKeysWithPrefix narrow the entries visited.
 //迭代器返回迭代器函数以迭代整个缓存中的EntryInfo。
-func (c *BigCache) Iterator() *EntryInfoIterator {
-	return newIterator(c)
+func (c *BigCache) Iterator(options ...IteratorOption) *EntryInfoIterator {
+	return newIterator(c, options...)
 }
 
 func (c *BigCache) onEvict(oldestEntry []byte, currentTimestamp uint64, evict func(reason RemoveReason) error) bool {
@@ -235,6 +491,36 @@ func (c *BigCache) cleanUp(currentTimestamp uint64) {
 	for _, shard := range c.shards {
 		shard.cleanUp(currentTimestamp)
 	}
+	if c.overflow != nil {
+		c.overflow.cleanUp(currentTimestamp)
+	}
+	c.loads.cleanUp(currentTimestamp)
+}
+
+// promote moves the entry for key from the disk tier back to its shard and reports whether there was one
+// 从磁盘层取出key的entry放回shard，返回是否取到了
+func (c *BigCache) promote(shard *cacheShard, key string, hashedKey uint64) bool {
+	if c.overflow == nil {
+		return false
+	}
+	wrappedEntry := c.overflow.take(key, hashedKey, uint64(c.clock.Epoch()))
+	if wrappedEntry == nil {
+		return false
+	}
+	if err := shard.promote(key, hashedKey, wrappedEntry); err != nil {
+		// 放不回内存就还给磁盘层，磁盘层也放不下就算删除
+		if !c.overflow.put(wrappedEntry) {
+			shard.removed(wrappedEntry, NoSpace)
+		}
+		return false
+	}
+	return true
+}
+
+// overflowRemoved counts an entry dropped from the disk tier in the stats of its shard and reports it to OnRemove
+// 磁盘层丢掉的entry算到它所在的shard上
+func (c *BigCache) overflowRemoved(wrappedEntry []byte, reason RemoveReason) {
+	c.getShard(readHashFromEntry(wrappedEntry)).removed(wrappedEntry, reason)
 }
 
 func (c *BigCache) getShard(hashedKey uint64) (shard *cacheShard) {
@@ -242,12 +528,12 @@ func (c *BigCache) getShard(hashedKey uint64) (shard *cacheShard) {
 }
 
 func (c *BigCache) providedOnRemove(wrappedEntry []byte, reason RemoveReason) {
-	c.config.OnRemove(readKeyFromEntry(wrappedEntry), readEntry(wrappedEntry))
+	c.config.OnRemove(readKeyFromEntry(wrappedEntry), c.readValue(wrappedEntry))
 }
 
 func (c *BigCache) providedOnRemoveWithReason(wrappedEntry []byte, reason RemoveReason) {
 	if c.config.onRemoveFilter == 0 || (1<<uint(reason))&c.config.onRemoveFilter > 0 {
-		c.config.OnRemoveWithReason(readKeyFromEntry(wrappedEntry), readEntry(wrappedEntry), reason)
+		c.config.OnRemoveWithReason(readKeyFromEntry(wrappedEntry), c.readValue(wrappedEntry), reason)
 	}
 }
 
@@ -257,5 +543,11 @@ func (c *BigCache) notProvidedOnRemove(wrappedEntry []byte, reason RemoveReason)
 func (c *BigCache) providedOnRemoveWithMetadata(wrappedEntry []byte, reason RemoveReason) {
 	hashedKey := c.hash.Sum64(readKeyFromEntry(wrappedEntry))
 	shard := c.getShard(hashedKey)
-	c.config.OnRemoveWithMetadata(readKeyFromEntry(wrappedEntry), readEntry(wrappedEntry), shard.getKeyMetadata(hashedKey))
+	c.config.OnRemoveWithMetadata(readKeyFromEntry(wrappedEntry), c.readValue(wrappedEntry), shard.getKeyMetadata(hashedKey))
+}
+
+// readValue returns the decompressed value of a removed entry, or nil if it can not be decompressed
+func (c *BigCache) readValue(wrappedEntry []byte) []byte {
+	value, _ := readEntryWithCodec(wrappedEntry, c.config.Codec)
+	return value
 }
@@ -3,6 +3,7 @@ package bigcache
 import (
 	"fmt"
 	"math/rand"
+	"sort"
 	"strconv"
 	"testing"
 	"time"
@@ -45,6 +46,32 @@ func BenchmarkWriteToUnlimitedCacheWithSmallInitSizeAnd1Shard(b *testing.B) {
 	}
 }
 
+// BenchmarkSetLatencyDuringGrowth reports the 99th percentile of Set latency of a cache whose shards
+// keep growing from a small initial size
+func BenchmarkSetLatencyDuringGrowth(b *testing.B) {
+	m := blob('a', 1024)
+	cache, _ := NewBigCache(Config{
+		Shards:             4,
+		LifeWindow:         100 * time.Second,
+		MaxEntriesInWindow: 100,
+		MaxEntrySize:       256,
+	})
+	latencies := make([]time.Duration, b.N)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		start := time.Now()
+		cache.Set(fmt.Sprintf("key-%d", i), m)
+		latencies[i] = time.Since(start)
+	}
+	b.StopTimer()
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	b.ReportMetric(float64(latencies[b.N*99/100]), "p99-ns")
+	b.ReportMetric(float64(latencies[b.N-1]), "max-ns")
+}
+
 func BenchmarkWriteToCache(b *testing.B) {
 	for _, shards := range []int{1, 512, 1024, 8192} {
 		b.Run(fmt.Sprintf("%d-shards", shards), func(b *testing.B) {
@@ -68,6 +95,22 @@ func BenchmarkReadFromCache(b *testing.B) {
 	}
 }
 
+func BenchmarkReadFromCacheWithFunc(b *testing.B) {
+	for _, shards := range []int{1, 512, 1024, 8192} {
+		b.Run(fmt.Sprintf("%d-shards", shards), func(b *testing.B) {
+			readFromCacheWithoutCopy(b, shards, false)
+		})
+	}
+}
+
+func BenchmarkReadFromCacheInto(b *testing.B) {
+	for _, shards := range []int{1, 512, 1024, 8192} {
+		b.Run(fmt.Sprintf("%d-shards", shards), func(b *testing.B) {
+			readFromCacheWithoutCopy(b, shards, true)
+		})
+	}
+}
+
 func BenchmarkReadFromCacheWithInfo(b *testing.B) {
 	for _, shards := range []int{1, 512, 1024, 8192} {
 		b.Run(fmt.Sprintf("%d-shards", shards), func(b *testing.B) {
@@ -165,6 +208,19 @@ func appendToCache(b *testing.B, shards int, lifeWindow time.Duration, requestsI
 	})
 }
 
+func BenchmarkHitRatioOnZipfianReads(b *testing.B) {
+	for _, policy := range []struct {
+		name   string
+		policy EvictionPolicy
+	}{{"fifo", FIFOEviction}, {"clock", ClockEviction}} {
+		for _, s := range []float64{1.01, 1.2} {
+			b.Run(fmt.Sprintf("%s-s%.2f", policy.name, s), func(b *testing.B) {
+				readZipfian(b, policy.policy, s)
+			})
+		}
+	}
+}
+
 func readFromCache(b *testing.B, shards int, info bool) {
 	cache, _ := NewBigCache(Config{
 		Shards:             shards,
@@ -190,6 +246,70 @@ func readFromCache(b *testing.B, shards int, info bool) {
 	})
 }
 
+// readZipfian reads keys with a Zipfian popularity from a cache that holds about a tenth of them,
+// setting every missed key, and reports the hit ratio
+func readZipfian(b *testing.B, policy EvictionPolicy, s float64) {
+	const keys = 100000
+	cache, _ := NewBigCache(Config{
+		Shards:             1,
+		LifeWindow:         1000 * time.Second,
+		MaxEntriesInWindow: keys / 10,
+		MaxEntrySize:       100,
+		HardMaxCacheSize:   1,
+		EvictionPolicy:     policy,
+	})
+	zipf := rand.NewZipf(rand.New(rand.NewSource(1)), s, 1, keys-1)
+	value := blob('a', 100)
+	b.ResetTimer()
+
+	var hits int
+	for i := 0; i < b.N; i++ {
+		key := strconv.FormatUint(zipf.Uint64(), 10)
+		if _, err := cache.Get(key); err == nil {
+			hits++
+		} else {
+			cache.Set(key, value)
+		}
+	}
+	b.ReportMetric(float64(hits)/float64(b.N), "hit-ratio")
+}
+
+// readFromCacheWithoutCopy reads existing keys with GetInto or GetFunc. Keys are formatted before the
+// timer starts, so the reported allocations are those of the reads alone.
+func readFromCacheWithoutCopy(b *testing.B, shards int, into bool) {
+	cache, _ := NewBigCache(Config{
+		Shards:             shards,
+		LifeWindow:         1000 * time.Second,
+		MaxEntriesInWindow: 100000,
+		MaxEntrySize:       500,
+	})
+	keys := make([]string, 100000)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+		cache.Set(keys[i], message)
+	}
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		b.ReportAllocs()
+		buf := make([]byte, 0, len(message))
+		var size int
+		read := func(value []byte) error {
+			size += len(value)
+			return nil
+		}
+
+		for i := 0; pb.Next(); i++ {
+			key := keys[i%len(keys)]
+			if into {
+				buf, _ = cache.GetInto(key, buf[:0])
+			} else {
+				cache.GetFunc(key, read)
+			}
+		}
+	})
+}
+
 func readFromCacheNonExistentKeys(b *testing.B, shards int) {
 	cache, _ := NewBigCache(Config{
 		Shards:             shards,
@@ -10,6 +10,8 @@ import (
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/allegro/bigcache/v2/queue"
 )
 
 func TestWriteAndGetOnCache(t *testing.T) {
@@ -28,6 +30,80 @@ func TestWriteAndGetOnCache(t *testing.T) {
 	assertEqual(t, value, cachedValue)
 }
 
+func TestGetFunc(t *testing.T) {
+	t.Parallel()
+
+	// given
+	cache, _ := NewBigCache(DefaultConfig(5 * time.Second))
+	cache.Set("key", []byte("value"))
+	callbackErr := fmt.Errorf("callback error")
+
+	// when
+	var seen []byte
+	err := cache.GetFunc("key", func(value []byte) error {
+		seen = append(seen, value...)
+		return nil
+	})
+	errFromCallback := cache.GetFunc("key", func(value []byte) error {
+		return callbackErr
+	})
+	called := false
+	errNotFound := cache.GetFunc("nonExistingKey", func(value []byte) error {
+		called = true
+		return nil
+	})
+
+	// then
+	noError(t, err)
+	assertEqual(t, []byte("value"), seen)
+	assertEqual(t, callbackErr, errFromCallback)
+	assertEqual(t, ErrEntryNotFound, errNotFound)
+	assertEqual(t, false, called)
+	assertEqual(t, int64(2), cache.Stats().Hits)
+}
+
+func TestGetInto(t *testing.T) {
+	t.Parallel()
+
+	// given
+	cache, _ := NewBigCache(DefaultConfig(5 * time.Second))
+	cache.Set("key", []byte("value"))
+	buf := make([]byte, 0, 64)
+
+	// when
+	prefixed, err := cache.GetInto("key", append(buf, "prefix-"...))
+	missing, errNotFound := cache.GetInto("nonExistingKey", buf[:0])
+
+	// then
+	noError(t, err)
+	assertEqual(t, []byte("prefix-value"), prefixed)
+	assertEqual(t, &buf[:1][0], &prefixed[0])
+	assertEqual(t, ErrEntryNotFound, errNotFound)
+	assertEqual(t, 0, len(missing))
+}
+
+func TestGetIntoDoesNotAllocate(t *testing.T) {
+	// given
+	cache, _ := NewBigCache(DefaultConfig(5 * time.Second))
+	cache.Set("key", blob('a', 256))
+	buf := make([]byte, 0, 256)
+	var size int
+
+	// when
+	allocs := testing.AllocsPerRun(100, func() {
+		buf, _ = cache.GetInto("key", buf[:0])
+		cache.GetFunc("key", func(value []byte) error {
+			size = len(value)
+			return nil
+		})
+	})
+
+	// then
+	assertEqual(t, float64(0), allocs)
+	assertEqual(t, 256, len(buf))
+	assertEqual(t, 256, size)
+}
+
 func TestAppendAndGetOnCache(t *testing.T) {
 	t.Parallel()
 
@@ -141,6 +217,138 @@ func TestAppendRandomly(t *testing.T) {
 	}
 }
 
+func TestIncrAndDecr(t *testing.T) {
+	t.Parallel()
+
+	// given
+	cache, _ := NewBigCache(DefaultConfig(5 * time.Second))
+
+	// when
+	first, firstErr := cache.Incr("counter", 5)
+	second, secondErr := cache.Decr("counter", 2)
+	stored, _ := cache.Get("counter")
+
+	// then
+	noError(t, firstErr)
+	noError(t, secondErr)
+	assertEqual(t, int64(5), first)
+	assertEqual(t, int64(3), second)
+	assertEqual(t, []byte{0, 0, 0, 0, 0, 0, 0, 3}, stored)
+}
+
+func TestIncrOfNonCounter(t *testing.T) {
+	t.Parallel()
+
+	// given
+	cache, _ := NewBigCache(DefaultConfig(5 * time.Second))
+	cache.Set("key", []byte("value"))
+
+	// when
+	_, err := cache.Incr("key", 1)
+	value, _ := cache.Get("key")
+
+	// then
+	assertEqual(t, ErrNotCounter, err)
+	assertEqual(t, []byte("value"), value)
+}
+
+func TestConcurrentIncr(t *testing.T) {
+	t.Parallel()
+
+	// given
+	cache, _ := NewBigCache(Config{
+		Shards:             1,
+		LifeWindow:         time.Minute,
+		MaxEntriesInWindow: 10,
+		MaxEntrySize:       256,
+		Codec:              LZ4Codec,
+	})
+	var wg sync.WaitGroup
+
+	// when
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				cache.Incr("counter", 1)
+			}
+		}()
+	}
+	wg.Wait()
+	counter, err := cache.Incr("counter", 0)
+
+	// then
+	noError(t, err)
+	assertEqual(t, int64(1000), counter)
+}
+
+func TestSetIfAbsent(t *testing.T) {
+	t.Parallel()
+
+	// given
+	cache, _ := NewBigCache(DefaultConfig(5 * time.Second))
+
+	// when
+	stored, storedErr := cache.SetIfAbsent("key", []byte("first"))
+	overwritten, overwrittenErr := cache.SetIfAbsent("key", []byte("second"))
+	value, _ := cache.Get("key")
+
+	// then
+	noError(t, storedErr)
+	noError(t, overwrittenErr)
+	assertEqual(t, true, stored)
+	assertEqual(t, false, overwritten)
+	assertEqual(t, []byte("first"), value)
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	t.Parallel()
+
+	// given
+	cache, _ := NewBigCache(DefaultConfig(5 * time.Second))
+	cache.Set("key", []byte("old"))
+
+	// when
+	missing, _ := cache.CompareAndSwap("missing", nil, []byte("new"))
+	mismatched, _ := cache.CompareAndSwap("key", []byte("other"), []byte("new"))
+	swapped, err := cache.CompareAndSwap("key", []byte("old"), []byte("new"))
+	value, _ := cache.Get("key")
+	_, missingErr := cache.Get("missing")
+
+	// then
+	noError(t, err)
+	assertEqual(t, false, missing)
+	assertEqual(t, false, mismatched)
+	assertEqual(t, true, swapped)
+	assertEqual(t, []byte("new"), value)
+	assertEqual(t, ErrEntryNotFound, missingErr)
+}
+
+func TestUpdate(t *testing.T) {
+	t.Parallel()
+
+	// given
+	cache, _ := NewBigCache(DefaultConfig(5 * time.Second))
+	cache.Set("key", []byte("value"))
+
+	// when
+	err := cache.Update("key", func(value []byte, found bool) ([]byte, bool) {
+		return bytes.ToUpper(value), found
+	})
+	skipErr := cache.Update("missing", func(value []byte, found bool) ([]byte, bool) {
+		return []byte("created"), found
+	})
+	value, _ := cache.Get("key")
+	_, missingErr := cache.Get("missing")
+
+	// then
+	noError(t, err)
+	noError(t, skipErr)
+	assertEqual(t, []byte("VALUE"), value)
+	assertEqual(t, ErrEntryNotFound, missingErr)
+}
+
 func TestConstructCacheWithDefaultHasher(t *testing.T) {
 	t.Parallel()
 
@@ -234,6 +442,174 @@ func TestTimingEvictionShouldEvictOnlyFromUpdatedShard(t *testing.T) {
 	assertEqual(t, []byte("value"), value)
 }
 
+func TestTimingEvictionWithMillisecondResolution(t *testing.T) {
+	t.Parallel()
+
+	// given
+	clock := mockedClock{value: 0}
+	cache, _ := NewBigCache(Config{
+		Shards:             1,
+		LifeWindow:         250 * time.Millisecond,
+		ClockResolution:    time.Millisecond,
+		Clock:              &clock,
+		MaxEntriesInWindow: 1,
+		MaxEntrySize:       256,
+	})
+
+	// when
+	cache.Set("key", []byte("value"))
+	clock.set(250)
+	cache.Set("key2", []byte("value2"))
+	_, errBeforeLifeWindow := cache.Get("key")
+	_, resp, _ := cache.GetWithInfo("key2")
+	clock.set(251)
+	cache.Set("key3", []byte("value3"))
+	_, errAfterLifeWindow := cache.Get("key")
+
+	// then
+	noError(t, errBeforeLifeWindow)
+	assertEqual(t, uint64(250), resp.Timestamp)
+	assertEqual(t, ErrEntryNotFound, errAfterLifeWindow)
+}
+
+func TestSystemClockIsMonotonic(t *testing.T) {
+	t.Parallel()
+
+	// given
+	clock := newSystemClock(time.Nanosecond)
+
+	// when
+	first := clock.Epoch()
+	time.Sleep(time.Millisecond)
+	second := clock.Epoch()
+
+	// then
+	assertEqual(t, true, second-first >= int64(time.Millisecond))
+	assertEqual(t, time.Now().Unix(), newSystemClock(time.Second).Epoch())
+}
+
+func TestClockEvictionKeepsReadEntries(t *testing.T) {
+	t.Parallel()
+
+	// given
+	cache, _ := NewBigCache(Config{
+		Shards:             1,
+		LifeWindow:         time.Minute,
+		MaxEntriesInWindow: 1024,
+		MaxEntrySize:       1024,
+		HardMaxCacheSize:   1,
+		EvictionPolicy:     ClockEviction,
+	})
+	cache.Set("hot", blob('h', 1000))
+
+	// when
+	for i := 0; i < 4096; i++ {
+		if i%256 == 0 {
+			cache.Get("hot")
+		}
+		cache.Set(fmt.Sprintf("cold%d", i), blob('c', 1000))
+	}
+	value, err := cache.Get("hot")
+	_, coldErr := cache.Get("cold0")
+
+	// then
+	noError(t, err)
+	assertEqual(t, blob('h', 1000), value)
+	assertEqual(t, ErrEntryNotFound, coldErr)
+}
+
+func TestFIFOEvictionRemovesReadEntries(t *testing.T) {
+	t.Parallel()
+
+	// given
+	cache, _ := NewBigCache(Config{
+		Shards:             1,
+		LifeWindow:         time.Minute,
+		MaxEntriesInWindow: 1024,
+		MaxEntrySize:       1024,
+		HardMaxCacheSize:   1,
+	})
+	cache.Set("hot", blob('h', 1000))
+
+	// when
+	for i := 0; i < 4096; i++ {
+		if i%256 == 0 {
+			cache.Get("hot")
+		}
+		cache.Set(fmt.Sprintf("cold%d", i), blob('c', 1000))
+	}
+	_, err := cache.Get("hot")
+
+	// then
+	assertEqual(t, ErrEntryNotFound, err)
+}
+
+func TestClockEvictionWithCollisionsResolved(t *testing.T) {
+	t.Parallel()
+
+	// given
+	cache, _ := NewBigCache(Config{
+		Shards:             1,
+		LifeWindow:         time.Minute,
+		MaxEntriesInWindow: 1024,
+		MaxEntrySize:       1024,
+		HardMaxCacheSize:   1,
+		Hasher:             hashStub(5),
+		ResolveCollisions:  true,
+		EvictionPolicy:     ClockEviction,
+	})
+	cache.Set("a", blob('a', 100*1024))
+	cache.Set("b", blob('b', 100*1024))
+
+	// when
+	cache.Get("b")
+	for i := 0; i < 12; i++ {
+		cache.Set(fmt.Sprintf("c%d", i), blob('c', 100*1024))
+	}
+	_, errA := cache.Get("a")
+	valueB, errB := cache.Get("b")
+
+	// then
+	assertEqual(t, ErrEntryNotFound, errA)
+	noError(t, errB)
+	assertEqual(t, blob('b', 100*1024), valueB)
+}
+
+func TestClockEvictionExpiresRequeuedEntries(t *testing.T) {
+	t.Parallel()
+
+	// given
+	clock := mockedClock{value: 0}
+	cache, _ := NewBigCache(Config{
+		Shards:             1,
+		LifeWindow:         10 * time.Second,
+		Clock:              &clock,
+		MaxEntriesInWindow: 1024,
+		MaxEntrySize:       1024,
+		HardMaxCacheSize:   1,
+		EvictionPolicy:     ClockEviction,
+	})
+	cache.Set("hot", blob('h', 1000))
+	cache.Get("hot")
+	clock.set(5)
+	for i := 0; i < 1500; i++ {
+		cache.Set(fmt.Sprintf("cold%d", i), blob('c', 1000))
+	}
+	_, _, errBeforeLifeWindow := cache.GetWithInfo("hot")
+
+	// when
+	clock.set(12)
+	cache.cleanUp(uint64(clock.Epoch()))
+	_, _, errAfterLifeWindow := cache.GetWithInfo("hot")
+	_, _, coldErr := cache.GetWithInfo("cold1499")
+
+	// then
+	noError(t, errBeforeLifeWindow)
+	assertEqual(t, ErrEntryNotFound, errAfterLifeWindow)
+	noError(t, coldErr)
+	assertEqual(t, int64(1), cache.Stats().Removals.Expired)
+}
+
 func TestCleanShouldEvictAll(t *testing.T) {
 	t.Parallel()
 
@@ -441,31 +817,188 @@ func TestOnRemoveGetEntryStats(t *testing.T) {
 		cache.Get("key")
 	}
 
-	cache.Delete("key")
+	cache.Delete("key")
+
+	// then
+	assertEqual(t, uint32(100), count)
+}
+
+func TestCacheLen(t *testing.T) {
+	t.Parallel()
+
+	// given
+	cache, _ := NewBigCache(Config{
+		Shards:             8,
+		LifeWindow:         time.Second,
+		MaxEntriesInWindow: 1,
+		MaxEntrySize:       256,
+	})
+	keys := 1337
+
+	// when
+	for i := 0; i < keys; i++ {
+		cache.Set(fmt.Sprintf("key%d", i), []byte("value"))
+	}
+
+	// then
+	assertEqual(t, keys, cache.Len())
+}
+
+func TestShardStats(t *testing.T) {
+	t.Parallel()
+
+	// given
+	clock := mockedClock{value: 0}
+	cache, _ := newBigCache(Config{
+		Shards:             2,
+		LifeWindow:         time.Second,
+		MaxEntriesInWindow: 10,
+		MaxEntrySize:       256,
+		Hasher:             hashStub(4),
+	}, &clock)
+
+	// when
+	cache.Set("a", []byte("value"))
+	cache.Set("b", []byte("value"))
+	cache.Set("c", []byte("value"))
+	cache.Get("c")
+	cache.Get("missing")
+	cache.Delete("c")
+	cache.Set("e", []byte("value"))
+	clock.set(5)
+	cache.cleanUp(uint64(clock.Epoch()))
+	cache.Set("d", []byte("value"))
+	stats := cache.ShardStats()
+
+	// then
+	assertEqual(t, 2, len(stats))
+	assertEqual(t, int64(1), stats[0].Hits)
+	assertEqual(t, int64(1), stats[0].Collisions)
+	assertEqual(t, int64(1), stats[0].DelHits)
+	assertEqual(t, 1, stats[0].Entries)
+	assertEqual(t, true, stats[0].UsedBytes > 0)
+	assertEqual(t, cache.shards[0].capacity(), stats[0].Capacity)
+	assertEqual(t, RemovalCounts{Expired: 1, Deleted: 1}, stats[0].Removals)
+	assertEqual(t, ShardStats{Capacity: cache.shards[1].capacity()}, stats[1])
+}
+
+func TestRemovalStats(t *testing.T) {
+	t.Parallel()
+
+	// given
+	clock := mockedClock{value: 0}
+	cache, _ := newBigCache(Config{
+		Shards:             1,
+		LifeWindow:         10 * time.Second,
+		MaxEntriesInWindow: 100,
+		MaxEntrySize:       1024,
+		HardMaxCacheSize:   1,
+	}, &clock)
+	entrySize := int64(headersSizeInBytes + len("key0000") + 1000)
+
+	// when
+	for i := 0; i < 2048; i++ {
+		cache.Set(fmt.Sprintf("key%04d", i), blob('a', 1000))
+	}
+	evicted := int64(2048 - cache.Len())
+	clock.set(3)
+	oldestEntryAge := cache.ShardStats()[0].OldestEntryAge
+	cache.Delete("key2047")
+	clock.set(11)
+	cache.Set("new", []byte("value"))
+	clock.set(12)
+	cache.cleanUp(uint64(clock.Epoch()))
+	expired := int64(2048) - evicted - 1
+	stats := cache.Stats()
+
+	// then
+	assertEqual(t, true, evicted > 0)
+	assertEqual(t, 3*time.Second, oldestEntryAge)
+	assertEqual(t, RemovalCounts{Expired: expired, NoSpace: evicted, Deleted: 1}, stats.Removals)
+	assertEqual(t, RemovalCounts{Expired: expired * entrySize, NoSpace: evicted * entrySize, Deleted: entrySize}, stats.RemovedBytes)
+	assertEqual(t, time.Second, cache.ShardStats()[0].OldestEntryAge)
+}
+
+func TestHotKeys(t *testing.T) {
+	t.Parallel()
+
+	// given
+	cache, _ := NewBigCache(Config{
+		Shards:             4,
+		LifeWindow:         time.Minute,
+		MaxEntriesInWindow: 100,
+		MaxEntrySize:       256,
+		StatsEnabled:       true,
+	})
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key%d", i)
+		cache.Set(key, []byte("value"))
+		for j := 0; j < i; j++ {
+			cache.Get(key)
+		}
+	}
+
+	// when
+	hot := cache.HotKeys(3)
+
+	// then
+	assertEqual(t, 3, len(hot))
+	for i, key := range hot {
+		name := fmt.Sprintf("key%d", 9-i)
+		hashedKey := cache.hash.Sum64(name)
+		assertEqual(t, KeyStats{Key: name, Hash: hashedKey, Shard: int(hashedKey & cache.shardMask), RequestCount: uint32(9 - i)}, key)
+	}
+}
+
+func TestHotKeysWithCollidingKeys(t *testing.T) {
+	t.Parallel()
+
+	// given
+	cache, _ := NewBigCache(Config{
+		Shards:             1,
+		LifeWindow:         time.Minute,
+		MaxEntriesInWindow: 100,
+		MaxEntrySize:       256,
+		StatsEnabled:       true,
+		ResolveCollisions:  true,
+		Hasher:             hashStub(5),
+	})
+	cache.Set("a", []byte("value"))
+	cache.Set("b", []byte("value"))
+	cache.Delete("a")
+	for i := 0; i < 3; i++ {
+		cache.Get("b")
+	}
+	cache.shards[0].hashmapStats[6] = 10
+
+	// when
+	hot := cache.HotKeys(2)
 
 	// then
-	assertEqual(t, uint32(100), count)
+	assertEqual(t, []KeyStats{{Key: "b", Hash: 5, RequestCount: 3}}, hot)
 }
 
-func TestCacheLen(t *testing.T) {
+func TestHotKeysWithoutPositiveLimit(t *testing.T) {
 	t.Parallel()
 
 	// given
 	cache, _ := NewBigCache(Config{
-		Shards:             8,
-		LifeWindow:         time.Second,
-		MaxEntriesInWindow: 1,
+		Shards:             4,
+		LifeWindow:         time.Minute,
+		MaxEntriesInWindow: 100,
 		MaxEntrySize:       256,
+		StatsEnabled:       true,
 	})
-	keys := 1337
+	cache.Set("key", []byte("value"))
+	cache.Get("key")
 
 	// when
-	for i := 0; i < keys; i++ {
-		cache.Set(fmt.Sprintf("key%d", i), []byte("value"))
-	}
+	none := cache.HotKeys(0)
+	negative := cache.HotKeys(-1)
 
 	// then
-	assertEqual(t, keys, cache.Len())
+	assertEqual(t, 0, len(none))
+	assertEqual(t, true, negative == nil)
 }
 
 func TestCacheCapacity(t *testing.T) {
@@ -487,7 +1020,9 @@ func TestCacheCapacity(t *testing.T) {
 
 	// then
 	assertEqual(t, keys, cache.Len())
-	assertEqual(t, 40960, cache.Capacity())
+	// Shards start with 2560 bytes and grow by 2560 byte segments. An entry never spans two segments, so the
+	// end of a full segment is left unused: two shards need a third segment for their last entry.
+	assertEqual(t, 6*5120+2*7680, cache.Capacity())
 }
 
 func TestCacheInitialCapacity(t *testing.T) {
@@ -585,6 +1120,204 @@ func TestCacheStats(t *testing.T) {
 	assertEqual(t, stats.DelHits, int64(10))
 	assertEqual(t, stats.DelMisses, int64(10))
 }
+func TestCompactionBeforeEvictingForSpace(t *testing.T) {
+	t.Parallel()
+
+	// given
+	var evicted int
+	cache, _ := NewBigCache(Config{
+		Shards:              1,
+		LifeWindow:          time.Minute,
+		MaxEntriesInWindow:  1000,
+		MaxEntrySize:        1100,
+		HardMaxCacheSize:    1,
+		CompactionThreshold: 0.3,
+		OnRemoveWithReason: func(key string, entry []byte, reason RemoveReason) {
+			if reason == NoSpace {
+				evicted++
+			}
+		},
+	})
+	value := blob('a', 1024)
+	for i := 0; i < 700; i++ {
+		cache.Set(fmt.Sprintf("key%d", i), value)
+	}
+	for i := 100; i < 700; i++ {
+		cache.Delete(fmt.Sprintf("key%d", i))
+	}
+
+	// when
+	for i := 700; i < 1300; i++ {
+		cache.Set(fmt.Sprintf("key%d", i), value)
+	}
+
+	// then
+	assertEqual(t, 0, evicted)
+	for i := 0; i < 100; i++ {
+		cachedValue, err := cache.Get(fmt.Sprintf("key%d", i))
+		noError(t, err)
+		assertEqual(t, value, cachedValue)
+	}
+	assertEqual(t, 700, cache.Len())
+	stats := cache.Stats()
+	assertEqual(t, int64(1), stats.Compactions)
+	assertEqual(t, true, stats.ReclaimedBytes >= int64(600*1024))
+}
+
+func TestMmapQueueStorage(t *testing.T) {
+	t.Parallel()
+
+	// given
+	storage, err := queue.NewMmapStorage("")
+	if err != nil {
+		t.Skipf("Memory mapped storage is not available: %v", err)
+	}
+	cache, err := NewBigCache(Config{
+		Shards:              4,
+		LifeWindow:          time.Minute,
+		MaxEntriesInWindow:  10,
+		MaxEntrySize:        256,
+		CompactionThreshold: 0.3,
+		QueueStorage:        storage,
+	})
+	noError(t, err)
+
+	// when
+	for i := 0; i < 2000; i++ {
+		cache.Set(fmt.Sprintf("key%d", i), blob(byte('a'+i%26), 200))
+	}
+	for i := 1000; i < 2000; i++ {
+		cache.Delete(fmt.Sprintf("key%d", i))
+	}
+	for _, shard := range cache.shards {
+		shard.forceCompact()
+	}
+
+	// then
+	for i := 0; i < 1000; i++ {
+		cachedValue, err := cache.Get(fmt.Sprintf("key%d", i))
+		noError(t, err)
+		assertEqual(t, blob(byte('a'+i%26), 200), cachedValue)
+	}
+	assertEqual(t, int64(4), cache.Stats().Compactions)
+	noError(t, cache.Close())
+	assertEqual(t, 0, cache.shards[0].capacity())
+}
+
+func TestMmapQueueStorageAfterClose(t *testing.T) {
+	t.Parallel()
+
+	// given
+	storage, err := queue.NewMmapStorage("")
+	if err != nil {
+		t.Skipf("Memory mapped storage is not available: %v", err)
+	}
+	cache, err := NewBigCache(Config{
+		Shards:              1,
+		LifeWindow:          time.Minute,
+		MaxEntriesInWindow:  10,
+		MaxEntrySize:        256,
+		CompactionThreshold: 0.1,
+		QueueStorage:        storage,
+	})
+	noError(t, err)
+	for i := 0; i < 100; i++ {
+		cache.Set(fmt.Sprintf("key%d", i), blob('a', 200))
+		cache.Delete(fmt.Sprintf("key%d", i))
+	}
+
+	// when
+	errClose := cache.Close()
+	errSet := cache.Set("key", blob('a', 200))
+	errAppend := cache.Append("key", blob('a', 200))
+	_, errGet := cache.Get("key0")
+
+	// then
+	noError(t, errClose)
+	assertEqual(t, ErrCacheClosed, errSet)
+	assertEqual(t, ErrCacheClosed, errAppend)
+	assertEqual(t, ErrEntryNotFound, errGet)
+	assertEqual(t, 0, cache.Len())
+	assertEqual(t, 0, cache.Capacity())
+}
+
+func TestCacheWithHeapStorageIsUsableAfterClose(t *testing.T) {
+	t.Parallel()
+
+	// given
+	cache, _ := NewBigCache(Config{
+		Shards:             4,
+		LifeWindow:         time.Minute,
+		MaxEntriesInWindow: 10,
+		MaxEntrySize:       256,
+	})
+	cache.Set("key", []byte("value"))
+
+	// when
+	errClose := cache.Close()
+	errSet := cache.Set("other", []byte("other value"))
+	value, errGet := cache.Get("key")
+
+	// then
+	noError(t, errClose)
+	noError(t, errSet)
+	noError(t, errGet)
+	assertEqual(t, []byte("value"), value)
+}
+
+func TestCompactionOnCleanUp(t *testing.T) {
+	t.Parallel()
+
+	// given
+	clock := mockedClock{value: 0}
+	cache, _ := newBigCache(Config{
+		Shards:              1,
+		LifeWindow:          time.Minute,
+		MaxEntriesInWindow:  100,
+		MaxEntrySize:        100,
+		CompactionThreshold: 0.05,
+		ResolveCollisions:   true,
+		Hasher:              hashStub(5),
+	}, &clock)
+	for i := 0; i < 10; i++ {
+		cache.Set(fmt.Sprintf("key%d", i), blob('a', 100))
+	}
+
+	// when
+	cache.cleanUp(1)
+
+	// then
+	assertEqual(t, int64(0), cache.Stats().Compactions)
+
+	// when
+	for i := 0; i < 10; i += 2 {
+		cache.Set(fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("value%d", i)))
+	}
+	cache.cleanUp(1)
+
+	// then
+	assertEqual(t, int64(1), cache.Stats().Compactions)
+	for i := 0; i < 10; i++ {
+		cachedValue, err := cache.Get(fmt.Sprintf("key%d", i))
+		noError(t, err)
+		if i%2 == 0 {
+			assertEqual(t, []byte(fmt.Sprintf("value%d", i)), cachedValue)
+		} else {
+			assertEqual(t, blob('a', 100), cachedValue)
+		}
+	}
+
+	// when
+	cache.Delete("key1")
+	cache.Compact()
+
+	// then
+	assertEqual(t, int64(2), cache.Stats().Compactions)
+	assertEqual(t, 9, cache.Len())
+	_, err := cache.Get("key1")
+	assertEqual(t, ErrEntryNotFound, err)
+}
+
 func TestCacheEntryStats(t *testing.T) {
 	t.Parallel()
 
@@ -631,6 +1364,72 @@ func TestCacheDel(t *testing.T) {
 	assertEqual(t, 0, len(cachedValue))
 }
 
+func TestDeletePrefix(t *testing.T) {
+	t.Parallel()
+
+	// given
+	var removed []string
+	cache, _ := NewBigCache(Config{
+		Shards:             8,
+		LifeWindow:         time.Minute,
+		MaxEntriesInWindow: 100,
+		MaxEntrySize:       256,
+		StatsEnabled:       true,
+		OnRemove: func(key string, entry []byte) {
+			removed = append(removed, key)
+		},
+	})
+	for i := 0; i < 20; i++ {
+		cache.Set(fmt.Sprintf("tenant:123:%d", i), []byte("value"))
+		cache.Set(fmt.Sprintf("tenant:1234:%d", i), []byte("value"))
+	}
+
+	// when
+	deleted := cache.DeletePrefix("tenant:123:")
+	_, errDeleted := cache.Get("tenant:123:7")
+	kept, errKept := cache.Get("tenant:1234:7")
+
+	// then
+	assertEqual(t, 20, deleted)
+	assertEqual(t, 20, len(removed))
+	assertEqual(t, 20, cache.Len())
+	assertEqual(t, ErrEntryNotFound, errDeleted)
+	noError(t, errKept)
+	assertEqual(t, []byte("value"), kept)
+	assertEqual(t, int64(20), cache.Stats().DelHits)
+	assertEqual(t, int64(20), cache.Stats().Removals.Deleted)
+}
+
+func TestDeleteMatchingWithCollisionsResolved(t *testing.T) {
+	t.Parallel()
+
+	// given
+	cache, _ := NewBigCache(Config{
+		Shards:             1,
+		LifeWindow:         time.Minute,
+		MaxEntriesInWindow: 10,
+		MaxEntrySize:       256,
+		Hasher:             hashStub(5),
+		ResolveCollisions:  true,
+	})
+	cache.Set("a", []byte("value a"))
+	cache.Set("b", []byte("value b"))
+	cache.Set("c", []byte("value c"))
+
+	// when
+	deleted := cache.DeleteMatching(func(key string) bool {
+		return key != "b"
+	})
+	value, err := cache.Get("b")
+
+	// then
+	assertEqual(t, 2, deleted)
+	assertEqual(t, 1, cache.Len())
+	noError(t, err)
+	assertEqual(t, []byte("value b"), value)
+	assertEqual(t, 0, cache.DeleteMatching(func(key string) bool { return key == "a" }))
+}
+
 // TestCacheDelRandomly does simultaneous deletes, puts and gets, to check for corruption errors.
 func TestCacheDelRandomly(t *testing.T) {
 	t.Parallel()
@@ -949,6 +1748,151 @@ func TestHashCollision(t *testing.T) {
 	assertEqual(t, cache.Stats().Collisions, int64(1))
 }
 
+func TestLeveledLogger(t *testing.T) {
+	t.Parallel()
+
+	// given
+	ll := &mockedLeveledLogger{debug: true}
+	cache, _ := NewBigCache(Config{
+		Shards:             1,
+		LifeWindow:         time.Minute,
+		MaxEntriesInWindow: 1,
+		MaxEntrySize:       256,
+		HardMaxCacheSize:   1,
+		Hasher:             hashStub(5),
+		LeveledLogger:      ll,
+	})
+
+	// when
+	cache.Set("liquid", []byte("value"))
+	cache.Set("costarring", []byte("value 2"))
+	cache.Get("liquid")
+
+	// then
+	assertEqual(t, []string{"DEBUG Collision detected [shard 0 key liquid storedKey costarring hash 5]"}, ll.messages)
+
+}
+
+func TestLeveledLoggerReportsEvictionBurst(t *testing.T) {
+	t.Parallel()
+
+	// given
+	ll := &mockedLeveledLogger{}
+	cache, _ := NewBigCache(Config{
+		Shards:             1,
+		LifeWindow:         time.Minute,
+		MaxEntriesInWindow: 1,
+		MaxEntrySize:       256,
+		HardMaxCacheSize:   1,
+		LeveledLogger:      ll,
+	})
+	for i := 0; i < evictionBurst; i++ {
+		cache.Set(fmt.Sprintf("key-%d", i), blob('a', 1024*50))
+	}
+
+	// when
+	cache.Set("big", blob('b', 1024*1000))
+
+	// then
+	assertEqual(t, []string{"INFO Evicted entries to make room [shard 0 evicted 16 entrySize 1024021 capacity 1026560]"}, ll.messages)
+}
+
+func TestHashCollisionResolved(t *testing.T) {
+	t.Parallel()
+
+	// given
+	cache, _ := NewBigCache(Config{
+		Shards:             16,
+		LifeWindow:         5 * time.Second,
+		MaxEntriesInWindow: 10,
+		MaxEntrySize:       256,
+		Hasher:             hashStub(5),
+		ResolveCollisions:  true,
+	})
+
+	// when
+	cache.Set("liquid", []byte("value"))
+	cache.Set("costarring", []byte("value 2"))
+	cache.Set("costarring", []byte("value 3"))
+
+	// then
+	cachedValue, err := cache.Get("liquid")
+	noError(t, err)
+	assertEqual(t, []byte("value"), cachedValue)
+	cachedValue, err = cache.Get("costarring")
+	noError(t, err)
+	assertEqual(t, []byte("value 3"), cachedValue)
+	assertEqual(t, 2, cache.Len())
+	assertEqual(t, int64(2), cache.Stats().Collisions)
+
+	// when
+	cache.Append("costarring", []byte(" appended"))
+	err = cache.Delete("liquid")
+
+	// then
+	noError(t, err)
+	_, err = cache.Get("liquid")
+	assertEqual(t, ErrEntryNotFound, err)
+	cachedValue, err = cache.Get("costarring")
+	noError(t, err)
+	assertEqual(t, []byte("value 3 appended"), cachedValue)
+	assertEqual(t, 1, cache.Len())
+
+	// when
+	cache.Set("liquid", []byte("value 4"))
+	keys := make(map[string][]byte)
+	iterator := cache.Iterator()
+	for iterator.SetNext() {
+		current, err := iterator.Value()
+		noError(t, err)
+		keys[current.Key()] = current.Value()
+	}
+
+	// then
+	assertEqual(t, map[string][]byte{"liquid": []byte("value 4"), "costarring": []byte("value 3 appended")}, keys)
+}
+
+func TestHashCollisionResolvedEviction(t *testing.T) {
+	t.Parallel()
+
+	// given
+	var removed []string
+	clock := mockedClock{value: 0}
+	cache, _ := newBigCache(Config{
+		Shards:             1,
+		LifeWindow:         time.Second,
+		MaxEntriesInWindow: 10,
+		MaxEntrySize:       256,
+		Hasher:             hashStub(5),
+		ResolveCollisions:  true,
+		OnRemove: func(key string, entry []byte) {
+			removed = append(removed, key)
+		},
+	}, &clock)
+
+	// when
+	cache.Set("a", []byte("1"))
+	cache.Set("b", []byte("2"))
+	cache.Set("a", []byte("3"))
+	clock.set(5)
+	cache.Set("c", []byte("4"))
+
+	// then
+	assertEqual(t, 3, cache.Len())
+
+	// when
+	cache.cleanUp(6)
+
+	// then
+	assertEqual(t, []string{"b", "a"}, removed)
+	_, err := cache.Get("a")
+	assertEqual(t, ErrEntryNotFound, err)
+	cachedValue, err := cache.Get("c")
+	noError(t, err)
+	assertEqual(t, []byte("4"), cachedValue)
+	assertEqual(t, 1, cache.Len())
+}
+
 func TestNilValueCaching(t *testing.T) {
 	t.Parallel()
 
@@ -1075,6 +2019,29 @@ func (ml *mockedLogger) Printf(format string, v ...interface{}) {
 	ml.lastArgs = v
 }
 
+type mockedLeveledLogger struct {
+	messages []string
+	debug    bool // Debug messages are dropped unless set
+}
+
+func (ll *mockedLeveledLogger) Debug(msg string, args ...interface{}) {
+	if ll.debug {
+		ll.messages = append(ll.messages, fmt.Sprintf("DEBUG %s %v", msg, args))
+	}
+}
+
+func (ll *mockedLeveledLogger) Info(msg string, args ...interface{}) {
+	ll.messages = append(ll.messages, fmt.Sprintf("INFO %s %v", msg, args))
+}
+
+func (ll *mockedLeveledLogger) Warn(msg string, args ...interface{}) {
+	ll.messages = append(ll.messages, fmt.Sprintf("WARN %s %v", msg, args))
+}
+
+func (ll *mockedLeveledLogger) Error(msg string, args ...interface{}) {
+	ll.messages = append(ll.messages, fmt.Sprintf("ERROR %s %v", msg, args))
+}
+
 type mockedClock struct {
 	value int64
 }
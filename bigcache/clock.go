@@ -2,13 +2,31 @@ package bigcache
 
 import "time"
 
-type clock interface {
+// Clock is the source of entry timestamps. Epoch returns the current time as a number of
+// Config.ClockResolution units; only differences between two readings matter, so a fake clock
+// used in tests may start at any value.
+// Clock 提供entry的时间戳。Epoch 返回以 Config.ClockResolution 为单位的当前时间，只有两次读数的差值有意义。
+type Clock interface {
 	Epoch() int64
 }
 
+// systemClock reads the monotonic clock, so timestamps are not affected by wall clock changes.
+// 用单调时钟计时，不受系统时间调整的影响
 type systemClock struct {
+	start      time.Time // 带单调时钟读数的起始时间
+	startNanos int64     // start 的 Unix 纳秒，让 Epoch 仍然和 Unix 时间对齐
+	resolution time.Duration
 }
 
-func (c systemClock) Epoch() int64 {
-	return time.Now().Unix()
+func newSystemClock(resolution time.Duration) *systemClock {
+	start := time.Now()
+	return &systemClock{
+		start:      start,
+		startNanos: start.UnixNano(),
+		resolution: resolution,
+	}
+}
+
+func (c *systemClock) Epoch() int64 {
+	return (c.startNanos + int64(time.Since(c.start))) / int64(c.resolution)
 }
@@ -0,0 +1,253 @@
+package bigcache
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Codec compresses entry values. When Config.Codec is set, every entry records the codec its value was
+// compressed with, so entries stored with and without compression coexist in a shard.
+// zstd compression is provided by the separate github.com/allegro/bigcache/v2/zstdcodec module, so the cache
+// itself has no dependencies; other libraries can be plugged in by wrapping them in a type implementing Codec.
+// Codec 负责压缩value。设置了codec的cache，每个entry都记录了它用的codec，所以压缩和没压缩的entry可以同时存在
+// zstd 在单独的 zstdcodec module 里，bigcache本身不依赖第三方库
+type Codec interface {
+	// ID identifies the codec in entries. It must not be 0, which marks uncompressed entries.
+	// 1 and 2 are taken by LZ4Codec and DeflateCodec, 3 by zstdcodec.
+	// 写到entry头里的codec标识，不能是0，0表示没有压缩
+	ID() byte
+	// Encode appends the compressed src to dst and returns the extended buffer.
+	Encode(dst, src []byte) []byte
+	// Decode appends the decompressed src to dst and returns the extended buffer.
+	Decode(dst, src []byte) ([]byte, error)
+}
+
+var (
+	// ErrUnknownCodec is returned when an entry was compressed with a codec other than Config.Codec
+	ErrUnknownCodec = errors.New("Entry compressed with unknown codec")
+	// ErrCorruptedEntry is returned when a compressed entry can not be decoded
+	ErrCorruptedEntry = errors.New("Compressed entry is corrupted")
+)
+
+const (
+	lz4CodecID     = 1
+	deflateCodecID = 2
+)
+
+// LZ4Codec compresses values into LZ4 blocks. It is fast and suits values that are read often.
+// LZ4 块格式压缩，速度快，压缩率一般
+var LZ4Codec Codec = lz4Codec{}
+
+// DeflateCodec compresses values with DEFLATE at the best speed level. It compresses text such as JSON
+// considerably better than LZ4 at a higher CPU cost.
+// DEFLATE 压缩，压缩率比LZ4高，CPU开销也更大
+var DeflateCodec Codec = &deflateCodec{}
+
+type lz4Codec struct{}
+
+func (lz4Codec) ID() byte {
+	return lz4CodecID
+}
+
+// Encode writes the uvarint length of src followed by an LZ4 block
+func (lz4Codec) Encode(dst, src []byte) []byte {
+	var header [binary.MaxVarintLen64]byte
+	dst = append(dst, header[:binary.PutUvarint(header[:], uint64(len(src)))]...)
+	return lz4CompressBlock(dst, src)
+}
+
+func (lz4Codec) Decode(dst, src []byte) ([]byte, error) {
+	length, n := binary.Uvarint(src)
+	if n <= 0 {
+		return dst, ErrCorruptedEntry
+	}
+	return lz4DecompressBlock(dst, src[n:], int(length))
+}
+
+const (
+	lz4MinMatch    = 4
+	lz4HashLog     = 12
+	lz4MaxOffset   = 1<<16 - 1
+	lz4LastLiteral = 5  // 最后5个字节必须是literal
+	lz4MFLimit     = 12 // 最后一个match必须在距结尾12个字节之前开始
+)
+
+// lz4CompressBlock appends src compressed in the LZ4 block format to dst
+// 贪心匹配：用前4个字节的hash找之前出现过的位置
+func lz4CompressBlock(dst, src []byte) []byte {
+	var table [1 << lz4HashLog]int32 // 位置+1，0表示没有
+
+	anchor := 0
+	for i := 0; i+lz4MFLimit < len(src); {
+		sequence := binary.LittleEndian.Uint32(src[i:])
+		h := sequence * 2654435761 >> (32 - lz4HashLog)
+		candidate := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if candidate < 0 || i-candidate > lz4MaxOffset || binary.LittleEndian.Uint32(src[candidate:]) != sequence {
+			i++
+			continue
+		}
+
+		matchLength := lz4MinMatch
+		for i+matchLength < len(src)-lz4LastLiteral && src[candidate+matchLength] == src[i+matchLength] {
+			matchLength++
+		}
+		dst = lz4AppendSequence(dst, src[anchor:i], i-candidate, matchLength)
+		i += matchLength
+		anchor = i
+	}
+
+	return lz4AppendSequence(dst, src[anchor:], 0, 0)
+}
+
+// lz4AppendSequence appends literals followed by a match; the last sequence of a block has no match
+func lz4AppendSequence(dst, literals []byte, offset, matchLength int) []byte {
+	token := byte(15 << 4)
+	if len(literals) < 15 {
+		token = byte(len(literals)) << 4
+	}
+	if matchLength > 0 {
+		if matchLength-lz4MinMatch >= 15 {
+			token |= 15
+		} else {
+			token |= byte(matchLength - lz4MinMatch)
+		}
+	}
+
+	dst = append(dst, token)
+	if len(literals) >= 15 {
+		dst = lz4AppendLength(dst, len(literals)-15)
+	}
+	dst = append(dst, literals...)
+	if matchLength == 0 {
+		return dst
+	}
+	dst = append(dst, byte(offset), byte(offset>>8))
+	if matchLength-lz4MinMatch >= 15 {
+		dst = lz4AppendLength(dst, matchLength-lz4MinMatch-15)
+	}
+	return dst
+}
+
+func lz4AppendLength(dst []byte, length int) []byte {
+	for ; length >= 255; length -= 255 {
+		dst = append(dst, 255)
+	}
+	return append(dst, byte(length))
+}
+
+// lz4DecompressBlock appends the decompressed LZ4 block src, which holds length bytes, to dst
+func lz4DecompressBlock(dst, src []byte, length int) ([]byte, error) {
+	start := len(dst)
+	if cap(dst)-start < length {
+		grown := make([]byte, start, start+length)
+		copy(grown, dst)
+		dst = grown
+	}
+
+	for i := 0; i < len(src); {
+		token := src[i]
+		i++
+
+		literalLength := int(token >> 4)
+		if literalLength == 15 {
+			n, read, ok := lz4ReadLength(src[i:])
+			if !ok {
+				return dst[:start], ErrCorruptedEntry
+			}
+			literalLength += n
+			i += read
+		}
+		if literalLength > len(src)-i || literalLength > start+length-len(dst) {
+			return dst[:start], ErrCorruptedEntry
+		}
+		dst = append(dst, src[i:i+literalLength]...)
+		i += literalLength
+		if i == len(src) {
+			break
+		}
+
+		if i+2 > len(src) {
+			return dst[:start], ErrCorruptedEntry
+		}
+		offset := int(src[i]) | int(src[i+1])<<8
+		i += 2
+		matchLength := int(token&15) + lz4MinMatch
+		if token&15 == 15 {
+			n, read, ok := lz4ReadLength(src[i:])
+			if !ok {
+				return dst[:start], ErrCorruptedEntry
+			}
+			matchLength += n
+			i += read
+		}
+		if offset == 0 || offset > len(dst)-start || matchLength > start+length-len(dst) {
+			return dst[:start], ErrCorruptedEntry
+		}
+		// match 可能和要写的部分重叠，只能一个字节一个字节地拷贝
+		from := len(dst) - offset
+		for j := 0; j < matchLength; j++ {
+			dst = append(dst, dst[from+j])
+		}
+	}
+
+	if len(dst)-start != length {
+		return dst[:start], ErrCorruptedEntry
+	}
+	return dst, nil
+}
+
+func lz4ReadLength(src []byte) (length int, read int, ok bool) {
+	for read < len(src) {
+		b := src[read]
+		read++
+		length += int(b)
+		if b != 255 {
+			return length, read, true
+		}
+	}
+	return 0, read, false
+}
+
+type deflateCodec struct {
+	writers sync.Pool // *flate.Writer，创建一个writer要开辟几百KB的内存，所以复用
+	readers sync.Pool // io.ReadCloser，同时也是 flate.Resetter
+}
+
+func (c *deflateCodec) ID() byte {
+	return deflateCodecID
+}
+
+func (c *deflateCodec) Encode(dst, src []byte) []byte {
+	buf := bytes.NewBuffer(dst)
+	w, _ := c.writers.Get().(*flate.Writer)
+	if w == nil {
+		w, _ = flate.NewWriter(buf, flate.BestSpeed)
+	} else {
+		w.Reset(buf)
+	}
+	w.Write(src)
+	w.Close()
+	c.writers.Put(w)
+	return buf.Bytes()
+}
+
+func (c *deflateCodec) Decode(dst, src []byte) ([]byte, error) {
+	r, _ := c.readers.Get().(io.ReadCloser)
+	if r == nil {
+		r = flate.NewReader(bytes.NewReader(src))
+	} else if err := r.(flate.Resetter).Reset(bytes.NewReader(src), nil); err != nil {
+		return dst, err
+	}
+	buf := bytes.NewBuffer(dst)
+	_, err := buf.ReadFrom(r)
+	c.readers.Put(r)
+	if err != nil {
+		return dst, ErrCorruptedEntry
+	}
+	return buf.Bytes(), nil
+}
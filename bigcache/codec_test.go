@@ -0,0 +1,165 @@
+package bigcache
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCodecsRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	random := make([]byte, 100*1024)
+	rand.New(rand.NewSource(1)).Read(random)
+	inputs := map[string][]byte{
+		"empty":      {},
+		"short":      []byte("abc"),
+		"repeated":   bytes.Repeat([]byte("a"), 100*1024),
+		"json":       []byte(strings.Repeat(`{"id":12345,"name":"bigcache","tags":["fast","concurrent"]},`, 2000)),
+		"random":     random,
+		"far-repeat": append(append(append([]byte{}, random...), random...), 'x'),
+	}
+
+	for _, codec := range []Codec{LZ4Codec, DeflateCodec} {
+		for name, input := range inputs {
+			// when
+			encoded := codec.Encode([]byte("prefix"), input)
+			decoded, err := codec.Decode([]byte("prefix"), encoded[len("prefix"):])
+
+			// then
+			noError(t, err)
+			assertEqual(t, append([]byte("prefix"), input...), decoded, fmt.Sprintf("codec %d, input %s", codec.ID(), name))
+		}
+	}
+}
+
+func TestLZ4Compresses(t *testing.T) {
+	t.Parallel()
+
+	// given
+	input := []byte(strings.Repeat(`{"id":12345,"name":"bigcache"},`, 1000))
+
+	// when
+	encoded := LZ4Codec.Encode(nil, input)
+
+	// then
+	assertEqual(t, true, len(encoded)*10 < len(input))
+}
+
+func TestLZ4DetectsCorruptedBlocks(t *testing.T) {
+	t.Parallel()
+
+	// given
+	encoded := LZ4Codec.Encode(nil, []byte(strings.Repeat("bigcache ", 100)))
+
+	// when
+	_, errTruncated := LZ4Codec.Decode(nil, encoded[:len(encoded)-3])
+	_, errLength := LZ4Codec.Decode(nil, append([]byte{200}, encoded[1:]...))
+	_, errOffset := LZ4Codec.Decode(nil, []byte{8, 0x04, 0xff, 0xff})
+
+	// then
+	assertEqual(t, ErrCorruptedEntry, errTruncated)
+	assertEqual(t, ErrCorruptedEntry, errLength)
+	assertEqual(t, ErrCorruptedEntry, errOffset)
+}
+
+func TestCompressedEntries(t *testing.T) {
+	t.Parallel()
+
+	for _, codec := range []Codec{LZ4Codec, DeflateCodec} {
+		// given
+		cache, _ := NewBigCache(Config{
+			Shards:             1,
+			LifeWindow:         time.Minute,
+			MaxEntriesInWindow: 10,
+			MaxEntrySize:       256,
+			Codec:              codec,
+			CompressionMinSize: 64,
+		})
+		large := []byte(strings.Repeat("compressible ", 100))
+		small := []byte("small")
+
+		// when
+		cache.Set("large", large)
+		cache.Set("small", small)
+		cache.Append("large", []byte("tail"))
+		cache.Append("small", []byte("tail"))
+		largeValue, errLarge := cache.Get("large")
+		smallValue, errSmall := cache.Get("small")
+		into, errInto := cache.GetInto("large", nil)
+		var viewed []byte
+		errFunc := cache.GetFunc("large", func(value []byte) error {
+			viewed = append(viewed, value...)
+			return nil
+		})
+
+		// then
+		expected := append(append([]byte{}, large...), "tail"...)
+		noError(t, errLarge)
+		noError(t, errSmall)
+		noError(t, errInto)
+		noError(t, errFunc)
+		assertEqual(t, expected, largeValue)
+		assertEqual(t, []byte("smalltail"), smallValue)
+		assertEqual(t, expected, into)
+		assertEqual(t, expected, viewed)
+		assertEqual(t, true, cache.Stats().CompressionRatio() > 5)
+	}
+}
+
+func TestCompressedEntriesInIteratorAndCallbacks(t *testing.T) {
+	t.Parallel()
+
+	// given
+	var removed []byte
+	cache, _ := NewBigCache(Config{
+		Shards:             1,
+		LifeWindow:         time.Minute,
+		MaxEntriesInWindow: 10,
+		MaxEntrySize:       256,
+		Codec:              LZ4Codec,
+		OnRemove: func(key string, entry []byte) {
+			removed = entry
+		},
+	})
+	value := []byte(strings.Repeat("compressible ", 100))
+	cache.Set("key", value)
+
+	// when
+	iterator := cache.Iterator()
+	iterator.SetNext()
+	current, err := iterator.Value()
+	cache.Delete("key")
+
+	// then
+	noError(t, err)
+	assertEqual(t, value, current.Value())
+	assertEqual(t, value, removed)
+}
+
+func TestIncompressibleEntriesAreStoredAsIs(t *testing.T) {
+	t.Parallel()
+
+	// given
+	cache, _ := NewBigCache(Config{
+		Shards:             1,
+		LifeWindow:         time.Minute,
+		MaxEntriesInWindow: 10,
+		MaxEntrySize:       256,
+		Codec:              LZ4Codec,
+	})
+	random := make([]byte, 1024)
+	rand.Read(random)
+
+	// when
+	cache.Set("key", random)
+	value, err := cache.Get("key")
+
+	// then
+	noError(t, err)
+	assertEqual(t, random, value)
+	assertEqual(t, float64(1), cache.Stats().CompressionRatio())
+}
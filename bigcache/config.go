@@ -1,6 +1,10 @@
 package bigcache
 
-import "time"
+import (
+	"time"
+
+	"github.com/allegro/bigcache/v2/queue"
+)
 
 // Config for BigCache
 type Config struct {
@@ -11,10 +15,10 @@ type Config struct {
 	// key的统一过期时间。bigcache不支持设置每个key的单独过期时间，一个bigcache实例的所有key的过期时间都是一样的。
 	LifeWindow time.Duration
 	// Interval between removing expired entries (clean up).
-	// If set to <= 0 then no action is performed. Setting to < 1 second is counterproductive — bigcache has a one second resolution.
+	// If set to <= 0 then no action is performed. Setting to less than ClockResolution is counterproductive.
 	// 清除过期entries 的时间间隔（clean up）。
 	// 如果该值小于0，那么就不会再new bigcache的时候启动一个协程去定时的执行cleanUp了。
-	// 不要设置成小于1秒的。bigcache的最小单位是一秒
+	// 不要设置成小于 ClockResolution 的。bigcache默认的最小单位是一秒
 	// 调用cleanUp的时间间隔，就是清除key的时间间隔，每几秒清除一次key。
 	CleanWindow time.Duration
 	// Max number of entries in life window. Used only to calculate initial size for cache shards.
@@ -25,15 +29,61 @@ type Config struct {
 	MaxEntrySize int
 	// StatsEnabled if true calculate the number of times a cached resource was requested.
 	StatsEnabled bool
-	// Verbose mode prints information about new memory allocation
+	// Verbose mode prints information about new memory allocation, collisions and evictions to Logger.
+	// It has no effect when LeveledLogger is set.
 	Verbose bool
 	// Hasher used to map between string keys and unsigned 64bit integers, by default fnv64 hashing is used.
 	Hasher Hasher
+	// ResolveCollisions keeps entries of distinct keys with the same hash side by side. By default a key
+	// overwrites the entry of another key with the same hash, and reading that other key reports a collision.
+	// Colliding keys are counted in Stats.Collisions when they are set.
+	// 开启后，hash相同的不同key可以同时存在（多用一个按key索引的map）。默认情况下后set的key会覆盖hash相同的key。
+	ResolveCollisions bool
+	// CompactionThreshold is the fraction of a shard's queue capacity taken by deleted or overwritten entries
+	// above which the shard's live entries are rewritten into a fresh queue. It is checked on each clean up and
+	// before evicting entries for lack of space. Default value is 0 which means no compaction.
+	// 已删除（被覆盖）的entry占shard容量的比例超过这个值，就把有效的entry重写到新的queue里，回收空间。
+	// 在 cleanUp 和因空间不足要删除最老entry之前检查。0表示不压缩。
+	CompactionThreshold float64
+	// EvictionPolicy chooses the entry removed when a shard is full and HardMaxCacheSize is reached.
+	// Default value is FIFOEviction which removes the oldest entry; ClockEviction keeps recently read entries.
+	// Entries expire after LifeWindow under every policy; ClockEviction gives expired entries no second chance.
+	// 空间不够时的淘汰策略，默认FIFO。ClockEviction 是近似的LRU，会保留最近被读过的entry，但过期时间不变
+	EvictionPolicy EvictionPolicy
+	// Codec compresses values before they are stored, see LZ4Codec, DeflateCodec and zstdcodec.Codec.
+	// Default value is nil which means values are stored as is.
+	// 压缩value用的codec，默认不压缩
+	Codec Codec
+	// CompressionMinSize is the size in bytes below which values are stored uncompressed
+	// 比这个短的value不压缩
+	CompressionMinSize int
 	// HardMaxCacheSize is a limit for cache size in MB. Cache will not allocate more memory than this limit.
 	// It can protect application from consuming all available memory on machine, therefore from running OOM Killer.
 	// Default value is 0 which means unlimited size. When the limit is higher than 0 and reached then
 	// the oldest entries are overridden for the new ones.
 	HardMaxCacheSize int
+	// QueueStorage allocates the memory shards keep their entries in. queue.NewMmapStorage keeps entries in
+	// memory mapped regions outside the Go heap which grow without copying the entries.
+	// Memory of storages other than queue.HeapStorage is released by Close. Default value is nil which means
+	// queue.HeapStorage.
+	// shard存entry的内存从这里分配。queue.NewMmapStorage 用mmap的内存，不在Go的堆上，扩容的时候不用拷贝。
+	// 不是 queue.HeapStorage 的话 Close 的时候释放。默认是nil，也就是 queue.HeapStorage
+	QueueStorage queue.Storage
+	// OverflowDir enables a disk tier in this directory. Entries evicted because HardMaxCacheSize was reached
+	// are appended to segment files there instead of being dropped, and Get and its variants read entries
+	// missing in memory from disk, moving them back to memory. Spilled entries do not trigger OnRemove callbacks.
+	// The directory must not be shared with another cache; segments are removed by NewBigCache, Reset and Close.
+	// Default value is "" which means no disk tier.
+	// 磁盘层的目录。因为 HardMaxCacheSize 被淘汰的entry会写到这个目录的segment文件里，而不是直接丢掉，
+	// get的时候内存里没有就去磁盘上找，找到了再放回内存。写到磁盘上的entry不会触发 OnRemove 回调。
+	OverflowDir string
+	// OverflowMaxSize is a limit for the size of the disk tier in MB. When it is exceeded the oldest segment
+	// is dropped with its entries. Default value is 0 which means unlimited size.
+	// 磁盘层的大小上限（MB），超过了就丢掉最老的segment。0表示不限制
+	OverflowMaxSize int
+	// OverflowSegmentSize is the size in MB after which a new segment file is started. Default value is 64.
+	// 单个segment文件的大小（MB），默认64
+	OverflowSegmentSize int
 	// OnRemove is a callback fired when the oldest entry is removed because of its expiration time or no space left
 	// for the new entry, or because delete was called.
 	// Default value is nil which means no callback and it prevents from unwrapping the oldest entry.
@@ -51,9 +101,35 @@ type Config struct {
 
 	onRemoveFilter int
 
+	// ClockResolution is the unit of entry timestamps: time.Second (the default), time.Millisecond,
+	// time.Nanosecond or any other positive duration. LifeWindow is rounded down to a multiple of it.
+	// entry时间戳的单位，默认是秒。可以设置成毫秒、纳秒，这样 LifeWindow 就可以小于1秒了。
+	ClockResolution time.Duration
+	// Clock supplies entry timestamps in units of ClockResolution.
+	// Defaults to a monotonic system clock.
+	// 时间源，默认是单调的系统时钟。测试的时候可以注入一个假的时钟。
+	Clock Clock
+
 	// Logger is a logging interface and used in combination with `Verbose`
 	// Defaults to `DefaultLogger()`
 	Logger Logger
+	// LeveledLogger receives internal messages with levels and fields like the shard index and sizes,
+	// whatever the value of Verbose. A `*slog.Logger` can be used directly.
+	// 带级别的结构化日志，设置了之后不看 Verbose，所有消息都交给它，由它按级别过滤
+	LeveledLogger LeveledLogger
+}
+
+// queueStorage returns the storage of shard queues
+func (c Config) queueStorage() queue.Storage {
+	if c.QueueStorage == nil {
+		return queue.HeapStorage
+	}
+	return c.QueueStorage
+}
+
+// releasesQueueMemory reports whether Close has to free shard queues. Heap memory is left to the garbage collector.
+func (c Config) releasesQueueMemory() bool {
+	return c.queueStorage() != queue.HeapStorage
 }
 
 // DefaultConfig initializes config with default values.
@@ -73,6 +149,20 @@ func DefaultConfig(eviction time.Duration) Config {
 	}
 }
 
+// clockResolution returns the configured unit of entry timestamps, a second by default
+func (c Config) clockResolution() time.Duration {
+	if c.ClockResolution <= 0 {
+		return time.Second
+	}
+	return c.ClockResolution
+}
+
+// lifeWindowTicks returns LifeWindow in units of the clock resolution
+// 把 LifeWindow 转换成时钟单位
+func (c Config) lifeWindowTicks() uint64 {
+	return uint64(c.LifeWindow / c.clockResolution())
+}
+
 // initialShardSize computes initial shard size
 // 计算初始的shard size
 func (c Config) initialShardSize() int {
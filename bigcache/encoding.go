@@ -9,6 +9,7 @@ const (
 	hashSizeInBytes      = 8                                                       // Number of bytes used for hash hash值的字节数(int64 8字节)
 	keySizeInBytes       = 2                                                       // Number of bytes used for size of entry key
 	headersSizeInBytes   = timestampSizeInBytes + hashSizeInBytes + keySizeInBytes // Number of bytes used for all headers entry头的总字节数
+	codecSizeInBytes     = 1                                                       // Number of bytes used for codec of entry value, only when Config.Codec is set
 )
 
 //封装entry，就是encode呗。 时间戳(8字节)+hash key(8字节)+key 长度(2字节) + key + value
@@ -30,6 +31,20 @@ func wrapEntry(timestamp uint64, hash uint64, key string, entry []byte, buffer *
 	return blob[:blobLength]
 }
 
+// wrapEntryWithCodec wraps an entry of a cache with Config.Codec set: the ID of the codec the value was
+// compressed with, 0 if it is stored as is, follows the value. Caches without a codec use wrapEntry,
+// so their entries are not any longer.
+// 设置了 Config.Codec 的cache用这个封装entry：value后面多1字节codec，0表示没压缩。没有codec的cache不多占这个字节
+func wrapEntryWithCodec(timestamp uint64, hash uint64, key string, value []byte, codec byte, buffer *[]byte) []byte {
+	blobLength := len(value) + headersSizeInBytes + len(key) + codecSizeInBytes
+	if blobLength > len(*buffer) {
+		*buffer = make([]byte, blobLength)
+	}
+	blob := wrapEntry(timestamp, hash, key, value, buffer)[:blobLength]
+	blob[blobLength-1] = codec
+	return blob
+}
+
 // 在 wrappedEntry 上 追加 entry。1. 更新时间戳（前8字节），将原entry放到时间戳之后，然后在接上新的entry
 func appendToWrappedEntry(timestamp uint64, wrappedEntry []byte, entry []byte, buffer *[]byte) []byte {
 	blobLength := len(wrappedEntry) + len(entry)
@@ -58,6 +73,52 @@ func readEntry(data []byte) []byte {
 	return dst
 }
 
+// readEntryView returns the value stored in data without copying it
+// 只取value，不拷贝。返回的切片直接指向queue中的内存
+func readEntryView(data []byte) []byte {
+	length := binary.LittleEndian.Uint16(data[timestampSizeInBytes+hashSizeInBytes:])
+	return data[headersSizeInBytes+int(length):]
+}
+
+// readHeaderAndKeyView returns the part of data before the value without copying it
+// 只取头和key，不拷贝
+func readHeaderAndKeyView(data []byte) []byte {
+	length := binary.LittleEndian.Uint16(data[timestampSizeInBytes+hashSizeInBytes:])
+	return data[:headersSizeInBytes+int(length)]
+}
+
+// readValueView returns the value stored in data without copying it, and the ID of the codec it was
+// compressed with. Entries of caches without a codec have no codec ID and are never compressed.
+// 不拷贝，取value和它的codec。cache没有设置codec的话entry里没有codec字节，value也没有压缩
+func readValueView(data []byte, codec Codec) ([]byte, byte) {
+	value := readEntryView(data)
+	if codec == nil {
+		return value, 0
+	}
+	return value[:len(value)-codecSizeInBytes], value[len(value)-codecSizeInBytes]
+}
+
+// readEntryWithCodec returns a copy of the value stored in data, decompressed if needed
+// 读出value，压缩过的用codec解压
+func readEntryWithCodec(data []byte, codec Codec) ([]byte, error) {
+	if codec == nil {
+		return readEntry(data), nil
+	}
+	return appendEntryWithCodec(nil, data, codec)
+}
+
+// appendEntryWithCodec appends the value stored in data, decompressed if needed, to dst
+func appendEntryWithCodec(dst []byte, data []byte, codec Codec) ([]byte, error) {
+	value, id := readValueView(data, codec)
+	if id == 0 {
+		return append(dst, value...), nil
+	}
+	if codec.ID() != id {
+		return dst, ErrUnknownCodec
+	}
+	return codec.Decode(dst, value)
+}
+
 //只取出entry的时间戳
 func readTimestampFromEntry(data []byte) uint64 {
 	return binary.LittleEndian.Uint64(data)
@@ -81,6 +142,13 @@ func compareKeyFromEntry(data []byte, key string) bool {
 	return bytesToString(data[headersSizeInBytes:headersSizeInBytes+length]) == key
 }
 
+//判断data中的key是否以prefix开头
+func hasKeyPrefixInEntry(data []byte, prefix string) bool {
+	length := int(binary.LittleEndian.Uint16(data[timestampSizeInBytes+hashSizeInBytes:]))
+
+	return length >= len(prefix) && bytesToString(data[headersSizeInBytes:headersSizeInBytes+len(prefix)]) == prefix
+}
+
 //从entry中读hash
 func readHashFromEntry(data []byte) uint64 {
 	return binary.LittleEndian.Uint64(data[timestampSizeInBytes:])
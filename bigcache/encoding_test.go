@@ -42,3 +42,27 @@ func TestAllocateBiggerBuffer(t *testing.T) {
 	assertEqual(t, data, readEntry(wrapped))
 	assertEqual(t, 2+headersSizeInBytes, len(buffer))
 }
+
+func TestEncodeDecodeWithCodec(t *testing.T) {
+	// given
+	now := uint64(time.Now().Unix())
+	hash := uint64(42)
+	key := "key"
+	data := []byte("data")
+	buffer := make([]byte, 1)
+
+	// when
+	wrapped := wrapEntryWithCodec(now, hash, key, data, lz4CodecID, &buffer)
+	value, codec := readValueView(wrapped, LZ4Codec)
+	plain, plainCodec := readValueView(wrapEntry(now, hash, key, data, &buffer), nil)
+
+	// then
+	assertEqual(t, key, readKeyFromEntry(wrapped))
+	assertEqual(t, hash, readHashFromEntry(wrapped))
+	assertEqual(t, now, readTimestampFromEntry(wrapped))
+	assertEqual(t, data, value)
+	assertEqual(t, byte(lz4CodecID), codec)
+	assertEqual(t, headersSizeInBytes+len(key)+len(data)+codecSizeInBytes, len(wrapped))
+	assertEqual(t, data, plain)
+	assertEqual(t, byte(0), plainCodec)
+}
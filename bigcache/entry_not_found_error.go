@@ -5,4 +5,8 @@ import "errors"
 var (
 	// ErrEntryNotFound is an error type struct which is returned when entry was not found for provided key
 	ErrEntryNotFound = errors.New("Entry not found")
+	// ErrNotCounter is returned by Incr and Decr when the value of the key is not an 8-byte counter
+	ErrNotCounter = errors.New("Entry is not an 8-byte counter")
+	// ErrCacheClosed is returned when an entry is set after Close released the memory of the cache
+	ErrCacheClosed = errors.New("Cache is closed")
 )
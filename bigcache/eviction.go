@@ -0,0 +1,119 @@
+package bigcache
+
+import (
+	"container/heap"
+	"sync/atomic"
+)
+
+// EvictionPolicy decides which entry is removed when a shard runs out of space
+// EvictionPolicy 决定shard空间不够时删除哪个entry
+type EvictionPolicy int
+
+const (
+	// FIFOEviction removes the oldest entry, no matter how often it is read. It is the default.
+	// 默认策略：直接删除最老的entry
+	FIFOEviction EvictionPolicy = iota
+	// ClockEviction approximates LRU with the CLOCK algorithm: an entry read since it was last
+	// considered for eviction gets a second chance and is moved to the back of the queue instead.
+	// Entries removed because they expired are not affected.
+	// 近似LRU（CLOCK算法）：最老的entry如果被访问过，就清掉访问标记，把它重新放到队尾，而不是删除它
+	ClockEviction
+)
+
+// accessBitShift maps queue indexes to access bits. Wrapped entries are longer than 1<<accessBitShift
+// bytes, so two entries never share a bit.
+// queue的index右移这么多位就是bit的位置。entry的长度都大于16字节，所以不同的entry不会共用一个bit
+const accessBitShift = 4
+
+// accessBits is a bitmap of recently read entries indexed by their position in the shard queue.
+// Bits are set atomically while holding the shard read lock and are cleared and resized under the write lock.
+// 访问标记：按entry在queue中的位置索引的bitmap。读的时候在读锁下原子地设置，其他操作都在写锁下
+type accessBits struct {
+	words []uint32
+}
+
+// newAccessBits creates a bitmap covering a queue of the given capacity
+func newAccessBits(capacity int) *accessBits {
+	b := &accessBits{}
+	b.fit(capacity)
+	return b
+}
+
+// fit grows the bitmap to cover a queue of the given capacity
+func (b *accessBits) fit(capacity int) {
+	n := capacity>>accessBitShift/32 + 1
+	if n <= len(b.words) {
+		return
+	}
+	words := make([]uint32, n)
+	copy(words, b.words)
+	b.words = words
+}
+
+func (b *accessBits) set(index uint32) {
+	word, bit := b.position(index)
+	for {
+		old := atomic.LoadUint32(word)
+		if old&bit != 0 || atomic.CompareAndSwapUint32(word, old, old|bit) {
+			return
+		}
+	}
+}
+
+func (b *accessBits) clear(index uint32) {
+	b.testAndClear(index)
+}
+
+// testAndClear clears the bit of the entry at index and reports whether it was set
+func (b *accessBits) testAndClear(index uint32) bool {
+	word, bit := b.position(index)
+	for {
+		old := atomic.LoadUint32(word)
+		if old&bit == 0 {
+			return false
+		}
+		if atomic.CompareAndSwapUint32(word, old, old&^bit) {
+			return true
+		}
+	}
+}
+
+func (b *accessBits) reset() {
+	for i := range b.words {
+		atomic.StoreUint32(&b.words[i], 0)
+	}
+}
+
+func (b *accessBits) position(index uint32) (*uint32, uint32) {
+	i := index >> accessBitShift
+	return &b.words[i/32], 1 << (i % 32)
+}
+
+// requeuedEntry records an entry moved to the back of the queue by ClockEviction. The queue is no longer
+// ordered by timestamp behind it, so expiring from the head would not reach it in time.
+// 重新入队的entry排在比它新的entry后面，cleanUp 从队头删除过期entry的时候碰不到它，所以单独记下来
+type requeuedEntry struct {
+	timestamp uint64
+	hash      uint64
+	key       string // 冲突模式下才记录，用来在 collisions 中找到它
+}
+
+// requeuedHeap is a min-heap of requeued entries ordered by timestamp
+// 按时间戳排序的小顶堆，堆顶是最早过期的
+type requeuedHeap []requeuedEntry
+
+func (h requeuedHeap) Len() int            { return len(h) }
+func (h requeuedHeap) Less(i, j int) bool  { return h[i].timestamp < h[j].timestamp }
+func (h requeuedHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *requeuedHeap) Push(x interface{}) { *h = append(*h, x.(requeuedEntry)) }
+
+func (h *requeuedHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = requeuedEntry{}
+	*h = old[:n-1]
+	return e
+}
+
+var _ heap.Interface = (*requeuedHeap)(nil)
@@ -1,6 +1,7 @@
 package bigcache
 
 import (
+	"context"
 	"sync"
 )
 
@@ -16,6 +17,9 @@ const ErrInvalidIteratorState = iteratorError("Iterator is in invalid state. Use
 // ErrCannotRetrieveEntry is reported when entry cannot be retrieved from underlying
 const ErrCannotRetrieveEntry = iteratorError("Could not retrieve entry from cache")
 
+// ErrIteratorClosed is reported by ForEach when the iterator was closed before
+const ErrIteratorClosed = iteratorError("Iterator is closed")
+
 var emptyEntryInfo = EntryInfo{}
 
 // EntryInfo holds informations about entry in the cache
@@ -37,7 +41,7 @@ func (e EntryInfo) Hash() uint64 {
 	return e.hash
 }
 
-// Timestamp returns entry's timestamp (time of insertion)
+// Timestamp returns entry's timestamp (time of insertion) in units of Config.ClockResolution
 func (e EntryInfo) Timestamp() uint64 {
 	return e.timestamp
 }
@@ -47,6 +51,30 @@ func (e EntryInfo) Value() []byte {
 	return e.value
 }
 
+// IteratorOption configures an iterator created by BigCache.Iterator
+type IteratorOption func(*EntryInfoIterator)
+
+// IterateKeysWithPrefix makes the iterator visit only entries whose key starts with prefix.
+// Other entries are skipped before their values are decoded.
+// 只迭代以prefix开头的key
+func IterateKeysWithPrefix(prefix string) IteratorOption {
+	return func(it *EntryInfoIterator) {
+		it.prefix = prefix
+	}
+}
+
+// IterateSnapshot makes the iterator copy all entries of a shard under a single read lock when it moves to
+// the shard. Entries of one shard then come from the same moment: entries removed or overwritten during the
+// iteration are returned as they were when the shard was copied. The copy needs as much memory as the live
+// entries of the largest shard; Close releases it.
+// 快照模式：迭代到一个shard的时候，在一个读锁下把它的所有entry拷贝出来，同一个shard的entry来自同一时刻。
+// 需要能放下最大的shard的所有entry的内存
+func IterateSnapshot() IteratorOption {
+	return func(it *EntryInfoIterator) {
+		it.snapshot = true
+	}
+}
+
 // EntryInfoIterator allows to iterate over entries in the cache
 type EntryInfoIterator struct {
 	mutex            sync.Mutex
@@ -55,68 +83,87 @@ type EntryInfoIterator struct {
 	currentIndex     int
 	currentEntryInfo EntryInfo
 	elements         []uint64
+	collidedKeys     []string // 冲突模式下，当前shard中hash槽被别的key占用的key，排在elements之后
 	elementsCount    int
 	valid            bool
+	prefix           string // 只迭代以它开头的key，空字符串表示全部
+	snapshot         bool
+	snapshotData     []byte // 快照模式下当前shard的entry
+	snapshotOffsets  []int  // 第i个entry是 snapshotData[snapshotOffsets[i]:snapshotOffsets[i+1]]
+	closed           bool
 }
 
 // SetNext moves to next element and returns true if it exists.
 func (it *EntryInfoIterator) SetNext() bool {
 	it.mutex.Lock()
+	defer it.mutex.Unlock()
 
-	it.valid = false
-	it.currentIndex++
+	if it.closed {
+		it.valid = false
+		return false
+	}
 
-	if it.elementsCount > it.currentIndex {
-		it.valid = true
+	// 被删除的或者不匹配prefix的entry跳过，用循环而不是递归，跳过很多entry的时候不会把栈撑大
+	for {
+		it.valid = false
+		it.currentIndex++
 
-		empty := it.setCurrentEntry()
-		it.mutex.Unlock()
+		if it.elementsCount <= it.currentIndex && !it.nextShard() {
+			return false
+		}
+		it.valid = true
 
-		if empty {
-			return it.SetNext()
+		if skipped := it.setCurrentEntry(); !skipped {
+			return true
 		}
-		return true
 	}
+}
 
+// nextShard copies keys of the next non empty shard and returns false if there is none
+func (it *EntryInfoIterator) nextShard() bool {
 	for i := it.currentShard + 1; i < it.cache.config.Shards; i++ {
-		it.elements, it.elementsCount = it.cache.shards[i].copyHashedKeys()
+		it.loadShard(i)
 
 		// Non empty shard - stick with it
 		if it.elementsCount > 0 {
 			it.currentIndex = 0
 			it.currentShard = i
-			it.valid = true
-
-			empty := it.setCurrentEntry()
-			it.mutex.Unlock()
-
-			if empty {
-				return it.SetNext()
-			}
 			return true
 		}
 	}
-	it.mutex.Unlock()
 	return false
 }
 
+// setCurrentEntry reads the entry at the current position and returns true if it should be skipped
 func (it *EntryInfoIterator) setCurrentEntry() bool {
 	var entryNotFound = false
-	entry, err := it.cache.shards[it.currentShard].getEntry(it.elements[it.currentIndex])
+	var entry []byte
+	var err error
+	if it.snapshot {
+		entry = it.snapshotData[it.snapshotOffsets[it.currentIndex]:it.snapshotOffsets[it.currentIndex+1]]
+	} else if it.currentIndex < len(it.elements) {
+		entry, err = it.cache.shards[it.currentShard].getEntry(it.elements[it.currentIndex])
+	} else {
+		entry, err = it.cache.shards[it.currentShard].getCollidedEntry(it.collidedKeys[it.currentIndex-len(it.elements)])
+	}
 
-	if err == ErrEntryNotFound {
+	if err == ErrEntryNotFound || err == nil && it.prefix != "" && !hasKeyPrefixInEntry(entry, it.prefix) {
 		it.currentEntryInfo = emptyEntryInfo
 		entryNotFound = true
 	} else if err != nil {
 		it.currentEntryInfo = EntryInfo{
 			err: err,
 		}
+	} else if value, err := readEntryWithCodec(entry, it.cache.config.Codec); err != nil {
+		it.currentEntryInfo = EntryInfo{
+			err: err,
+		}
 	} else {
 		it.currentEntryInfo = EntryInfo{
 			timestamp: readTimestampFromEntry(entry),
 			hash:      readHashFromEntry(entry),
 			key:       readKeyFromEntry(entry),
-			value:     readEntry(entry),
+			value:     value,
 			err:       err,
 		}
 	}
@@ -124,16 +171,77 @@ func (it *EntryInfoIterator) setCurrentEntry() bool {
 	return entryNotFound
 }
 
-func newIterator(cache *BigCache) *EntryInfoIterator {
-	elements, count := cache.shards[0].copyHashedKeys()
+// copyShardKeys copies hashed keys of the shard, and in collision resolving mode the keys stored by name.
+func copyShardKeys(shard *cacheShard) (elements []uint64, collidedKeys []string, count int) {
+	elements, count = shard.copyHashedKeys()
+	if shard.collisions != nil {
+		collidedKeys = shard.copyCollidedKeys()
+		count += len(collidedKeys)
+	}
+	return elements, collidedKeys, count
+}
+
+// loadShard copies keys of the shard, or its entries in snapshot mode
+func (it *EntryInfoIterator) loadShard(shard int) {
+	if it.snapshot {
+		it.snapshotData, it.snapshotOffsets = it.cache.shards[shard].snapshot(it.snapshotData[:0], it.snapshotOffsets[:0], false)
+		it.elementsCount = len(it.snapshotOffsets) - 1
+		return
+	}
+	it.elements, it.collidedKeys, it.elementsCount = copyShardKeys(it.cache.shards[shard])
+}
+
+func newIterator(cache *BigCache, options ...IteratorOption) *EntryInfoIterator {
+	it := &EntryInfoIterator{
+		cache:        cache,
+		currentShard: 0,
+		currentIndex: -1,
+	}
+	for _, option := range options {
+		option(it)
+	}
+	it.loadShard(0)
+	return it
+}
+
+// Close stops the iteration and releases copied keys and entries. SetNext returns false after Close.
+// 结束迭代，释放拷贝出来的key和entry
+func (it *EntryInfoIterator) Close() error {
+	it.mutex.Lock()
+	it.closed = true
+	it.valid = false
+	it.elements, it.collidedKeys, it.elementsCount = nil, nil, 0
+	it.snapshotData, it.snapshotOffsets = nil, nil
+	it.mutex.Unlock()
+	return nil
+}
 
-	return &EntryInfoIterator{
-		cache:         cache,
-		currentShard:  0,
-		currentIndex:  -1,
-		elements:      elements,
-		elementsCount: count,
+// ForEach calls fn for every remaining entry and closes the iterator. It stops early and returns the error
+// when fn returns one, when an entry can not be read, or when ctx is done.
+// 对剩下的每个entry调用fn，结束后关闭迭代器。fn返回错误、entry读不出来或者ctx结束时提前返回
+func (it *EntryInfoIterator) ForEach(ctx context.Context, fn func(entry EntryInfo) error) error {
+	defer it.Close()
+
+	it.mutex.Lock()
+	closed := it.closed
+	it.mutex.Unlock()
+	if closed {
+		return ErrIteratorClosed
+	}
+
+	for it.SetNext() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		entry, err := it.Value()
+		if err != nil {
+			return err
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
 // Value returns current value from the iterator
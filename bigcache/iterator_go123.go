@@ -0,0 +1,69 @@
+//go:build go1.23
+// +build go1.23
+
+package bigcache
+
+import "iter"
+
+// All returns an iterator over keys and values of the in-memory entries, for use with range-over-func.
+// Like Iterator(IterateSnapshot()), every shard is copied under a single read lock when the iteration reaches it,
+// so entries of one shard come from the same moment. The value is only valid until the next iteration step
+// and must be copied to be kept. Entries in the disk tier are not visited.
+// 用于 range-over-func 的迭代器，每个shard在一个读锁下拷贝一次。value只在当次循环中有效，要保留的话需要拷贝
+func (c *BigCache) All() iter.Seq2[string, []byte] {
+	return func(yield func(key string, value []byte) bool) {
+		var decoded []byte
+		c.walk(false, func(entry []byte) bool {
+			value, codec := readValueView(entry, c.config.Codec)
+			if codec != 0 {
+				var err error
+				if decoded, err = appendEntryWithCodec(decoded[:0], entry, c.config.Codec); err != nil {
+					// 只有换了 Config.Codec 才会解不出来，跳过
+					return true
+				}
+				value = decoded
+			}
+			return yield(readKeyFromEntry(entry), value)
+		})
+	}
+}
+
+// Keys returns an iterator over keys of the in-memory entries. Values are not copied.
+// 只迭代key，不拷贝value
+func (c *BigCache) Keys() iter.Seq[string] {
+	return func(yield func(key string) bool) {
+		c.walk(true, func(entry []byte) bool {
+			return yield(readKeyFromEntry(entry))
+		})
+	}
+}
+
+// EntryInfos returns an iterator over key, hash and timestamp of the in-memory entries, so millions of keys
+// can be listed without copying their values. Value of the yielded EntryInfo is always nil.
+// 只迭代key、hash和时间戳，不拷贝value，EntryInfo.Value() 返回nil
+func (c *BigCache) EntryInfos() iter.Seq[EntryInfo] {
+	return func(yield func(info EntryInfo) bool) {
+		c.walk(true, func(entry []byte) bool {
+			return yield(EntryInfo{
+				timestamp: readTimestampFromEntry(entry),
+				hash:      readHashFromEntry(entry),
+				key:       readKeyFromEntry(entry),
+			})
+		})
+	}
+}
+
+// walk passes snapshots of the entries of every shard, or of their headers and keys only, to fn until it
+// returns false. A single buffer is reused for all shards.
+func (c *BigCache) walk(keysOnly bool, fn func(entry []byte) bool) {
+	var data []byte
+	var offsets []int
+	for _, shard := range c.shards {
+		data, offsets = shard.snapshot(data[:0], offsets[:0], keysOnly)
+		for i := 0; i+1 < len(offsets); i++ {
+			if !fn(data[offsets[i]:offsets[i+1]]) {
+				return
+			}
+		}
+	}
+}
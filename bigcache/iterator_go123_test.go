@@ -0,0 +1,132 @@
+//go:build go1.23
+// +build go1.23
+
+package bigcache
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestAllYieldsKeysAndValues(t *testing.T) {
+	t.Parallel()
+
+	// given
+	cache, _ := NewBigCache(Config{
+		Shards:             8,
+		LifeWindow:         time.Minute,
+		MaxEntriesInWindow: 100,
+		MaxEntrySize:       256,
+		Codec:              LZ4Codec,
+		CompressionMinSize: 64,
+	})
+	for i := 0; i < 100; i++ {
+		cache.Set(fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("value%d", i)))
+	}
+	cache.Set("compressed", blob('c', 200))
+
+	// when
+	values := make(map[string]string)
+	for key, value := range cache.All() {
+		values[key] = string(value)
+	}
+
+	// then
+	assertEqual(t, 101, len(values))
+	assertEqual(t, "value42", values["key42"])
+	assertEqual(t, string(blob('c', 200)), values["compressed"])
+}
+
+func TestKeysAndEntryInfos(t *testing.T) {
+	t.Parallel()
+
+	// given
+	clock := mockedClock{value: 7}
+	cache, _ := newBigCache(Config{
+		Shards:             4,
+		LifeWindow:         time.Minute,
+		MaxEntriesInWindow: 100,
+		MaxEntrySize:       256,
+		Hasher:             hashStub(5),
+		ResolveCollisions:  true,
+	}, &clock)
+	cache.Set("a", []byte("value a"))
+	cache.Set("b", []byte("value b"))
+
+	// when
+	var keys []string
+	for key := range cache.Keys() {
+		keys = append(keys, key)
+	}
+	var infos []EntryInfo
+	for info := range cache.EntryInfos() {
+		infos = append(infos, info)
+	}
+	sort.Strings(keys)
+
+	// then
+	assertEqual(t, []string{"a", "b"}, keys)
+	assertEqual(t, 2, len(infos))
+	for _, info := range infos {
+		assertEqual(t, uint64(5), info.Hash())
+		assertEqual(t, uint64(7), info.Timestamp())
+		assertEqual(t, []byte(nil), info.Value())
+	}
+}
+
+func TestKeysStopsOnBreak(t *testing.T) {
+	t.Parallel()
+
+	// given
+	cache, _ := NewBigCache(Config{
+		Shards:             8,
+		LifeWindow:         time.Minute,
+		MaxEntriesInWindow: 100,
+		MaxEntrySize:       256,
+	})
+	for i := 0; i < 100; i++ {
+		cache.Set(fmt.Sprintf("key%d", i), []byte("value"))
+	}
+
+	// when
+	visited := 0
+	for range cache.Keys() {
+		if visited++; visited == 10 {
+			break
+		}
+	}
+
+	// then
+	assertEqual(t, 10, visited)
+}
+
+func BenchmarkIterateKeys(b *testing.B) {
+	cache, _ := NewBigCache(Config{
+		Shards:             256,
+		LifeWindow:         time.Minute,
+		MaxEntriesInWindow: 100000,
+		MaxEntrySize:       500,
+	})
+	for i := 0; i < 100000; i++ {
+		cache.Set(fmt.Sprintf("key-%d", i), message)
+	}
+
+	b.Run("Iterator", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			it := cache.Iterator()
+			for it.SetNext() {
+				it.Value()
+			}
+		}
+	})
+	b.Run("Keys", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for range cache.Keys() {
+			}
+		}
+	})
+}
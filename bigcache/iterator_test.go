@@ -6,6 +6,7 @@ import (
 	"math/rand"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -44,6 +45,139 @@ func TestEntriesIterator(t *testing.T) {
 	assertEqual(t, keysCount, len(keys))
 }
 
+func TestEntriesIteratorWithKeyPrefix(t *testing.T) {
+	t.Parallel()
+
+	// given
+	cache, _ := NewBigCache(Config{
+		Shards:             8,
+		LifeWindow:         6 * time.Second,
+		MaxEntriesInWindow: 1,
+		MaxEntrySize:       256,
+	})
+	for i := 0; i < 1000; i++ {
+		cache.Set(fmt.Sprintf("tenant:%d:%d", i%10, i), []byte("value"))
+	}
+
+	// when
+	var keys []string
+	iterator := cache.Iterator(IterateKeysWithPrefix("tenant:3:"))
+	for iterator.SetNext() {
+		current, err := iterator.Value()
+		noError(t, err)
+		keys = append(keys, current.Key())
+	}
+
+	// then
+	assertEqual(t, 100, len(keys))
+	for _, key := range keys {
+		assertEqual(t, true, strings.HasPrefix(key, "tenant:3:"))
+	}
+}
+
+func TestSnapshotIteratorReturnsEntriesFromOneMoment(t *testing.T) {
+	t.Parallel()
+
+	// given
+	cache, _ := NewBigCache(Config{
+		Shards:             1,
+		LifeWindow:         6 * time.Second,
+		MaxEntriesInWindow: 1,
+		MaxEntrySize:       256,
+	})
+	for i := 0; i < 100; i++ {
+		cache.Set(fmt.Sprintf("key%d", i), []byte("old"))
+	}
+
+	// when
+	values := make(map[string]string)
+	iterator := cache.Iterator(IterateSnapshot())
+	for i := 0; i < 100; i++ {
+		cache.Set(fmt.Sprintf("key%d", i), []byte("new"))
+		cache.Delete(fmt.Sprintf("key%d", (i+50)%100))
+	}
+	for iterator.SetNext() {
+		current, err := iterator.Value()
+		noError(t, err)
+		values[current.Key()] = string(current.Value())
+	}
+
+	// then
+	assertEqual(t, 100, len(values))
+	for key, value := range values {
+		assertEqual(t, "old", value, key)
+	}
+}
+
+func TestIteratorForEachStopsEarly(t *testing.T) {
+	t.Parallel()
+
+	// given
+	cache, _ := NewBigCache(Config{
+		Shards:             8,
+		LifeWindow:         6 * time.Second,
+		MaxEntriesInWindow: 1,
+		MaxEntrySize:       256,
+	})
+	for i := 0; i < 100; i++ {
+		cache.Set(fmt.Sprintf("key%d", i), []byte("value"))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stop := fmt.Errorf("stop")
+
+	// when
+	visited := 0
+	errCancelled := cache.Iterator(IterateSnapshot()).ForEach(ctx, func(entry EntryInfo) error {
+		if visited++; visited == 10 {
+			cancel()
+		}
+		return nil
+	})
+	visitedBeforeCancel := visited
+	visited = 0
+	errStopped := cache.Iterator().ForEach(context.Background(), func(entry EntryInfo) error {
+		if visited++; visited == 20 {
+			return stop
+		}
+		return nil
+	})
+
+	// then
+	assertEqual(t, context.Canceled, errCancelled)
+	assertEqual(t, 10, visitedBeforeCancel)
+	assertEqual(t, stop, errStopped)
+	assertEqual(t, 20, visited)
+}
+
+func TestIteratorClose(t *testing.T) {
+	t.Parallel()
+
+	// given
+	cache, _ := NewBigCache(Config{
+		Shards:             8,
+		LifeWindow:         6 * time.Second,
+		MaxEntriesInWindow: 1,
+		MaxEntrySize:       256,
+	})
+	cache.Set("key", []byte("value"))
+	iterator := cache.Iterator(IterateSnapshot())
+
+	// when
+	err := iterator.Close()
+	hasNext := iterator.SetNext()
+	_, errValue := iterator.Value()
+	errForEach := iterator.ForEach(context.Background(), func(entry EntryInfo) error {
+		return nil
+	})
+
+	// then
+	noError(t, err)
+	assertEqual(t, false, hasNext)
+	assertEqual(t, ErrInvalidIteratorState, errValue)
+	assertEqual(t, ErrIteratorClosed, errForEach)
+}
+
 func TestEntriesIteratorWithMostShardsEmpty(t *testing.T) {
 	t.Parallel()
 
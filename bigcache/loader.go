@@ -0,0 +1,256 @@
+package bigcache
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Loader loads the value for a key missing from the cache. It returns ErrEntryNotFound when the backend
+// has no value for the key.
+// 从后端加载cache里没有的key，后端也没有的话返回 ErrEntryNotFound
+type Loader func(ctx context.Context, key string) ([]byte, error)
+
+// LoadOption configures a GetOrLoad call
+type LoadOption func(*loadOptions)
+
+type loadOptions struct {
+	timeout     time.Duration
+	notFoundTTL time.Duration
+}
+
+// LoadTimeout bounds the time the loader runs and callers wait for it. The loader gets a context
+// with the deadline; a value it returns later is still stored. Calls made after the timeout start a new
+// loader call even if the late one is still running.
+// 限制loader的运行时间，超时之后loader返回的值还是会存到cache里。超时之后的调用会重新调用loader
+func LoadTimeout(timeout time.Duration) LoadOption {
+	return func(o *loadOptions) {
+		o.timeout = timeout
+	}
+}
+
+// CacheNotFound makes GetOrLoad remember for ttl that the loader returned ErrEntryNotFound for a key,
+// so ErrEntryNotFound is returned without calling the loader until ttl passes or the key is set.
+// Like LifeWindow, ttl is measured by Config.Clock in ticks of Config.ClockResolution, a second by default:
+// it is rounded up to whole ticks and counted from the tick the loader returned in, so the key is forgotten
+// within one tick of ttl.
+// 负缓存：loader返回 ErrEntryNotFound 之后，ttl 时间内不再调用loader，直接返回 ErrEntryNotFound。
+// 和 LifeWindow 一样按时钟的单位（默认一秒）计时，误差在一个单位以内
+func CacheNotFound(ttl time.Duration) LoadOption {
+	return func(o *loadOptions) {
+		o.notFoundTTL = ttl
+	}
+}
+
+// notFoundPruneSize is the smallest number of keys not found by the loader at which expired ones are forgotten
+// without waiting for the janitor, which does not run when CleanWindow is 0
+// notFound 至少有这么多个key的时候才在 GetOrLoad 里清理过期的，CleanWindow 为0的时候没有后台清理
+const notFoundPruneSize = 1024
+
+// loadCall is a loader call shared by all callers of GetOrLoad for a key
+type loadCall struct {
+	done    chan struct{}
+	timeout <-chan struct{} // nil表示没有超时
+	value   []byte
+	err     error
+}
+
+// loadGroup deduplicates loader calls per key and remembers keys the loader did not find
+// 同一个key同时只调用一次loader；记录loader没找到的key
+type loadGroup struct {
+	lock     sync.Mutex
+	calls    map[string]*loadCall
+	notFound map[string]uint64 // key -> 到这个时间戳之前不再调用loader
+	pruneAt  int               // notFound 达到这个大小就清理一次过期的key
+}
+
+func newLoadGroup() *loadGroup {
+	return &loadGroup{
+		calls:    make(map[string]*loadCall),
+		notFound: make(map[string]uint64),
+		pruneAt:  notFoundPruneSize,
+	}
+}
+
+// GetOrLoad reads the entry for the key, and when there is none calls loader and stores the value it returns.
+// Concurrent calls for the same key share a single loader call, so a popular key that expired makes one backend
+// call. The loader runs with the values but not the cancellation of ctx, as other callers may be waiting
+// for it; options of the call that starts loading apply. GetOrLoad returns ctx.Err() when ctx is done first.
+// It returns ErrEntryNotFound when the loader does and the error of the loader when it fails.
+// 读取key，没有的话调用loader加载并存到cache里。同一个key的并发调用共用一次loader调用。
+// loader 拿到的context继承ctx的value但不会被ctx取消，因为可能还有别的调用者在等
+func (c *BigCache) GetOrLoad(ctx context.Context, key string, loader Loader, options ...LoadOption) ([]byte, error) {
+	if value, err := c.Get(key); err != ErrEntryNotFound {
+		return value, err
+	}
+
+	c.loads.lock.Lock()
+	if expiry, ok := c.loads.notFound[key]; ok {
+		if uint64(c.clock.Epoch()) < expiry {
+			c.loads.lock.Unlock()
+			return nil, ErrEntryNotFound
+		}
+		delete(c.loads.notFound, key)
+	}
+	call, ok := c.loads.calls[key]
+	if !ok || call.timedOut() {
+		// 超时的loader可能一直不返回，不能让后面的调用者都等它
+		var o loadOptions
+		for _, option := range options {
+			option(&o)
+		}
+		call = &loadCall{done: make(chan struct{})}
+		c.loads.calls[key] = call
+		var loadCtx context.Context = detachedContext{ctx}
+		cancel := func() {}
+		if o.timeout > 0 {
+			loadCtx, cancel = context.WithTimeout(loadCtx, o.timeout)
+			call.timeout = loadCtx.Done()
+		}
+		go func() {
+			defer cancel()
+			c.load(loadCtx, key, call, loader, o)
+		}()
+	}
+	c.loads.lock.Unlock()
+
+	return c.wait(ctx, key, call)
+}
+
+// wait returns the result of the call once it is done, or an error when its timeout passes or ctx is done first
+func (c *BigCache) wait(ctx context.Context, key string, call *loadCall) ([]byte, error) {
+	select {
+	case <-call.done:
+		return call.result()
+	case <-call.timeout:
+		// select 在几个case都就绪时随机选一个，loader刚好返回了的话还是用它的结果
+		select {
+		case <-call.done:
+			return call.result()
+		default:
+		}
+		c.loads.forget(key, call)
+		return nil, context.DeadlineExceeded
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// result returns the value or the error of a call that is done
+func (call *loadCall) result() ([]byte, error) {
+	if call.err != nil {
+		return nil, call.err
+	}
+	// 每个调用者一份拷贝，和 Get 一样
+	return append([]byte(nil), call.value...), nil
+}
+
+// load calls loader unless the key was set in the meantime, stores the value and wakes up the callers
+func (c *BigCache) load(ctx context.Context, key string, call *loadCall, loader Loader, options loadOptions) {
+	defer func() {
+		if r := recover(); r != nil {
+			call.value, call.err = nil, fmt.Errorf("Loader panicked: %v", r)
+		}
+		c.loads.lock.Lock()
+		c.loads.forgetWithoutLock(key, call)
+		if call.err == ErrEntryNotFound && options.notFoundTTL > 0 {
+			currentTimestamp := uint64(c.clock.Epoch())
+			resolution := c.config.clockResolution()
+			c.loads.notFound[key] = currentTimestamp + uint64((options.notFoundTTL+resolution-1)/resolution)
+			c.loads.pruneWithoutLock(currentTimestamp)
+		}
+		c.loads.lock.Unlock()
+		close(call.done)
+	}()
+
+	// 别的调用者可能在查cache和加入loadGroup之间刚加载完
+	if call.value, call.err = c.Get(key); call.err != ErrEntryNotFound {
+		return
+	}
+	if call.value, call.err = loader(ctx, key); call.err == nil {
+		// 存不下也把值返回给调用者
+		c.Set(key, call.value)
+	}
+}
+
+// timedOut reports whether the timeout of the call passed
+func (call *loadCall) timedOut() bool {
+	select {
+	case <-call.timeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// forget removes the call for key unless it was already replaced by a newer one
+func (g *loadGroup) forget(key string, call *loadCall) {
+	g.lock.Lock()
+	g.forgetWithoutLock(key, call)
+	g.lock.Unlock()
+}
+
+func (g *loadGroup) forgetWithoutLock(key string, call *loadCall) {
+	if g.calls[key] == call {
+		delete(g.calls, key)
+	}
+}
+
+// pruneWithoutLock forgets expired keys not found by the loader once their number doubled since the last
+// pruning, so the map stays within twice the unexpired keys without the janitor at an amortized constant cost
+// key的个数比上次清理后翻倍了就清理一次过期的，均摊下来每次是常数时间
+func (g *loadGroup) pruneWithoutLock(currentTimestamp uint64) {
+	if len(g.notFound) < g.pruneAt {
+		return
+	}
+	g.cleanUpWithoutLock(currentTimestamp)
+	g.pruneAt = 2 * len(g.notFound)
+	if g.pruneAt < notFoundPruneSize {
+		g.pruneAt = notFoundPruneSize
+	}
+}
+
+// cleanUp forgets keys not found by the loader whose ttl passed
+func (g *loadGroup) cleanUp(currentTimestamp uint64) {
+	g.lock.Lock()
+	g.cleanUpWithoutLock(currentTimestamp)
+	g.lock.Unlock()
+}
+
+func (g *loadGroup) cleanUpWithoutLock(currentTimestamp uint64) {
+	for key, expiry := range g.notFound {
+		if currentTimestamp >= expiry {
+			delete(g.notFound, key)
+		}
+	}
+}
+
+// reset forgets all keys not found by the loader
+func (g *loadGroup) reset() {
+	g.lock.Lock()
+	g.notFound = make(map[string]uint64)
+	g.pruneAt = notFoundPruneSize
+	g.lock.Unlock()
+}
+
+// detachedContext keeps the values of its parent but is never cancelled
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
@@ -0,0 +1,265 @@
+package bigcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newLoaderTestCache(clock Clock) *BigCache {
+	cache, _ := newBigCache(Config{
+		Shards:             4,
+		LifeWindow:         time.Minute,
+		MaxEntriesInWindow: 10,
+		MaxEntrySize:       256,
+	}, clock)
+	return cache
+}
+
+func TestGetOrLoadStoresLoadedValue(t *testing.T) {
+	t.Parallel()
+
+	// given
+	cache := newLoaderTestCache(&mockedClock{value: 0})
+	var calls int32
+	loader := func(ctx context.Context, key string) ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		return []byte("value of " + key), nil
+	}
+
+	// when
+	loaded, loadErr := cache.GetOrLoad(context.Background(), "key", loader)
+	cached, cachedErr := cache.GetOrLoad(context.Background(), "key", loader)
+
+	// then
+	noError(t, loadErr)
+	noError(t, cachedErr)
+	assertEqual(t, []byte("value of key"), loaded)
+	assertEqual(t, []byte("value of key"), cached)
+	assertEqual(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestGetOrLoadCallsLoaderOnceForConcurrentCallers(t *testing.T) {
+	t.Parallel()
+
+	// given
+	cache := newLoaderTestCache(&mockedClock{value: 0})
+	var calls int32
+	release := make(chan struct{})
+	loader := func(ctx context.Context, key string) ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return []byte("value"), nil
+	}
+
+	// when
+	var wg sync.WaitGroup
+	values := make([][]byte, 100)
+	for i := range values {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			values[i], _ = cache.GetOrLoad(context.Background(), "key", loader)
+		}(i)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	// then
+	assertEqual(t, int32(1), atomic.LoadInt32(&calls))
+	for _, value := range values {
+		assertEqual(t, []byte("value"), value)
+	}
+}
+
+func TestGetOrLoadCachesNotFound(t *testing.T) {
+	t.Parallel()
+
+	// given
+	clock := &mockedClock{value: 0}
+	cache := newLoaderTestCache(clock)
+	var calls int32
+	loader := func(ctx context.Context, key string) ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, ErrEntryNotFound
+	}
+
+	// when
+	_, firstErr := cache.GetOrLoad(context.Background(), "key", loader, CacheNotFound(5*time.Second))
+	clock.set(4)
+	_, cachedErr := cache.GetOrLoad(context.Background(), "key", loader, CacheNotFound(5*time.Second))
+
+	// then
+	assertEqual(t, ErrEntryNotFound, firstErr)
+	assertEqual(t, ErrEntryNotFound, cachedErr)
+	assertEqual(t, int32(1), atomic.LoadInt32(&calls))
+
+	// when
+	clock.set(5)
+	cache.GetOrLoad(context.Background(), "key", loader, CacheNotFound(5*time.Second))
+
+	// then
+	assertEqual(t, int32(2), atomic.LoadInt32(&calls))
+
+	// when
+	cache.Set("key", []byte("value"))
+	value, err := cache.GetOrLoad(context.Background(), "key", loader)
+
+	// then
+	noError(t, err)
+	assertEqual(t, []byte("value"), value)
+	assertEqual(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestGetOrLoadDoesNotCacheErrors(t *testing.T) {
+	t.Parallel()
+
+	// given
+	cache := newLoaderTestCache(&mockedClock{value: 0})
+	backendErr := errors.New("backend unavailable")
+	var calls int32
+	loader := func(ctx context.Context, key string) ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, backendErr
+	}
+
+	// when
+	_, firstErr := cache.GetOrLoad(context.Background(), "key", loader, CacheNotFound(time.Minute))
+	_, secondErr := cache.GetOrLoad(context.Background(), "key", loader, CacheNotFound(time.Minute))
+
+	// then
+	assertEqual(t, backendErr, firstErr)
+	assertEqual(t, backendErr, secondErr)
+	assertEqual(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestGetOrLoadTimeout(t *testing.T) {
+	t.Parallel()
+
+	// given
+	cache := newLoaderTestCache(&mockedClock{value: 0})
+	loader := func(ctx context.Context, key string) ([]byte, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	// when
+	_, err := cache.GetOrLoad(context.Background(), "key", loader, LoadTimeout(10*time.Millisecond))
+
+	// then
+	assertEqual(t, context.DeadlineExceeded, err)
+}
+
+func TestGetOrLoadReturnsValueOfCallDoneAtItsTimeout(t *testing.T) {
+	t.Parallel()
+
+	// given
+	cache := newLoaderTestCache(&mockedClock{value: 0})
+	closed := make(chan struct{})
+	close(closed)
+	call := &loadCall{done: closed, timeout: closed, value: []byte("value")}
+
+	for i := 0; i < 100; i++ {
+		// when
+		value, err := cache.wait(context.Background(), "key", call)
+
+		// then
+		noError(t, err)
+		assertEqual(t, []byte("value"), value)
+	}
+}
+
+func TestGetOrLoadDoesNotWaitForLoaderPastItsTimeout(t *testing.T) {
+	t.Parallel()
+
+	// given
+	cache := newLoaderTestCache(&mockedClock{value: 0})
+	release := make(chan struct{})
+	defer close(release)
+	stuck := func(ctx context.Context, key string) ([]byte, error) {
+		// ignores ctx
+		<-release
+		return nil, errors.New("late")
+	}
+	loader := func(ctx context.Context, key string) ([]byte, error) {
+		return []byte("value"), nil
+	}
+
+	// when
+	_, timeoutErr := cache.GetOrLoad(context.Background(), "key", stuck, LoadTimeout(10*time.Millisecond))
+	value, err := cache.GetOrLoad(context.Background(), "key", loader)
+
+	// then
+	assertEqual(t, context.DeadlineExceeded, timeoutErr)
+	noError(t, err)
+	assertEqual(t, []byte("value"), value)
+}
+
+func TestGetOrLoadForgetsExpiredNotFoundKeysWithoutJanitor(t *testing.T) {
+	t.Parallel()
+
+	// given
+	clock := mockedClock{value: 0}
+	cache := newLoaderTestCache(&clock)
+	loader := func(ctx context.Context, key string) ([]byte, error) {
+		return nil, ErrEntryNotFound
+	}
+
+	// when
+	for i := 0; i < 10*notFoundPruneSize; i++ {
+		clock.set(int64(i / notFoundPruneSize * 10))
+		cache.GetOrLoad(context.Background(), fmt.Sprintf("key%d", i), loader, CacheNotFound(time.Second))
+	}
+
+	// then
+	assertEqual(t, true, len(cache.loads.notFound) <= 2*notFoundPruneSize)
+}
+
+func TestGetOrLoadReturnsWhenContextIsDone(t *testing.T) {
+	t.Parallel()
+
+	// given
+	cache := newLoaderTestCache(&mockedClock{value: 0})
+	release := make(chan struct{})
+	loader := func(ctx context.Context, key string) ([]byte, error) {
+		<-release
+		return []byte("value"), ctx.Err()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// when
+	cancel()
+	_, err := cache.GetOrLoad(ctx, "key", loader)
+	close(release)
+	// joins the call still running, or reads the value it stored
+	joined, joinErr := cache.GetOrLoad(context.Background(), "key", loader)
+	value, getErr := cache.Get("key")
+
+	// then
+	assertEqual(t, context.Canceled, err)
+	noError(t, joinErr)
+	assertEqual(t, []byte("value"), joined)
+	noError(t, getErr)
+	assertEqual(t, []byte("value"), value)
+}
+
+func TestGetOrLoadRecoversLoaderPanic(t *testing.T) {
+	t.Parallel()
+
+	// given
+	cache := newLoaderTestCache(&mockedClock{value: 0})
+	loader := func(ctx context.Context, key string) ([]byte, error) {
+		panic("boom")
+	}
+
+	// when
+	_, err := cache.GetOrLoad(context.Background(), "key", loader)
+
+	// then
+	assertEqual(t, "Loader panicked: boom", err.Error())
+}
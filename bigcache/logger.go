@@ -1,8 +1,10 @@
 package bigcache
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"strings"
 )
 
 // Logger is invoked when `Config.Verbose=true`
@@ -11,6 +13,17 @@ type Logger interface {
 	Printf(format string, v ...interface{})
 }
 
+// LeveledLogger is a structured logger with levels. Every message comes with args of alternating keys and values,
+// like shard index and sizes, so a `*slog.Logger` from `log/slog` can be used as is.
+// The logger decides which levels are written.
+// 带级别的结构化日志，args是交替的key和value，可以直接用 *slog.Logger。哪些级别要输出由logger自己决定
+type LeveledLogger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
 // this is a safeguard, breaking on compile time in case
 // `log.Logger` does not adhere to our `Logger` interface.
 // see https://golang.org/doc/faq#guarantee_satisfies_interface
@@ -31,3 +44,72 @@ func newLogger(custom Logger) Logger {
 
 	return DefaultLogger()
 }
+
+// newLeveledLogger returns Config.LeveledLogger if set, otherwise Config.Logger writing every level
+// when Config.Verbose is set, or a logger dropping all messages
+func newLeveledLogger(config Config) LeveledLogger {
+	if config.LeveledLogger != nil {
+		return config.LeveledLogger
+	}
+	if config.Verbose {
+		return printfLogger{newLogger(config.Logger)}
+	}
+	return nopLogger{}
+}
+
+// printfLogger writes messages of all levels to a Logger as `LEVEL message key=value ...`
+type printfLogger struct {
+	logger Logger
+}
+
+func (l printfLogger) Debug(msg string, args ...interface{}) { l.log("DEBUG", msg, args) }
+func (l printfLogger) Info(msg string, args ...interface{})  { l.log("INFO", msg, args) }
+func (l printfLogger) Warn(msg string, args ...interface{})  { l.log("WARN", msg, args) }
+func (l printfLogger) Error(msg string, args ...interface{}) { l.log("ERROR", msg, args) }
+
+func (l printfLogger) log(level, msg string, args []interface{}) {
+	var line strings.Builder
+	line.WriteString(level)
+	line.WriteString(" ")
+	line.WriteString(msg)
+	for i := 0; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			fmt.Fprintf(&line, " !BADKEY=%v", args[i])
+			break
+		}
+		fmt.Fprintf(&line, " %v=%v", args[i], args[i+1])
+	}
+	l.logger.Printf("%s", line.String())
+}
+
+// nopLogger drops all messages
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, args ...interface{}) {}
+func (nopLogger) Info(msg string, args ...interface{})  {}
+func (nopLogger) Warn(msg string, args ...interface{})  {}
+func (nopLogger) Error(msg string, args ...interface{}) {}
+
+// fieldsLogger adds the same fields, like the shard index, to every message
+// 给每条日志都加上同样的字段，比如shard的序号
+type fieldsLogger struct {
+	logger LeveledLogger
+	fields []interface{}
+}
+
+// withFields returns logger adding fields to every message
+func withFields(logger LeveledLogger, fields ...interface{}) LeveledLogger {
+	if _, ok := logger.(nopLogger); ok {
+		return logger
+	}
+	return fieldsLogger{logger: logger, fields: fields}
+}
+
+func (l fieldsLogger) Debug(msg string, args ...interface{}) { l.logger.Debug(msg, l.with(args)...) }
+func (l fieldsLogger) Info(msg string, args ...interface{})  { l.logger.Info(msg, l.with(args)...) }
+func (l fieldsLogger) Warn(msg string, args ...interface{})  { l.logger.Warn(msg, l.with(args)...) }
+func (l fieldsLogger) Error(msg string, args ...interface{}) { l.logger.Error(msg, l.with(args)...) }
+
+func (l fieldsLogger) with(args []interface{}) []interface{} {
+	return append(l.fields[:len(l.fields):len(l.fields)], args...)
+}
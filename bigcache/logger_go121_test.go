@@ -0,0 +1,37 @@
+//go:build go1.21
+// +build go1.21
+
+package bigcache
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlogLogger(t *testing.T) {
+	t.Parallel()
+
+	// given
+	var out bytes.Buffer
+	cache, _ := NewBigCache(Config{
+		Shards:             16,
+		LifeWindow:         time.Minute,
+		MaxEntriesInWindow: 10,
+		MaxEntrySize:       256,
+		Hasher:             hashStub(5),
+		LeveledLogger:      slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug})),
+	})
+
+	// when
+	cache.Set("liquid", []byte("value"))
+	cache.Set("costarring", []byte("value 2"))
+	cache.Get("liquid")
+
+	// then
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assertEqual(t, 1, len(lines))
+	assertEqual(t, true, strings.Contains(lines[0], `level=DEBUG msg="Collision detected" shard=5 key=liquid storedKey=costarring hash=5`))
+}
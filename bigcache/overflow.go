@@ -0,0 +1,441 @@
+package bigcache
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	defaultOverflowSegmentSize = 64 // MB
+	overflowRecordHeaderSize   = 8  // 4字节entry长度 + 4字节crc32
+	overflowSegmentPattern     = "bigcache-*.seg"
+	overflowFilterBits         = 16 // presence filter的计数器个数是 1<<overflowFilterBits
+)
+
+// overflowKey identifies an entry of the disk tier. The key is kept next to its hash so that colliding keys
+// get records of their own.
+// 索引用hash+key，hash冲突的key各自有自己的记录
+type overflowKey struct {
+	hash uint64
+	key  string
+}
+
+// overflowLocation is the position of a wrapped entry in a segment file
+type overflowLocation struct {
+	segment   *overflowSegment
+	offset    int64
+	length    int64  // 包括record头
+	timestamp uint64 // entry的时间戳，清理过期entry的时候不用读文件
+}
+
+// overflowSegment is an append-only file of records: entry length, crc32 of the entry and the wrapped entry
+// 只追加的segment文件，每条记录是：entry长度(4字节) + crc32(4字节) + encode好的entry
+type overflowSegment struct {
+	file   *os.File
+	size   int64         // 文件大小
+	live   int64         // 还在索引中的记录的字节数
+	keys   []overflowKey // 写到这个segment的记录的key，按写入顺序，包括已经无效的
+	oldest uint64        // 记录中最小的时间戳，没有过期的可能就不用扫描这个segment
+}
+
+// overflowStore is the disk tier of a cache. Entries evicted from shards for lack of space are appended to
+// the newest segment and read back when a Get misses in memory. Records of entries that were read back,
+// deleted or overwritten stay in their segment until it is compacted: when a new segment is started, older
+// segments that are mostly dead have their live records copied to the new one and are removed. When the
+// segments exceed the size limit, the oldest segment is dropped with all its entries.
+// 磁盘层。shard因空间不足删除的entry会追加到最新的segment里，内存中get不到的时候再从磁盘读回来。
+// 读回、删除、覆盖的entry的记录还在segment里，开新segment的时候，大部分记录都无效的旧segment会被压缩：
+// 有效记录拷贝到新segment，旧文件删除。总大小超过上限就直接丢掉最老的segment。
+// present counts the indexed entries per hash bucket, so that writes of keys that were never evicted can
+// skip the lock without touching the index.
+// present按hash分桶统计索引中的entry数，没有被淘汰过的key不用加锁就知道磁盘层里没有它
+type overflowStore struct {
+	lock        sync.Mutex
+	dir         string
+	segmentSize int64
+	maxSize     int64 // 0表示不限制
+	lifeWindow  uint64
+	segments    []*overflowSegment // 从老到新，最后一个是正在写的
+	index       map[overflowKey]overflowLocation
+	present     []uint32
+	size        int64
+	nextID      int
+	buffer      []byte
+	logger      LeveledLogger
+
+	// onRemove reports entries dropped for lack of space or expired, like a shard reports its removals.
+	// removals collects them under the lock, they are reported after it is released.
+	// 磁盘层因为空间不足或者过期丢掉的entry也要回调和计数。在锁里先收集起来，释放锁之后再回调
+	onRemove func(wrappedEntry []byte, reason RemoveReason)
+	removals []overflowRemoval
+}
+
+// overflowRemoval is an entry dropped from the disk tier waiting to be reported
+type overflowRemoval struct {
+	wrappedEntry []byte
+	reason       RemoveReason
+}
+
+// newOverflowStore creates the disk tier in dir, removing segments left there by a previous process
+func newOverflowStore(config Config) (*overflowStore, error) {
+	if err := os.MkdirAll(config.OverflowDir, 0700); err != nil {
+		return nil, err
+	}
+	stale, err := filepath.Glob(filepath.Join(config.OverflowDir, overflowSegmentPattern))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range stale {
+		if err := os.Remove(name); err != nil {
+			return nil, err
+		}
+	}
+
+	segmentSize := config.OverflowSegmentSize
+	if segmentSize <= 0 {
+		segmentSize = defaultOverflowSegmentSize
+	}
+	o := &overflowStore{
+		dir:         config.OverflowDir,
+		segmentSize: int64(convertMBToBytes(segmentSize)),
+		maxSize:     int64(convertMBToBytes(config.OverflowMaxSize)),
+		lifeWindow:  config.lifeWindowTicks(),
+		index:       make(map[overflowKey]overflowLocation),
+		present:     make([]uint32, 1<<overflowFilterBits),
+		logger:      newLeveledLogger(config),
+	}
+	if err := o.addSegment(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// put appends an evicted entry and reports whether it was stored
+// 把被淘汰的entry写到磁盘，返回是否写成功
+func (o *overflowStore) put(wrappedEntry []byte) bool {
+	o.lock.Lock()
+	defer o.unlockAndReport()
+
+	if len(o.segments) == 0 {
+		// 已经close了
+		return false
+	}
+	key := overflowKey{hash: readHashFromEntry(wrappedEntry), key: readKeyFromEntry(wrappedEntry)}
+	if err := o.append(key, wrappedEntry); err != nil {
+		o.logger.Warn("Could not write entry to overflow segment", "size", len(wrappedEntry), "error", err)
+		return false
+	}
+	if o.segments[len(o.segments)-1].size >= o.segmentSize {
+		if err := o.addSegment(); err != nil {
+			o.logger.Error("Could not create overflow segment", "dir", o.dir, "error", err)
+		} else {
+			o.compact()
+		}
+	}
+	for o.maxSize > 0 && o.size > o.maxSize && len(o.segments) > 1 {
+		o.dropOldestSegment()
+	}
+	return true
+}
+
+// take removes the entry stored for key and returns it, or nil if there is no unexpired entry for key
+// 取出key的entry并从磁盘层删除，没有或者已经过期就返回nil
+func (o *overflowStore) take(key string, hashedKey uint64, currentTimestamp uint64) []byte {
+	if !o.mayContain(hashedKey) {
+		return nil
+	}
+	o.lock.Lock()
+	defer o.unlockAndReport()
+
+	indexKey := overflowKey{hash: hashedKey, key: key}
+	location, ok := o.index[indexKey]
+	if !ok {
+		return nil
+	}
+	o.remove(indexKey, location)
+	wrappedEntry, err := o.read(location)
+	if err != nil {
+		o.logger.Warn("Could not read entry from overflow segment", "error", err)
+		return nil
+	}
+	if currentTimestamp-readTimestampFromEntry(wrappedEntry) > o.lifeWindow {
+		o.removals = append(o.removals, overflowRemoval{wrappedEntry, Expired})
+		return nil
+	}
+	return wrappedEntry
+}
+
+// del removes the entry stored for key and reports whether there was one
+// 磁盘层里没有这个hash的时候不加锁
+func (o *overflowStore) del(key string, hashedKey uint64) bool {
+	if !o.mayContain(hashedKey) {
+		return false
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	indexKey := overflowKey{hash: hashedKey, key: key}
+	location, ok := o.index[indexKey]
+	if !ok {
+		return false
+	}
+	o.remove(indexKey, location)
+	return true
+}
+
+// delMatching removes the entries whose key satisfies match and returns their number
+func (o *overflowStore) delMatching(match func(key string) bool) int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	deleted := 0
+	for indexKey, location := range o.index {
+		if match(indexKey.key) {
+			o.remove(indexKey, location)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// cleanUp forgets expired entries and compacts segments they leave mostly dead. Only segments whose
+// oldest record has expired are scanned.
+// 只扫描最老的记录已经过期的segment
+func (o *overflowStore) cleanUp(currentTimestamp uint64) {
+	o.lock.Lock()
+	defer o.unlockAndReport()
+
+	if len(o.segments) == 0 {
+		return
+	}
+	for _, segment := range o.segments {
+		if len(segment.keys) == 0 || currentTimestamp-segment.oldest <= o.lifeWindow {
+			continue
+		}
+		oldest := currentTimestamp
+		for _, indexKey := range segment.keys {
+			location, ok := o.index[indexKey]
+			if !ok || location.segment != segment {
+				continue
+			}
+			if currentTimestamp-location.timestamp > o.lifeWindow {
+				o.drop(indexKey, location, Expired)
+			} else if location.timestamp < oldest {
+				oldest = location.timestamp
+			}
+		}
+		segment.oldest = oldest
+	}
+	o.compact()
+}
+
+func (o *overflowStore) len() int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return len(o.index)
+}
+
+// reset forgets all entries and truncates all segments into a single empty one
+func (o *overflowStore) reset() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.index = make(map[overflowKey]overflowLocation)
+	o.clearPresent()
+	if len(o.segments) == 0 {
+		return
+	}
+	for len(o.segments) > 1 {
+		o.removeSegment(o.segments[0])
+	}
+	active := o.segments[0]
+	if err := active.file.Truncate(0); err == nil {
+		o.size -= active.size
+		active.size, active.live = 0, 0
+	}
+	active.keys = nil
+}
+
+// close removes all segment files
+func (o *overflowStore) close() error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	var err error
+	for len(o.segments) > 0 {
+		if removeErr := o.removeSegment(o.segments[0]); removeErr != nil {
+			err = removeErr
+		}
+	}
+	o.index = make(map[overflowKey]overflowLocation)
+	o.clearPresent()
+	return err
+}
+
+// append writes a record to the newest segment and indexes it, replacing the record of the same key
+func (o *overflowStore) append(indexKey overflowKey, wrappedEntry []byte) error {
+	length := overflowRecordHeaderSize + len(wrappedEntry)
+	if cap(o.buffer) < length {
+		o.buffer = make([]byte, length)
+	}
+	record := o.buffer[:length]
+	binary.LittleEndian.PutUint32(record, uint32(len(wrappedEntry)))
+	binary.LittleEndian.PutUint32(record[4:], crc32.ChecksumIEEE(wrappedEntry))
+	copy(record[overflowRecordHeaderSize:], wrappedEntry)
+
+	active := o.segments[len(o.segments)-1]
+	if _, err := active.file.WriteAt(record, active.size); err != nil {
+		return err
+	}
+	if previous, ok := o.index[indexKey]; ok {
+		previous.segment.live -= previous.length
+	} else {
+		atomic.AddUint32(o.presentCounter(indexKey.hash), 1)
+	}
+	timestamp := readTimestampFromEntry(wrappedEntry)
+	o.index[indexKey] = overflowLocation{
+		segment:   active,
+		offset:    active.size,
+		length:    int64(length),
+		timestamp: timestamp,
+	}
+	if len(active.keys) == 0 || timestamp < active.oldest {
+		active.oldest = timestamp
+	}
+	active.keys = append(active.keys, indexKey)
+	active.size += int64(length)
+	active.live += int64(length)
+	o.size += int64(length)
+	return nil
+}
+
+// read returns the wrapped entry of a record after checking its checksum
+func (o *overflowStore) read(location overflowLocation) ([]byte, error) {
+	record := make([]byte, location.length)
+	if _, err := location.segment.file.ReadAt(record, location.offset); err != nil {
+		return nil, err
+	}
+	wrappedEntry := record[overflowRecordHeaderSize:]
+	if int(binary.LittleEndian.Uint32(record)) != len(wrappedEntry) ||
+		binary.LittleEndian.Uint32(record[4:]) != crc32.ChecksumIEEE(wrappedEntry) {
+		return nil, fmt.Errorf("corrupted record at offset %d of %s", location.offset, location.segment.file.Name())
+	}
+	return wrappedEntry, nil
+}
+
+func (o *overflowStore) remove(indexKey overflowKey, location overflowLocation) {
+	delete(o.index, indexKey)
+	location.segment.live -= location.length
+	atomic.AddUint32(o.presentCounter(indexKey.hash), ^uint32(0))
+}
+
+// drop removes an entry from the index and queues it to be reported with reason
+func (o *overflowStore) drop(indexKey overflowKey, location overflowLocation, reason RemoveReason) {
+	o.remove(indexKey, location)
+	wrappedEntry, err := o.read(location)
+	if err != nil {
+		o.logger.Warn("Could not read entry from overflow segment", "error", err)
+		return
+	}
+	o.removals = append(o.removals, overflowRemoval{wrappedEntry, reason})
+}
+
+// unlockAndReport releases the lock and reports the entries dropped under it, so that callbacks can use the cache
+// 释放锁，然后回调锁里丢掉的entry，回调里可以再调用cache
+func (o *overflowStore) unlockAndReport() {
+	removals := o.removals
+	o.removals = nil
+	o.lock.Unlock()
+	if o.onRemove == nil {
+		return
+	}
+	for _, removal := range removals {
+		o.onRemove(removal.wrappedEntry, removal.reason)
+	}
+}
+
+// mayContain reports without locking whether an entry of hashedKey may be indexed
+func (o *overflowStore) mayContain(hashedKey uint64) bool {
+	return atomic.LoadUint32(o.presentCounter(hashedKey)) != 0
+}
+
+func (o *overflowStore) presentCounter(hashedKey uint64) *uint32 {
+	return &o.present[hashedKey&(1<<overflowFilterBits-1)]
+}
+
+func (o *overflowStore) clearPresent() {
+	for i := range o.present {
+		atomic.StoreUint32(&o.present[i], 0)
+	}
+}
+
+func (o *overflowStore) addSegment() error {
+	name := filepath.Join(o.dir, fmt.Sprintf("bigcache-%08d.seg", o.nextID))
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	o.nextID++
+	o.segments = append(o.segments, &overflowSegment{file: file})
+	return nil
+}
+
+// compact copies live records of sealed segments that are less than half live to the newest segment
+// and removes those segments
+// 有效记录不到一半的旧segment：把有效记录拷贝到最新的segment，然后删掉旧文件
+func (o *overflowStore) compact() {
+	var sparse []*overflowSegment
+	for _, segment := range o.segments[:len(o.segments)-1] {
+		if segment.live*2 < segment.size {
+			sparse = append(sparse, segment)
+		}
+	}
+	for _, segment := range sparse {
+		for _, indexKey := range segment.keys {
+			location, ok := o.index[indexKey]
+			if !ok || location.segment != segment {
+				continue
+			}
+			wrappedEntry, err := o.read(location)
+			if err != nil {
+				o.logger.Warn("Could not read entry from overflow segment", "error", err)
+				o.remove(indexKey, location)
+				continue
+			}
+			if err := o.append(indexKey, wrappedEntry); err != nil {
+				o.logger.Warn("Could not write entry to overflow segment", "size", len(wrappedEntry), "error", err)
+				o.remove(indexKey, location)
+				o.removals = append(o.removals, overflowRemoval{wrappedEntry, NoSpace})
+			}
+		}
+		o.removeSegment(segment)
+	}
+}
+
+// dropOldestSegment forgets the entries of the oldest segment and removes it
+func (o *overflowStore) dropOldestSegment() {
+	oldest := o.segments[0]
+	for _, indexKey := range oldest.keys {
+		if location, ok := o.index[indexKey]; ok && location.segment == oldest {
+			o.drop(indexKey, location, NoSpace)
+		}
+	}
+	o.removeSegment(oldest)
+}
+
+func (o *overflowStore) removeSegment(segment *overflowSegment) error {
+	for i, s := range o.segments {
+		if s == segment {
+			o.segments = append(o.segments[:i], o.segments[i+1:]...)
+			break
+		}
+	}
+	o.size -= segment.size
+	segment.file.Close()
+	return os.Remove(segment.file.Name())
+}
@@ -0,0 +1,393 @@
+package bigcache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func overflowDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "bigcache-overflow")
+	noError(t, err)
+	return dir
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, overflowSegmentPattern))
+	noError(t, err)
+	return files
+}
+
+func newOverflowCache(t *testing.T, dir string, clock Clock) *BigCache {
+	cache, err := newBigCache(Config{
+		Shards:             1,
+		LifeWindow:         10 * time.Second,
+		MaxEntriesInWindow: 10,
+		MaxEntrySize:       100 * 1024,
+		HardMaxCacheSize:   1,
+		OverflowDir:        dir,
+	}, clock)
+	noError(t, err)
+	return cache
+}
+
+func TestOverflowKeepsEvictedEntries(t *testing.T) {
+	t.Parallel()
+
+	// given
+	dir := overflowDir(t)
+	defer os.RemoveAll(dir)
+	var removed []string
+	cache, _ := NewBigCache(Config{
+		Shards:             1,
+		LifeWindow:         time.Minute,
+		MaxEntriesInWindow: 10,
+		MaxEntrySize:       100 * 1024,
+		HardMaxCacheSize:   1,
+		OverflowDir:        dir,
+		OnRemove: func(key string, entry []byte) {
+			removed = append(removed, key)
+		},
+	})
+	defer cache.Close()
+
+	// when
+	for i := 0; i < 30; i++ {
+		cache.Set(fmt.Sprintf("key%d", i), blob(byte('a'+i%26), 100*1024))
+	}
+	onDisk := cache.overflow.len()
+
+	// then
+	assertEqual(t, 30, cache.Len())
+	assertEqual(t, true, onDisk > 0)
+	assertEqual(t, 0, len(removed))
+	for i := 0; i < 30; i++ {
+		value, err := cache.Get(fmt.Sprintf("key%d", i))
+		noError(t, err)
+		assertEqual(t, blob(byte('a'+i%26), 100*1024), value)
+	}
+	assertEqual(t, 30, cache.Len())
+}
+
+func TestOverflowPromotesEntryOnGet(t *testing.T) {
+	t.Parallel()
+
+	// given
+	dir := overflowDir(t)
+	defer os.RemoveAll(dir)
+	cache := newOverflowCache(t, dir, &mockedClock{value: 0})
+	defer cache.Close()
+	for i := 0; i < 12; i++ {
+		cache.Set(fmt.Sprintf("key%d", i), blob('a', 100*1024))
+	}
+	onDisk := cache.overflow.len()
+
+	// when
+	into, errInto := cache.GetInto("key0", nil)
+
+	// then
+	noError(t, errInto)
+	assertEqual(t, blob('a', 100*1024), into)
+	assertEqual(t, onDisk, cache.overflow.len())
+	assertEqual(t, true, cache.shards[0].containsWithoutLock("key0", cache.hash.Sum64("key0")))
+}
+
+func TestOverflowSetDeleteAndExpire(t *testing.T) {
+	t.Parallel()
+
+	// given
+	dir := overflowDir(t)
+	defer os.RemoveAll(dir)
+	clock := mockedClock{value: 0}
+	cache := newOverflowCache(t, dir, &clock)
+	defer cache.Close()
+	for i := 0; i < 12; i++ {
+		cache.Set(fmt.Sprintf("key%d", i), blob('a', 100*1024))
+	}
+
+	// when
+	cache.Set("key0", []byte("new value"))
+	overwritten, errOverwritten := cache.Get("key0")
+	errDelete := cache.Delete("key1")
+	_, errDeleted := cache.Get("key1")
+	clock.set(11)
+	_, errExpired := cache.Get("key2")
+	cache.cleanUp(uint64(clock.Epoch()))
+
+	// then
+	noError(t, errOverwritten)
+	assertEqual(t, []byte("new value"), overwritten)
+	noError(t, errDelete)
+	assertEqual(t, ErrEntryNotFound, errDeleted)
+	assertEqual(t, ErrEntryNotFound, errExpired)
+	assertEqual(t, 0, cache.overflow.len())
+}
+
+func TestOverflowReportsExpiredEntries(t *testing.T) {
+	t.Parallel()
+
+	// given
+	dir := overflowDir(t)
+	defer os.RemoveAll(dir)
+	clock := mockedClock{value: 0}
+	removed := make(map[string]RemoveReason)
+	cache, err := newBigCache(Config{
+		Shards:             1,
+		LifeWindow:         10 * time.Second,
+		MaxEntriesInWindow: 10,
+		MaxEntrySize:       100 * 1024,
+		HardMaxCacheSize:   1,
+		OverflowDir:        dir,
+		OnRemoveWithReason: func(key string, entry []byte, reason RemoveReason) {
+			removed[key] = reason
+		},
+	}, &clock)
+	noError(t, err)
+	defer cache.Close()
+	for i := 0; i < 12; i++ {
+		cache.Set(fmt.Sprintf("key%d", i), blob('a', 100*1024))
+	}
+	onDisk := cache.overflow.len()
+
+	// when
+	clock.set(11)
+	_, errExpired := cache.Get("key0")
+	afterGet := len(removed)
+	cache.cleanUp(uint64(clock.Epoch()))
+	stats := cache.Stats()
+
+	// then
+	assertEqual(t, true, onDisk > 0)
+	assertEqual(t, ErrEntryNotFound, errExpired)
+	assertEqual(t, 1, afterGet)
+	assertEqual(t, Expired, removed["key0"])
+	assertEqual(t, 12, len(removed))
+	for i := 0; i < 12; i++ {
+		assertEqual(t, Expired, removed[fmt.Sprintf("key%d", i)])
+	}
+	assertEqual(t, int64(12), stats.Removals.Expired)
+	assertEqual(t, int64(0), stats.Removals.NoSpace)
+	assertEqual(t, 0, cache.Len())
+}
+
+func TestOverflowReportsEntriesDroppedForSize(t *testing.T) {
+	t.Parallel()
+
+	// given
+	dir := overflowDir(t)
+	defer os.RemoveAll(dir)
+	removed := make(map[string]RemoveReason)
+	cache, err := newBigCache(Config{
+		Shards:             1,
+		LifeWindow:         time.Minute,
+		MaxEntriesInWindow: 10,
+		MaxEntrySize:       100 * 1024,
+		HardMaxCacheSize:   1,
+		OverflowDir:        dir,
+		OnRemoveWithReason: func(key string, entry []byte, reason RemoveReason) {
+			removed[key] = reason
+		},
+	}, &mockedClock{value: 0})
+	noError(t, err)
+	defer cache.Close()
+	cache.overflow.segmentSize = 200 * 1024
+	cache.overflow.maxSize = 400 * 1024
+
+	// when
+	for i := 0; i < 30; i++ {
+		cache.Set(fmt.Sprintf("key%d", i), blob('a', 100*1024))
+	}
+	stats := cache.Stats()
+
+	// then
+	assertEqual(t, true, len(removed) > 0)
+	assertEqual(t, 30, cache.Len()+len(removed))
+	for key, reason := range removed {
+		assertEqual(t, NoSpace, reason)
+		_, err := cache.Get(key)
+		assertEqual(t, ErrEntryNotFound, err)
+	}
+	assertEqual(t, int64(len(removed)), stats.Removals.NoSpace)
+	assertEqual(t, true, stats.RemovedBytes.NoSpace > int64(len(removed)*100*1024))
+}
+
+func TestOverflowDeletePrefix(t *testing.T) {
+	t.Parallel()
+
+	// given
+	dir := overflowDir(t)
+	defer os.RemoveAll(dir)
+	clock := mockedClock{value: 0}
+	cache := newOverflowCache(t, dir, &clock)
+	defer cache.Close()
+	for i := 0; i < 12; i++ {
+		cache.Set(fmt.Sprintf("tenant:%d:%d", i%2, i), blob('a', 100*1024))
+	}
+	onDisk := cache.overflow.len()
+
+	// when
+	deleted := cache.DeletePrefix("tenant:0:")
+	_, errDeleted := cache.Get("tenant:0:0")
+	_, errKept := cache.Get("tenant:1:1")
+
+	// then
+	assertEqual(t, true, onDisk > 0)
+	assertEqual(t, 6, deleted)
+	assertEqual(t, ErrEntryNotFound, errDeleted)
+	noError(t, errKept)
+}
+
+func TestOverflowSegmentsAreCompactedAndBounded(t *testing.T) {
+	t.Parallel()
+
+	// given
+	dir := overflowDir(t)
+	defer os.RemoveAll(dir)
+	store, err := newOverflowStore(Config{OverflowDir: dir, LifeWindow: time.Minute, Logger: &mockedLogger{}})
+	noError(t, err)
+	defer store.close()
+	store.segmentSize = 4 * 1024
+	buffer := make([]byte, 0)
+	put := func(i int) {
+		key := fmt.Sprintf("key%d", i)
+		store.put(wrapEntry(0, uint64(i+1), key, blob('a', 1000), &buffer))
+	}
+
+	// when
+	for i := 0; i < 20; i++ {
+		put(i)
+		if i%4 != 3 {
+			store.take(fmt.Sprintf("key%d", i), uint64(i+1), 0)
+		}
+	}
+	compacted := len(segmentFiles(t, dir))
+	store.maxSize = 8 * 1024
+	put(20)
+
+	// then
+	assertEqual(t, true, compacted < 5)
+	assertEqual(t, true, store.size <= store.maxSize+store.segmentSize)
+	assertEqual(t, len(store.segments), len(segmentFiles(t, dir)))
+	for indexKey, location := range store.index {
+		wrappedEntry, err := store.read(location)
+		noError(t, err)
+		assertEqual(t, indexKey.hash, readHashFromEntry(wrappedEntry))
+		assertEqual(t, indexKey.key, readKeyFromEntry(wrappedEntry))
+	}
+	assertEqual(t, true, store.take("key19", 20, 0) != nil)
+}
+
+func TestOverflowKeepsCollidingKeys(t *testing.T) {
+	t.Parallel()
+
+	// given
+	dir := overflowDir(t)
+	defer os.RemoveAll(dir)
+	cache, err := newBigCache(Config{
+		Shards:             1,
+		LifeWindow:         10 * time.Second,
+		MaxEntriesInWindow: 10,
+		MaxEntrySize:       100 * 1024,
+		HardMaxCacheSize:   1,
+		OverflowDir:        dir,
+		ResolveCollisions:  true,
+		Hasher:             hashStub(5),
+	}, &mockedClock{value: 0})
+	noError(t, err)
+	defer cache.Close()
+
+	// when
+	for i := 0; i < 12; i++ {
+		cache.Set(fmt.Sprintf("key%d", i), blob(byte('a'+i), 100*1024))
+	}
+	onDisk := cache.overflow.len()
+
+	// then
+	assertEqual(t, true, onDisk > 1)
+	for i := 0; i < 12; i++ {
+		value, err := cache.Get(fmt.Sprintf("key%d", i))
+		noError(t, err)
+		assertEqual(t, blob(byte('a'+i), 100*1024), value)
+	}
+}
+
+func TestOverflowSkipsLockForKeysNeverEvicted(t *testing.T) {
+	t.Parallel()
+
+	// given
+	dir := overflowDir(t)
+	defer os.RemoveAll(dir)
+	store, err := newOverflowStore(Config{OverflowDir: dir, LifeWindow: time.Minute, Logger: &mockedLogger{}})
+	noError(t, err)
+	defer store.close()
+	buffer := make([]byte, 0)
+	store.put(wrapEntry(0, 1, "key1", blob('a', 10), &buffer))
+
+	// when
+	store.lock.Lock()
+	missing := store.del("key2", 2)
+	absent := store.take("key2", 2, 0)
+	store.lock.Unlock()
+	present := store.mayContain(1)
+	deleted := store.del("key1", 1)
+
+	// then
+	assertEqual(t, false, missing)
+	assertEqual(t, true, absent == nil)
+	assertEqual(t, true, present)
+	assertEqual(t, true, deleted)
+	assertEqual(t, false, store.mayContain(1))
+}
+
+func TestOverflowCleanUpDropsExpiredSegments(t *testing.T) {
+	t.Parallel()
+
+	// given
+	dir := overflowDir(t)
+	defer os.RemoveAll(dir)
+	store, err := newOverflowStore(Config{OverflowDir: dir, LifeWindow: 10 * time.Second, Logger: &mockedLogger{}})
+	noError(t, err)
+	defer store.close()
+	store.segmentSize = 4 * 1024
+	buffer := make([]byte, 0)
+	for i := 0; i < 8; i++ {
+		store.put(wrapEntry(uint64(i*2), uint64(i+1), fmt.Sprintf("key%d", i), blob('a', 1000), &buffer))
+	}
+
+	// when
+	store.cleanUp(19)
+
+	// then
+	assertEqual(t, 3, store.len())
+	assertEqual(t, 2, len(store.segments))
+	assertEqual(t, uint64(10), store.segments[0].oldest)
+	assertEqual(t, true, store.take("key4", 5, 19) == nil)
+	assertEqual(t, true, store.take("key5", 6, 19) != nil)
+}
+
+func TestOverflowFilesAreRemoved(t *testing.T) {
+	t.Parallel()
+
+	// given
+	dir := overflowDir(t)
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "bigcache-99999999.seg"), []byte("stale"), 0600)
+	cache := newOverflowCache(t, dir, &mockedClock{value: 0})
+	for i := 0; i < 12; i++ {
+		cache.Set(fmt.Sprintf("key%d", i), blob('a', 100*1024))
+	}
+
+	// when
+	afterStart := segmentFiles(t, dir)
+	cache.Reset()
+	afterReset := cache.Len()
+	cache.Close()
+
+	// then
+	assertEqual(t, []string{filepath.Join(dir, "bigcache-00000000.seg")}, afterStart)
+	assertEqual(t, 0, afterReset)
+	assertEqual(t, 0, len(segmentFiles(t, dir)))
+}
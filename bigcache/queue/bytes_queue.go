@@ -2,44 +2,72 @@ package queue
 
 import (
 	"encoding/binary"
-	"log"
 	"time"
 )
 
 const (
-	// Number of bytes to encode 0 in uvarint format 以uvarint格式编码为0的字节数
-	minimumHeaderSize = 17 // 1 byte blobsize + timestampSizeInBytes + hashSizeInBytes
 	// Bytes before left margin are not used. Zero index means element does not exist in queue, useful while reading slice from index
 	leftMarginIndex = 1
+	// Segment size of queues created without initial capacity 没有初始容量的queue的segment大小
+	defaultSegmentSize = 4096
 )
 
 var (
 	errEmptyQueue       = &queueError{"Empty queue"}
 	errInvalidIndex     = &queueError{"Index must be greater than zero. Invalid index."}
 	errIndexOutOfBounds = &queueError{"Index out of range"}
+	errFullQueue        = &queueError{"Full queue. Maximum size limit reached."}
+	errQueueFreed       = &queueError{"Queue memory was freed"}
+	errMmapUnsupported  = &queueError{"Memory mapped storage is not supported on this platform"}
 )
 
 // BytesQueue is a non-thread safe queue type of fifo based on bytes array.
 // For every push operation index of entry is returned. It can be used to read the entry later
+// Memory is allocated in regions of a multiple of a fixed segment size, the initial capacity of the queue.
+// Regions follow each other in the index space, so an index stays valid as long as its entry is in the queue.
+// The regions are split into segments linked in a ring in the order they are written. The queue grows by linking
+// a new segment after the one being written, so entries are never copied. An entry never spans two segments: when
+// it does not fit in the rest of a segment, the queue moves on to the next free segment and remembers where the
+// data of the left segment ends.
 // BytesQueue是基于字节数组的fifo的非线程安全队列类型。
 //对于每个推入操作，返回条目的索引。 以后可以用来阅读条目
+// 内存按固定的segment大小（queue的初始容量）的整数倍分配，index是所有内存区域首尾相接之后的偏移。
+// 扩容就是分配一块新的内存，作为一个segment接在正在写的segment后面，已有的entry不用拷贝，index也不会变。
 type BytesQueue struct {
-	full        bool   // 是否满了
-	array       []byte // 字节数组
-	capacity    int    // 目前容量（单位byte）
-	maxCapacity int    // 最大容量
-	head        int    // 头指针
-	tail        int    // 尾指针
-	count       int    // 应该是条目数量
-	//rightMargin代表的是有数据的右边界
-	// 1. 如果正常状态tail>head: leftMargin(1) -> head(30) -> tail,rightMargin(90) -> capacity(100)
-	// rightMargin == tail
-	// 2. 如果head > tail: leftMargin(1) -> tail(20) -> head(30) -> rightMargin(90) -> capacity(100)
-	// 这是在1的基础上再push一个20的数据，因为capacity-tail=10<20，所以tail之后不能插入，但是head-leftMargin=29>20所以可以插入到head前。
-	// 所以直接空着tail-capacity的10空间，直接在leftMargin往后开辟空间。
-	rightMargin  int    // 有边界
+	full        bool      // 是否满了
+	regions     []region  // 分配的内存，按index从小到大
+	slots       []int32   // 第i个 segmentSize 大小的index区间属于哪块内存
+	segments    []segment // 按写入顺序连成环
+	segmentSize int       // 每次扩容至少分配这么多
+	capacity    int       // 目前容量（单位byte）
+	maxCapacity int       // 最大容量
+	head        int       // 头指针
+	headSegment int       // 头指针所在的segment
+	tail        int       // 尾指针
+	tailSegment int       // 尾指针所在的segment
+	count       int       // 条目数量
+	used        int       // 条目占用的字节数（包括header）
+
 	headerBuffer []byte // 这个会临时存要存入queue的data的长度，而且这个长度还是用varint编码的
-	verbose      bool   //是否开启日志？
+	logger       Logger // nil表示不输出日志
+	storage      Storage
+	freed        bool // Free 之后就不能再用了
+}
+
+// region is a block of memory allocated from the storage
+type region struct {
+	data []byte
+	base int // data[0] 的index
+}
+
+// segment is a part of a region written from its origin towards its wall
+// 环中的一段内存。tail从origin往wall写，写不下了就跳到下一个segment，同时记下这个segment数据的结尾
+type segment struct {
+	origin int // 第一个可以写的index
+	wall   int // 最后一个字节之后的index
+	start  int // head 进入这个segment时从哪里开始读，一般就是origin
+	end    int // 数据的结尾，tail 离开这个segment的时候设置，在那之前是wall
+	next   int // 环中的下一个segment
 }
 
 type queueError struct {
@@ -66,46 +94,91 @@ func getUvarintSize(x uint32) int {
 // capacity is used in bytes array allocation 参数capacity用来分配内存
 // When verbose flag is set then information about memory allocation are printed verbose设置后，内存分配会被输出
 func NewBytesQueue(capacity int, maxCapacity int, verbose bool) *BytesQueue {
-	return &BytesQueue{
-		array:        make([]byte, capacity),
-		capacity:     capacity,
+	q, _ := NewBytesQueueWithStorage(capacity, maxCapacity, verbose, HeapStorage)
+	return q
+}
+
+// NewBytesQueueWithStorage initializes new bytes queue keeping its entries in memory allocated by storage.
+// capacity is also the segment size the queue grows by.
+// Free must be called to release the memory when the queue is no longer used.
+// 用storage分配的内存初始化一个新的字节队列，capacity也是每次扩容的segment大小。不用了要调用 Free 释放内存
+func NewBytesQueueWithStorage(capacity int, maxCapacity int, verbose bool, storage Storage) (*BytesQueue, error) {
+	if capacity <= 0 {
+		capacity = defaultSegmentSize
+	}
+	q := &BytesQueue{
+		segmentSize:  capacity,
 		maxCapacity:  maxCapacity,
 		headerBuffer: make([]byte, binary.MaxVarintLen32), //5字节长度？
-		tail:         leftMarginIndex,
-		head:         leftMarginIndex,
-		rightMargin:  leftMarginIndex,
-		verbose:      verbose,
+		storage:      storage,
+	}
+	if verbose {
+		q.logger = stdLogger{}
+	}
+	if err := q.addRegion(capacity); err != nil {
+		return nil, err
 	}
+	q.segments = []segment{{origin: leftMarginIndex, wall: capacity}}
+	q.Reset()
+	return q, nil
+}
+
+// SetLogger makes the queue report memory allocation to logger, or nothing when logger is nil
+// 设置输出内存分配信息的logger，nil表示不输出
+func (q *BytesQueue) SetLogger(logger Logger) {
+	q.logger = logger
 }
 
 // Reset removes all entries from queue 重置
 func (q *BytesQueue) Reset() {
 	// Just reset indexes
+	for i := range q.segments {
+		q.segments[i].start = q.segments[i].origin
+		q.segments[i].end = q.segments[i].wall
+	}
 	q.tail = leftMarginIndex
 	q.head = leftMarginIndex
-	q.rightMargin = leftMarginIndex
+	q.tailSegment = 0
+	q.headSegment = 0
 	q.count = 0
+	q.used = 0
 	q.full = false
 }
 
+// Free removes all entries and releases the memory of the queue. Push fails after Free.
+// 释放queue的内存，之后就不能再Push了
+func (q *BytesQueue) Free() error {
+	if q.freed {
+		return nil
+	}
+	q.Reset()
+	var err error
+	for _, r := range q.regions {
+		if freeErr := q.storage.Free(r.data); freeErr != nil {
+			err = freeErr
+		}
+	}
+	q.regions, q.slots, q.segments = nil, nil, nil
+	q.capacity = 0
+	q.freed = true
+	return err
+}
+
 // Push copies entry at the end of queue and moves tail pointer. Allocates more space if needed.
 // Returns index for pushed data or error if maximum size queue limit is reached.
 // Push 拷贝entry到queue的尾部，然后移动tail指针。如果需要，会分配更多空间。
 // 返回存入之后的数据的index，或者如果超出限制就返回error
 func (q *BytesQueue) Push(data []byte) (int, error) {
+	if q.freed {
+		return -1, errQueueFreed
+	}
 	dataLen := len(data)
 	headerEntrySize := getUvarintSize(uint32(dataLen)) //对数据的长度进行了varint编码
 
-	if !q.canInsertAfterTail(dataLen + headerEntrySize) {
-		if q.canInsertBeforeHead(dataLen + headerEntrySize) {
-			//这个if就是判断的leftMarginIndex -> head 的空间够不够。因为当head>tail的时候，canInsertAfterTail判断了
-			q.tail = leftMarginIndex
-		} else if q.capacity+headerEntrySize+dataLen >= q.maxCapacity && q.maxCapacity > 0 {
-			//如果装的最大数据已经超过 maxCapacity 就直接返回full queue
-			return -1, &queueError{"Full queue. Maximum size limit reached."}
-		} else {
-			//否则就扩充内存
-			q.allocateAdditionalMemory(dataLen + headerEntrySize)
+	if !q.moveTail(dataLen + headerEntrySize) {
+		//现有的segment都放不下，就扩充内存
+		if err := q.allocateAdditionalMemory(dataLen + headerEntrySize); err != nil {
+			return -1, err
 		}
 	}
 
@@ -116,48 +189,158 @@ func (q *BytesQueue) Push(data []byte) (int, error) {
 	return index, nil
 }
 
-func (q *BytesQueue) allocateAdditionalMemory(minimum int) {
-	start := time.Now()
-	if q.capacity < minimum {
-		q.capacity += minimum //如果capacity本身比需求的内存少，就先加上需求的内存的容量（这样可以避免扩容后仍然不满足要求）
-	}
-	q.capacity = q.capacity * 2 //2倍扩容
-	if q.capacity > q.maxCapacity && q.maxCapacity > 0 {
-		q.capacity = q.maxCapacity //超过限制只给最大限制的容量
-	}
-
-	oldArray := q.array
-	q.array = make([]byte, q.capacity) //重新开辟空间
-
-	if leftMarginIndex != q.rightMargin { //这代表queue不空
-		copy(q.array, oldArray[:q.rightMargin])
-
-		if q.tail <= q.head {
-			if q.tail != q.head { //不满也不空
-				headerEntrySize := getUvarintSize(uint32(q.head - q.tail))
-				emptyBlobLen := q.head - q.tail - headerEntrySize
-				//todo 这里push的count++后是不是就多加了1了？而且临界值好像不准啊。
-				//如果长度正好是128，那么在这么计算之后，填充的是127？
-				// 我认为这是一个bug，并给作者提了issue ： https://github.com/allegro/bigcache/issues/253
-				// 在v2.2.1 - v3.0.0 (我阅读代码时候的版本) 都有这个bug。而且我认为修复起来很麻烦。
-				// 如果没有后续版本，最好用 v2.2.0 以及之前版本
-
-				// 为啥要push一个空byte到free space，因为head和tail要被重置。head会被重置到最前面
-				// 如果我们之后有pop操作，会从head pop一个元素，这个一个元素就是varintSize+bug，空的那一块没有varint，所以解析不出来
-				// 然后这里push操作就是将这块空space，varint一下，符合编码~
-				q.push(make([]byte, emptyBlobLen), emptyBlobLen) //清空中间空出来那块tail->head
+// moveTail makes room for need bytes at the tail, moving it to the next free segment with enough room if needed.
+// It returns false if no segment has enough room.
+// 让tail处能写下need个字节，当前segment写不下就跳到后面第一个写得下的空闲segment。都写不下返回false
+func (q *BytesQueue) moveTail(need int) bool {
+	if q.full {
+		return false
+	}
+	tail := &q.segments[q.tailSegment]
+	if q.tailSegment == q.headSegment && q.tail < q.head {
+		// tail 绕了一圈回到了head所在的segment，只能写到head之前
+		return q.head-q.tail >= need
+	}
+	if tail.wall-q.tail >= need {
+		return true
+	}
+	for next := tail.next; ; next = q.segments[next].next {
+		s := &q.segments[next]
+		if next == q.headSegment {
+			// head所在的segment只有head之前的部分是空的
+			if q.head-s.origin < need {
+				return false
 			}
+			q.jumpTail(next)
+			return true
+		}
+		if s.wall-s.origin >= need {
+			q.jumpTail(next)
+			return true
+		}
+	}
+}
 
-			q.head = leftMarginIndex
-			q.tail = q.rightMargin
+// jumpTail moves the tail to the origin of segment to, marking where the data of the left segment ends
+// and the segments skipped in between as empty
+func (q *BytesQueue) jumpTail(to int) {
+	left := &q.segments[q.tailSegment]
+	left.end = q.tail
+	for skipped := left.next; skipped != to; skipped = q.segments[skipped].next {
+		q.segments[skipped].end = q.segments[skipped].origin
+	}
+	if to != q.headSegment {
+		// 没有数据的segment，清掉上一圈留下的标记
+		q.segments[to].start = q.segments[to].origin
+		q.segments[to].end = q.segments[to].wall
+	}
+	q.tailSegment = to
+	q.tail = q.segments[to].origin
+	if q.count == 0 {
+		// 空队列，head跟着tail走
+		left.start = left.origin
+		left.end = left.wall
+		q.headSegment = to
+		q.head = q.tail
+	}
+}
+
+// allocateAdditionalMemory links a new segment with room for at least minimum bytes after the tail segment
+// and moves the tail there
+// 分配一个新的segment接在tail所在的segment后面，然后把tail移过去。已有的entry不动
+func (q *BytesQueue) allocateAdditionalMemory(minimum int) error {
+	start := time.Now()
+	size := (minimum + q.segmentSize - 1) / q.segmentSize * q.segmentSize
+	if q.maxCapacity > 0 && q.capacity+size > q.maxCapacity {
+		size = q.maxCapacity - q.capacity //超过限制只给剩下的容量
+		if size < minimum {
+			if q.count == 0 {
+				// 空的queue，空闲的内存可能分散在各个segment里，整个重新分配
+				return q.reallocate(minimum + leftMarginIndex)
+			}
+			//如果装的最大数据已经超过 maxCapacity 就直接返回full queue
+			return errFullQueue
 		}
 	}
+	base := q.capacity
+	if err := q.addRegion(size); err != nil {
+		return err
+	}
 
+	next := q.segments[q.tailSegment].next
+	if q.tailSegment == q.headSegment && (q.tail < q.head || q.full) {
+		// tail 绕回来写在了head之前：从head处把segment拆成两个。前半段是最新的数据，
+		// 后半段是最老的数据，要排在新的segment后面，这样读的顺序还是先进先出
+		tail := &q.segments[q.tailSegment]
+		q.segments = append(q.segments, segment{origin: q.head, wall: tail.wall, start: q.head, end: tail.end, next: next})
+		next = len(q.segments) - 1
+		q.segments[q.tailSegment].wall = q.head
+		q.headSegment = next
+	}
+	q.segments = append(q.segments, segment{origin: base, wall: base + size, next: next})
+	q.segments[q.tailSegment].next = len(q.segments) - 1
+	q.jumpTail(len(q.segments) - 1)
 	q.full = false
 
-	if q.verbose {
-		log.Printf("Allocated new queue in %s; Capacity: %d \n", time.Since(start), q.capacity)
+	if q.logger != nil {
+		q.logger.Debug("Allocated new queue segment", "duration", time.Since(start), "size", size, "capacity", q.capacity)
 	}
+	return nil
+}
+
+// reallocate replaces the memory of an empty queue with a single region of at least minimum bytes
+// 把空queue的内存全部换成一块至少minimum字节的内存
+func (q *BytesQueue) reallocate(minimum int) error {
+	start := time.Now()
+	size := (minimum + q.segmentSize - 1) / q.segmentSize * q.segmentSize
+	if q.maxCapacity > 0 && size > q.maxCapacity {
+		size = q.maxCapacity
+	}
+	if size < minimum {
+		return errFullQueue
+	}
+	data, err := q.storage.Allocate(size)
+	if err != nil {
+		return err
+	}
+	for _, r := range q.regions {
+		if err := q.storage.Free(r.data); err != nil && q.logger != nil {
+			q.logger.Warn("Could not free queue region", "size", len(r.data), "error", err)
+		}
+	}
+	q.regions, q.slots, q.capacity = nil, nil, 0
+	q.appendRegion(data)
+	q.segments = []segment{{origin: leftMarginIndex, wall: size}}
+	q.Reset()
+
+	if q.logger != nil {
+		q.logger.Debug("Reallocated queue", "duration", time.Since(start), "capacity", q.capacity)
+	}
+	return nil
+}
+
+// addRegion allocates size bytes at the end of the index space
+func (q *BytesQueue) addRegion(size int) error {
+	data, err := q.storage.Allocate(size)
+	if err != nil {
+		return err
+	}
+	q.appendRegion(data)
+	return nil
+}
+
+// appendRegion places data at the end of the index space
+func (q *BytesQueue) appendRegion(data []byte) {
+	q.regions = append(q.regions, region{data: data, base: q.capacity})
+	for slot := q.capacity / q.segmentSize; slot*q.segmentSize < q.capacity+len(data); slot++ {
+		q.slots = append(q.slots, int32(len(q.regions)-1))
+	}
+	q.capacity += len(data)
+}
+
+// region returns the memory region holding index
+func (q *BytesQueue) region(index int) region {
+	return q.regions[q.slots[index/q.segmentSize]]
 }
 
 func (q *BytesQueue) push(data []byte, len int) {
@@ -168,19 +351,21 @@ func (q *BytesQueue) push(data []byte, len int) {
 	//将data放进queue中
 	q.copy(data, len)
 
-	if q.tail > q.head {
-		q.rightMargin = q.tail
-	}
-	if q.tail == q.head { //队列头和队列尾重合，队列满了。
+	if q.tail == q.head && q.tailSegment == q.headSegment { //队列头和队列尾重合，队列满了。
 		q.full = true
 	}
 
 	q.count++ //放进一个元素，count+1
+	q.used += headerEntrySize + len
 }
 
-//将数据放入 BytesQueue.array 中，并移动tail到队尾
+//将数据放入tail所在的内存中，并移动tail到队尾
 func (q *BytesQueue) copy(data []byte, len int) {
-	q.tail += copy(q.array[q.tail:], data[:len])
+	if len == 0 {
+		return
+	}
+	r := q.region(q.tail)
+	q.tail += copy(r.data[q.tail-r.base:], data[:len])
 }
 
 // Pop reads the oldest entry from queue and moves head pointer to the next one
@@ -194,16 +379,21 @@ func (q *BytesQueue) Pop() ([]byte, error) {
 
 	q.head += headerEntrySize + size
 	q.count--
+	q.used -= headerEntrySize + size
+	q.full = false
 
-	if q.head == q.rightMargin {
-		q.head = leftMarginIndex
-		if q.tail == q.rightMargin {
-			q.tail = leftMarginIndex
-		}
-		q.rightMargin = q.tail
+	if q.count == 0 {
+		// 空了就从头开始写
+		q.Reset()
+		return data, nil
+	}
+	// 读到了segment数据的结尾，就跳到下一个segment
+	for s := &q.segments[q.headSegment]; q.head == s.end; s = &q.segments[q.headSegment] {
+		s.start = s.origin
+		s.end = s.wall
+		q.headSegment = s.next
+		q.head = q.segments[q.headSegment].start
 	}
-
-	q.full = false
 
 	return data, nil
 }
@@ -237,6 +427,12 @@ func (q *BytesQueue) Len() int {
 	return q.count
 }
 
+// Used returns number of bytes taken by entries kept in queue, including their headers
+// Used 返回queue中entry占用的字节数（包括entry的header）
+func (q *BytesQueue) Used() int {
+	return q.used
+}
+
 // Error returns error message
 func (e *queueError) Error() string {
 	return e.message
@@ -254,7 +450,7 @@ func (q *BytesQueue) peekCheckErr(index int) error {
 		return errInvalidIndex
 	}
 
-	if index >= len(q.array) {
+	if index >= q.capacity {
 		return errIndexOutOfBounds
 	}
 	return nil
@@ -267,39 +463,8 @@ func (q *BytesQueue) peek(index int) ([]byte, int, error) {
 		return nil, 0, err
 	}
 
-	blockSize, n := binary.Uvarint(q.array[index:])
-	return q.array[index+n : index+n+int(blockSize)], n, nil
-}
-
-// canInsertAfterTail returns true if it's possible to insert an entry of size of need after the tail of the queue
-// 判断是否可以在尾后插入。
-func (q *BytesQueue) canInsertAfterTail(need int) bool {
-	if q.full { //队列满，肯定不可以
-		return false
-	}
-	if q.tail >= q.head { //如果目前是 队列头（0）-> head(3) -> tail(104) -> capacity(512) ，那么就看 512-104是不是够用
-		return q.capacity-q.tail >= need
-	}
-	// 1. there is exactly need bytes between head and tail, so we do not need
-	// to reserve extra space for a potential empty entry when realloc this queue
-	// 1.头和尾之间确实需要字节，因此在重新分配此队列时，我们不需要为潜在的空条目保留额外的空间
-	// 2. still have unused space between tail and head, then we must reserve
-	// at least headerEntrySize bytes so we can put an empty entry
-	// 2.头和尾之间仍然有未使用的空间，那么我们必须至少保留headerEntrySize字节，以便我们可以放置一个空条目
-	// 现在是队列头（0）-> tail(3) -> head(104) -> capacity(512)，tail-head是空区域，就判断104-3是不是大于我想要的空间
-	// todo 为啥要留一个空条目呢？这个空条目就是用来在执行 allocateAdditionalMemory 填充的。
-	return q.head-q.tail == need || q.head-q.tail >= need+minimumHeaderSize
-}
-
-// canInsertBeforeHead returns true if it's possible to insert an entry of size of need before the head of the queue
-// 是否可以插入到队头之前？
-func (q *BytesQueue) canInsertBeforeHead(need int) bool {
-	if q.full { //队列满了不可以
-		return false
-	}
-	if q.tail >= q.head { // 如果目前是 队列头（0）-> leftMarginIndex(1) -> head(30) -> tail(104) -> capacity(512)
-		// 那么看 30-10是否>need+minimumHeaderSize
-		return q.head-leftMarginIndex == need || q.head-leftMarginIndex >= need+minimumHeaderSize
-	}
-	return q.head-q.tail == need || q.head-q.tail >= need+minimumHeaderSize
+	r := q.region(index)
+	offset := index - r.base
+	blockSize, n := binary.Uvarint(r.data[offset:])
+	return r.data[offset+n : offset+n+int(blockSize)], n, nil
 }
@@ -44,6 +44,31 @@ func TestLen(t *testing.T) {
 	assertEqual(t, queue.Len(), 1)
 }
 
+func TestUsed(t *testing.T) {
+	t.Parallel()
+
+	// given
+	queue := NewBytesQueue(16, 0, false)
+	assertEqual(t, 0, queue.Used())
+
+	// when
+	queue.Push(blob('a', 5))
+	queue.Push(blob('b', 5))
+	afterPush := queue.Used()
+	queue.Pop()
+	queue.Push(blob('c', 5))
+	afterWrap := queue.Used()
+	capacity := queue.Capacity()
+	queue.Pop()
+	queue.Pop()
+
+	// then
+	assertEqual(t, 12, afterPush)
+	assertEqual(t, 12, afterWrap)
+	assertEqual(t, 16, capacity)
+	assertEqual(t, 0, queue.Used())
+}
+
 func TestPeek(t *testing.T) {
 	t.Parallel()
 
@@ -215,12 +240,10 @@ func TestAllocateAdditionalSpaceForInsufficientFreeFragmentedSpaceWhereTailIsBef
 
 	// then
 	assertEqual(t, 200, queue.Capacity())
-	assertEqual(t, blob('c', 30), pop(queue))
-	// empty blob fills space between tail and head,
-	// created when additional memory was allocated,
-	// it keeps current entries indexes unchanged
-	assertEqual(t, blob(0, 39), pop(queue))
+	// new segment is linked after the one being written,
+	// entries are popped in the order they were pushed
 	assertEqual(t, blob('b', 10), pop(queue))
+	assertEqual(t, blob('c', 30), pop(queue))
 	assertEqual(t, blob('d', 40), pop(queue))
 }
 
@@ -253,8 +276,8 @@ func TestAllocateAdditionalSpaceForValueBiggerThanInitQueue(t *testing.T) {
 	queue.Push(blob('a', 100))
 	// then
 	assertEqual(t, blob('a', 100), pop(queue))
-	// 224 = (101 + 11) * 2
-	assertEqual(t, 224, queue.Capacity())
+	// 121 = 11 + 110, new segment is the smallest multiple of 11 that fits 101 bytes
+	assertEqual(t, 121, queue.Capacity())
 }
 
 func TestAllocateAdditionalSpaceForValueBiggerThanQueue(t *testing.T) {
@@ -272,8 +295,8 @@ func TestAllocateAdditionalSpaceForValueBiggerThanQueue(t *testing.T) {
 	queue.Pop()
 	queue.Pop()
 	assertEqual(t, make([]byte, 100), pop(queue))
-	// 244 = (101 + 21) * 2
-	assertEqual(t, 244, queue.Capacity())
+	// 126 = 21 + 105, new segment is the smallest multiple of 21 that fits 101 bytes
+	assertEqual(t, 126, queue.Capacity())
 }
 
 func TestPopWholeQueue(t *testing.T) {
@@ -392,7 +415,7 @@ func TestPushEntryAfterAllocateAdditionMemory(t *testing.T) {
 
 	// allocate more memory
 	assertEqual(t, 9, queue.Capacity())
-	queue.Push([]byte("c"))
+	queue.Push([]byte("cccc"))
 	assertEqual(t, 18, queue.Capacity())
 
 	// push after allocate
@@ -424,6 +447,68 @@ func TestPushEntryAfterAllocateAdditionMemoryInFull(t *testing.T) {
 	noError(t, err)
 }
 
+func TestIndexesUnchangedWhileQueueGrows(t *testing.T) {
+	t.Parallel()
+
+	// given
+	queue := NewBytesQueue(10, 0, false)
+	indexes := make([]int, 20)
+
+	// when
+	for i := range indexes {
+		indexes[i], _ = queue.Push(blob(byte('a'+i), 5))
+	}
+
+	// then
+	// every 10 bytes segment fits a single 6 bytes entry
+	assertEqual(t, 200, queue.Capacity())
+	for i, index := range indexes {
+		assertEqual(t, blob(byte('a'+i), 5), get(queue, index))
+	}
+	for i := range indexes {
+		assertEqual(t, blob(byte('a'+i), 5), pop(queue))
+	}
+}
+
+func TestReallocateEmptyQueueWhenMaxCapacityIsReached(t *testing.T) {
+	t.Parallel()
+
+	// given
+	queue := NewBytesQueue(10, 30, false)
+	queue.Push(blob('a', 8))
+	queue.Push(blob('b', 8)) // allocates second segment
+	queue.Pop()
+	queue.Pop()
+
+	// when
+	_, err := queue.Push(blob('c', 25)) // does not fit any segment, queue is empty
+
+	// then
+	noError(t, err)
+	assertEqual(t, 30, queue.Capacity())
+	assertEqual(t, blob('c', 25), pop(queue))
+}
+
+func TestPushAfterFree(t *testing.T) {
+	t.Parallel()
+
+	// given
+	queue := NewBytesQueue(100, 0, false)
+	queue.Push(blob('a', 10))
+
+	// when
+	err := queue.Free()
+	_, pushErr := queue.Push(blob('b', 10))
+	_, getErr := queue.Get(1)
+
+	// then
+	noError(t, err)
+	assertEqual(t, errQueueFreed, pushErr)
+	assertEqual(t, errEmptyQueue, getErr)
+	assertEqual(t, 0, queue.Capacity())
+	noError(t, queue.Free())
+}
+
 func pop(queue *BytesQueue) []byte {
 	entry, err := queue.Pop()
 	if err != nil {
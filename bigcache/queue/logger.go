@@ -0,0 +1,33 @@
+package queue
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Logger receives messages about memory of a queue with args of alternating keys and values,
+// so a `*slog.Logger` from `log/slog` can be used as is.
+// 输出queue内存分配信息的logger，args是交替的key和value，可以直接用 *slog.Logger
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+}
+
+// stdLogger writes messages with the standard logger, used by verbose queues
+type stdLogger struct{}
+
+func (stdLogger) Debug(msg string, args ...interface{}) { log.Print(format("DEBUG", msg, args)) }
+func (stdLogger) Warn(msg string, args ...interface{})  { log.Print(format("WARN", msg, args)) }
+
+// format returns `LEVEL message key=value ...`
+func format(level, msg string, args []interface{}) string {
+	var line strings.Builder
+	line.WriteString(level)
+	line.WriteString(" ")
+	line.WriteString(msg)
+	for i := 0; i+1 < len(args); i += 2 {
+		fmt.Fprintf(&line, " %v=%v", args[i], args[i+1])
+	}
+	return line.String()
+}
@@ -0,0 +1,26 @@
+package queue
+
+// Storage allocates the memory a BytesQueue keeps its entries in.
+// A Storage may be shared by many queues; every queue owns the regions it allocated.
+// Storage 负责给 BytesQueue 分配存entry的内存，可以被多个queue共用
+type Storage interface {
+	// Allocate returns a zeroed region of capacity bytes
+	Allocate(capacity int) ([]byte, error)
+	// Free releases region
+	Free(region []byte) error
+}
+
+// HeapStorage keeps entries in byte slices on the Go heap, released by the garbage collector.
+// It is the default storage.
+// 默认的存储，内存在Go的堆上，由GC回收
+var HeapStorage Storage = heapStorage{}
+
+type heapStorage struct{}
+
+func (heapStorage) Allocate(capacity int) ([]byte, error) {
+	return make([]byte, capacity), nil
+}
+
+func (heapStorage) Free(region []byte) error {
+	return nil
+}
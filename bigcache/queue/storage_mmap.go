@@ -0,0 +1,49 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package queue
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+)
+
+type mmapStorage struct {
+	dir string
+}
+
+// NewMmapStorage returns a storage that keeps entries in memory mapped regions outside the Go heap.
+// With an empty dir regions are anonymous mappings. Otherwise every region is a file in dir, which is unlinked
+// and closed as soon as it is mapped, so nothing is left behind when the process exits and no file descriptors
+// are held. The kernel can then write pages of the file back instead of keeping them all in memory.
+// 用mmap的内存存entry，不在Go的堆上。dir为空的时候是匿名映射；否则每块内存是dir里的一个文件，映射之后马上删除并关闭，
+// 进程退出什么也不会留下，也不占文件描述符
+func NewMmapStorage(dir string) (Storage, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+	return &mmapStorage{dir: dir}, nil
+}
+
+func (m *mmapStorage) Allocate(capacity int) ([]byte, error) {
+	if m.dir == "" {
+		return syscall.Mmap(-1, 0, capacity, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+	}
+	file, err := ioutil.TempFile(m.dir, "bigcache-queue-*")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	os.Remove(file.Name())
+	if err := file.Truncate(int64(capacity)); err != nil {
+		return nil, err
+	}
+	return syscall.Mmap(int(file.Fd()), 0, capacity, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+}
+
+func (m *mmapStorage) Free(region []byte) error {
+	return syscall.Munmap(region)
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package queue
+
+// NewMmapStorage returns an error because memory mapped regions are only supported on linux and darwin
+func NewMmapStorage(dir string) (Storage, error) {
+	return nil, errMmapUnsupported
+}
@@ -0,0 +1,64 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package queue
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestMmapStorageKeepsEntriesWhenGrowing(t *testing.T) {
+	t.Parallel()
+
+	// given
+	storage, err := NewMmapStorage("")
+	noError(t, err)
+	queue, err := NewBytesQueueWithStorage(64, 0, false, storage)
+	noError(t, err)
+	defer queue.Free()
+
+	// when
+	var indexes []int
+	for i := 0; i < 1000; i++ {
+		index, err := queue.Push([]byte(fmt.Sprintf("entry %d", i)))
+		noError(t, err)
+		indexes = append(indexes, index)
+		if i%3 == 0 {
+			pop(queue)
+		}
+	}
+
+	// then
+	assertEqual(t, true, queue.Capacity() > 64)
+	for i := 667; i < 1000; i++ {
+		assertEqual(t, []byte(fmt.Sprintf("entry %d", i)), get(queue, indexes[i]))
+	}
+}
+
+func TestMmapStorageLeavesNoFiles(t *testing.T) {
+	t.Parallel()
+
+	// given
+	dir, err := ioutil.TempDir("", "bigcache-queue")
+	noError(t, err)
+	defer os.RemoveAll(dir)
+	storage, err := NewMmapStorage(dir)
+	noError(t, err)
+
+	// when
+	queue, err := NewBytesQueueWithStorage(4096, 0, false, storage)
+	noError(t, err)
+	queue.Push(blob('a', 8192))
+	files, _ := ioutil.ReadDir(dir)
+	freeErr := queue.Free()
+	wrongRegionErr := storage.Free(make([]byte, 10))
+
+	// then
+	assertEqual(t, 0, len(files))
+	noError(t, freeErr)
+	assertEqual(t, syscall.EINVAL, wrongRegionErr)
+}
@@ -1,72 +1,158 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/allegro/bigcache/v2"
 )
 
 func cacheIndexHandler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
-		case http.MethodGet:
+		case http.MethodGet, http.MethodHead:
 			getCacheHandler(w, r)
 		case http.MethodPut:
 			putCacheHandler(w, r)
+		case http.MethodPatch:
+			patchCacheHandler(w, r)
 		case http.MethodDelete:
 			deleteCacheHandler(w, r)
+		default:
+			w.Header().Set("Allow", "GET, HEAD, PUT, PATCH, DELETE")
+			w.WriteHeader(http.StatusMethodNotAllowed)
 		}
 	})
 }
 
-// handles get requests.
+// handles get and head requests.
 func getCacheHandler(w http.ResponseWriter, r *http.Request) {
 	target := r.URL.Path[len(cachePath):]
 	if target == "" {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("can't get a key if there is no key."))
-		log.Print("empty request.")
+		logger.Debug("empty request.", "method", r.Method)
 		return
 	}
-	entry, err := cache.Get(target)
+	entry, info, err := cache.GetWithInfo(target)
 	if err != nil {
 		errMsg := (err).Error()
 		if strings.Contains(errMsg, "not found") {
-			log.Print(err)
+			logger.Debug("key not found", "key", target)
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
-		log.Print(err)
+		logger.Error("internal cache error", "key", target, "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+
+	tag := etag(entry)
+	writeMetadata(w, tag, info)
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && etagMatches(ifNoneMatch, tag, true) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(entry)))
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
 	w.Write(entry)
 }
 
+// handles put requests. `If-Match` stores the body only if the current entry has one of the given ETags,
+// `If-None-Match: *` only if there is no entry; otherwise 412 is returned.
 func putCacheHandler(w http.ResponseWriter, r *http.Request) {
 	target := r.URL.Path[len(cachePath):]
 	if target == "" {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("can't put a key if there is no key."))
-		log.Print("empty request.")
+		logger.Debug("empty request.", "method", r.Method)
 		return
 	}
 
-	entry, err := ioutil.ReadAll(r.Body)
+	entry, ok := readBody(w, r, target)
+	if !ok {
+		return
+	}
+
+	var stored bool
+	var err error
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		// the ETag is compared and the entry replaced under the shard lock.
+		err = cache.Update(target, func(value []byte, found bool) ([]byte, bool) {
+			stored = found && etagMatches(ifMatch, etag(value), false)
+			return entry, stored
+		})
+	} else if r.Header.Get("If-None-Match") == "*" {
+		stored, err = cache.SetIfAbsent(target, entry)
+	} else {
+		stored, err = true, cache.Set(target, entry)
+	}
 	if err != nil {
-		log.Print(err)
+		logger.Error("internal cache error", "key", target, "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	if !stored {
+		logger.Debug("precondition failed.", "key", target)
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	logger.Debug("stored in cache.", "key", target, "size", len(entry))
+	w.Header().Set("ETag", etag(entry))
+	w.WriteHeader(http.StatusCreated)
+}
 
-	if err := cache.Set(target, []byte(entry)); err != nil {
-		log.Print(err)
+// handles patch requests, appending the body to the entry of the key or storing it if there is none.
+func patchCacheHandler(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Path[len(cachePath):]
+	if target == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("can't patch a key if there is no key."))
+		logger.Debug("empty request.", "method", r.Method)
+		return
+	}
+
+	entry, ok := readBody(w, r, target)
+	if !ok {
+		return
+	}
+	if err := cache.Append(target, entry); err != nil {
+		logger.Error("internal cache error", "key", target, "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	log.Printf("stored \"%s\" in cache.", target)
-	w.WriteHeader(http.StatusCreated)
+	logger.Debug("appended in cache.", "key", target, "size", len(entry))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// reads the request body, answering 413 when it is larger than maxBodySize.
+func readBody(w http.ResponseWriter, r *http.Request, target string) ([]byte, bool) {
+	body := io.Reader(r.Body)
+	if maxBodySize > 0 {
+		// one more byte tells a body of exactly maxBodySize bytes from a longer one.
+		body = io.LimitReader(r.Body, maxBodySize+1)
+	}
+	entry, err := ioutil.ReadAll(body)
+	if maxBodySize > 0 && int64(len(entry)) > maxBodySize {
+		logger.Warn("request body too large", "key", target, "maxBodySize", maxBodySize)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+	if err != nil {
+		logger.Warn("cannot read request body", "key", target, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, false
+	}
+	return entry, true
 }
 
 // delete cache objects.
@@ -75,13 +161,59 @@ func deleteCacheHandler(w http.ResponseWriter, r *http.Request) {
 	if err := cache.Delete(target); err != nil {
 		if strings.Contains((err).Error(), "not found") {
 			w.WriteHeader(http.StatusNotFound)
-			log.Printf("%s not found.", target)
+			logger.Debug("key not found", "key", target)
 			return
 		}
 		w.WriteHeader(http.StatusInternalServerError)
-		log.Printf("internal cache error: %s", err)
+		logger.Error("internal cache error", "key", target, "error", err)
 	}
 	// this is what the RFC says to use when calling DELETE.
 	w.WriteHeader(http.StatusOK)
 	return
 }
+
+// sets the ETag, the time the entry was stored as Last-Modified and its age, and its lifetime as max-age,
+// so max-age minus Age is the time the entry has left.
+func writeMetadata(w http.ResponseWriter, tag string, info bigcache.Response) {
+	stored := entryTime(info.Timestamp)
+	age := time.Since(stored)
+	if age < 0 {
+		age = 0
+	}
+	w.Header().Set("ETag", tag)
+	w.Header().Set("Last-Modified", stored.UTC().Format(http.TimeFormat))
+	w.Header().Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	if config.LifeWindow > 0 {
+		w.Header().Set("Cache-Control", "max-age="+strconv.FormatInt(int64(config.LifeWindow/time.Second), 10))
+	}
+}
+
+// time an entry was stored, from its timestamp in units of the clock resolution.
+func entryTime(timestamp uint64) time.Time {
+	resolution := config.ClockResolution
+	if resolution <= 0 {
+		resolution = time.Second
+	}
+	return time.Unix(0, int64(timestamp)*int64(resolution))
+}
+
+// strong ETag of a value, a prefix of its SHA-256.
+func etag(value []byte) string {
+	sum := sha256.Sum256(value)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// reports whether an If-Match or If-None-Match header lists tag or is `*`. Weak tags in the header match
+// only when weak comparison is allowed, as for If-None-Match.
+func etagMatches(header, tag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == "*" || candidate == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,25 @@
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/allegro/bigcache/v2"
+)
+
+// newLogger returns a logger writing messages of level and above to w, as JSON lines when json is set.
+func newLogger(w io.Writer, level string, json bool) (bigcache.LeveledLogger, error) {
+	var minimum slog.Level
+	if err := minimum.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+	options := &slog.HandlerOptions{Level: minimum}
+	if json {
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	}
+	return slog.New(slog.NewTextHandler(w, options)), nil
+}
@@ -0,0 +1,51 @@
+//go:build !go1.21
+// +build !go1.21
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/allegro/bigcache/v2"
+)
+
+var levels = []string{"DEBUG", "INFO", "WARN", "ERROR"}
+
+// newLogger returns a logger writing messages of level and above to w. JSON output needs Go 1.21.
+func newLogger(w io.Writer, level string, json bool) (bigcache.LeveledLogger, error) {
+	if json {
+		return nil, errors.New("JSON logs need Go 1.21 or newer")
+	}
+	for minimum, name := range levels {
+		if strings.EqualFold(name, level) {
+			return &levelLogger{logger: log.New(w, "", log.LstdFlags), minimum: minimum}, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid log level %q", level)
+}
+
+// levelLogger writes messages as `LEVEL message key=value ...` lines
+type levelLogger struct {
+	logger  *log.Logger
+	minimum int
+}
+
+func (l *levelLogger) Debug(msg string, args ...interface{}) { l.log(0, msg, args) }
+func (l *levelLogger) Info(msg string, args ...interface{})  { l.log(1, msg, args) }
+func (l *levelLogger) Warn(msg string, args ...interface{})  { l.log(2, msg, args) }
+func (l *levelLogger) Error(msg string, args ...interface{}) { l.log(3, msg, args) }
+
+func (l *levelLogger) log(level int, msg string, args []interface{}) {
+	if level < l.minimum {
+		return
+	}
+	line := levels[level] + " " + msg
+	for i := 0; i+1 < len(args); i += 2 {
+		line += fmt.Sprintf(" %v=%v", args[i], args[i+1])
+	}
+	l.logger.Print(line)
+}
@@ -0,0 +1,37 @@
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestJSONLoggerSkipsLowerLevels(t *testing.T) {
+	t.Parallel()
+	var b bytes.Buffer
+	l, err := newLogger(&b, "warn", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l.Info("skipped")
+	l.Warn("written", "key", "example")
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(b.Bytes(), &line); err != nil {
+		t.Fatalf("want a single JSON line; got: %q", b.String())
+	}
+	if line["level"] != "WARN" || line["msg"] != "written" || line["key"] != "example" {
+		t.Errorf("want level, message and fields; got: %v", line)
+	}
+}
+
+func TestLoggerWithInvalidLevel(t *testing.T) {
+	t.Parallel()
+	if _, err := newLogger(&bytes.Buffer{}, "loud", false); err == nil {
+		t.Error("want an error for an unknown level")
+	}
+}
@@ -1,9 +1,21 @@
 package main
 
 import (
-	"log"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/allegro/bigcache/v2"
 )
 
 // our base middleware implementation.
@@ -17,13 +29,151 @@ func serviceLoader(h http.Handler, svcs ...service) http.Handler {
 	return h
 }
 
+// middleware limiting and authenticating clients, in the order of serviceLoader. the rate limit wraps
+// authentication, so requests with wrong credentials are limited as well.
+func securityServices(limits *bigcache.BigCache, limit int64, token, hmacSecret string, nonces *bigcache.BigCache) []service {
+	return []service{authenticate(token, hmacSecret, nonces), rateLimit(limits, limit)}
+}
+
 // middleware for request length metrics.
-func requestMetrics(l *log.Logger) service {
+func requestMetrics(l bigcache.LeveledLogger) service {
 	return func(h http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			start := time.Now()
 			h.ServeHTTP(w, r)
-			l.Printf("%s request to %s took %vns.", r.Method, r.URL.Path, time.Now().Sub(start).Nanoseconds())
+			l.Info("request", "method", r.Method, "path", r.URL.Path, "duration", time.Now().Sub(start))
+		})
+	}
+}
+
+// maximum difference between the clock of the server and the timestamp of an HMAC signed request.
+const hmacMaxSkew = 5 * time.Minute
+
+// middleware rejecting requests without the bearer token or a valid HMAC signature.
+// requests pass when neither token nor hmacSecret is set.
+//
+// HMAC signed requests carry `Authorization: HMAC <unix timestamp>:<nonce>:<signature>`, where the signature is
+// the hex encoded HMAC-SHA256 of "<method>\n<request URI>\n<unix timestamp>\n<nonce>\n<body SHA-256>" keyed with
+// hmacSecret, the body hash being hex encoded too. nonces of accepted requests are kept in nonces, a cache of
+// its own whose entries outlive the allowed skew, so a signed request can not be replayed.
+func authenticate(token, hmacSecret string, nonces *bigcache.BigCache) service {
+	return func(h http.Handler) http.Handler {
+		if token == "" && hmacSecret == "" {
+			return h
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authorization := r.Header.Get("Authorization")
+			switch {
+			case token != "" && strings.HasPrefix(authorization, "Bearer "):
+				if subtle.ConstantTimeCompare([]byte(authorization[len("Bearer "):]), []byte(token)) == 1 {
+					h.ServeHTTP(w, r)
+					return
+				}
+			case hmacSecret != "" && strings.HasPrefix(authorization, "HMAC "):
+				if validSignature(r, authorization[len("HMAC "):], hmacSecret, nonces, time.Now()) {
+					h.ServeHTTP(w, r)
+					return
+				}
+			}
+			logger.Warn("unauthorized request", "method", r.Method, "path", r.URL.Path, "client", clientID(r))
+			if token != "" {
+				w.Header().Add("WWW-Authenticate", "Bearer")
+			}
+			if hmacSecret != "" {
+				w.Header().Add("WWW-Authenticate", "HMAC")
+			}
+			w.WriteHeader(http.StatusUnauthorized)
 		})
 	}
 }
+
+// reports whether credentials hold a fresh signature of the request with a nonce not used before.
+// the body is read to be hashed and put back for the handler.
+func validSignature(r *http.Request, credentials, secret string, nonces *bigcache.BigCache, now time.Time) bool {
+	parts := strings.SplitN(credentials, ":", 3)
+	if len(parts) != 3 || parts[1] == "" {
+		return false
+	}
+	timestamp, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return false
+	}
+	if skew := now.Sub(time.Unix(timestamp, 0)); skew > hmacMaxSkew || skew < -hmacMaxSkew {
+		return false
+	}
+	signature, err := hex.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	body, err := peekBody(r)
+	if err != nil {
+		return false
+	}
+	if !hmac.Equal(signature, sign(secret, r.Method, r.URL.RequestURI(), timestamp, parts[1], body)) {
+		return false
+	}
+	if fresh, err := nonces.SetIfAbsent(parts[1], []byte{}); err != nil || !fresh {
+		logger.Warn("replayed request", "method", r.Method, "path", r.URL.Path, "client", clientID(r))
+		return false
+	}
+	return true
+}
+
+// reads the request body, at most one byte more than maxBodySize so that readBody still answers 413,
+// and puts what was read back in front of the rest of the body.
+func peekBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil {
+		return nil, nil
+	}
+	body := io.Reader(r.Body)
+	if maxBodySize > 0 {
+		body = io.LimitReader(r.Body, maxBodySize+1)
+	}
+	read, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(read), r.Body))
+	return read, nil
+}
+
+// HMAC-SHA256 of the method, the request URI, the unix timestamp, the nonce and the body SHA-256 of a request.
+func sign(secret, method, requestURI string, timestamp int64, nonce string, body []byte) []byte {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%d\n%s\n%x", method, requestURI, timestamp, nonce, bodyHash)
+	return mac.Sum(nil)
+}
+
+// middleware answering 429 to clients that made more than limit requests in the current second.
+// requests are counted in limits, a cache of its own, so every request takes a single Incr.
+func rateLimit(limits *bigcache.BigCache, limit int64) service {
+	return func(h http.Handler) http.Handler {
+		if limit <= 0 {
+			return h
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			client := clientID(r)
+			requests, err := limits.Incr(client+"/"+strconv.FormatInt(time.Now().Unix(), 10), 1)
+			if err == nil && requests > limit {
+				logger.Debug("rate limit exceeded", "client", client, "requests", requests)
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// identifies the client of a request by the common name of its TLS certificate, or else by its IP address.
+func clientID(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
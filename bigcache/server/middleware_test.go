@@ -2,10 +2,15 @@ package main
 
 import (
 	"bytes"
-	"log"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/allegro/bigcache/v2"
 )
 
 func emptyTestHandler() service {
@@ -31,7 +36,7 @@ func TestServiceLoader(t *testing.T) {
 
 func TestRequestMetrics(t *testing.T) {
 	var b bytes.Buffer
-	logger := log.New(&b, "", log.LstdFlags)
+	logger, _ := newLogger(&b, "info", false)
 	req, err := http.NewRequest("GET", "/api/v1/cache/empty", nil)
 	if err != nil {
 		t.Error(err)
@@ -45,3 +50,149 @@ func TestRequestMetrics(t *testing.T) {
 	}
 	t.Log(targetTestString)
 }
+
+func okHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+func TestAuthenticateWithBearerToken(t *testing.T) {
+	t.Parallel()
+	handler := serviceLoader(okHandler(), authenticate("secret-token", "", nil))
+
+	for authorization, want := range map[string]int{
+		"":                    http.StatusUnauthorized,
+		"Bearer wrong":        http.StatusUnauthorized,
+		"Bearer secret-token": http.StatusOK,
+	} {
+		req := httptest.NewRequest("GET", "/api/v1/cache/key", nil)
+		req.Header.Set("Authorization", authorization)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != want {
+			t.Errorf("authorization %q; want: %d; got: %d", authorization, want, rr.Code)
+		}
+	}
+}
+
+func newNonceCache() *bigcache.BigCache {
+	nonces, _ := bigcache.NewBigCache(bigcache.DefaultConfig(2 * hmacMaxSkew))
+	return nonces
+}
+
+// Authorization header of a request signed with secret.
+func hmacAuthorization(secret, method, requestURI string, timestamp int64, nonce, body string) string {
+	return fmt.Sprintf("HMAC %d:%s:%x", timestamp, nonce, sign(secret, method, requestURI, timestamp, nonce, []byte(body)))
+}
+
+func TestAuthenticateWithHMAC(t *testing.T) {
+	t.Parallel()
+	handler := serviceLoader(okHandler(), authenticate("", "hmac-secret", newNonceCache()))
+	now := time.Now().Unix()
+	stale := now - int64(hmacMaxSkew/time.Second) - 60
+
+	for name, tc := range map[string]struct {
+		authorization string
+		want          int
+	}{
+		"signed":         {hmacAuthorization("hmac-secret", "PUT", "/api/v1/cache/key", now, "n1", "value"), http.StatusOK},
+		"other secret":   {hmacAuthorization("other", "PUT", "/api/v1/cache/key", now, "n2", "value"), http.StatusUnauthorized},
+		"other path":     {hmacAuthorization("hmac-secret", "PUT", "/api/v1/cache/other", now, "n3", "value"), http.StatusUnauthorized},
+		"other body":     {hmacAuthorization("hmac-secret", "PUT", "/api/v1/cache/key", now, "n4", "other"), http.StatusUnauthorized},
+		"stale":          {hmacAuthorization("hmac-secret", "PUT", "/api/v1/cache/key", stale, "n5", "value"), http.StatusUnauthorized},
+		"no nonce":       {hmacAuthorization("hmac-secret", "PUT", "/api/v1/cache/key", now, "", "value"), http.StatusUnauthorized},
+		"bearer":         {"Bearer hmac-secret", http.StatusUnauthorized},
+		"malformed HMAC": {"HMAC nonsense", http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest("PUT", "/api/v1/cache/key", strings.NewReader("value"))
+		req.Header.Set("Authorization", tc.authorization)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != tc.want {
+			t.Errorf("%s; want: %d; got: %d", name, tc.want, rr.Code)
+		}
+	}
+}
+
+func TestAuthenticateRejectsReplayedHMAC(t *testing.T) {
+	t.Parallel()
+	var bodies []string
+	handler := serviceLoader(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(http.StatusOK)
+	}), authenticate("", "hmac-secret", newNonceCache()))
+	authorization := hmacAuthorization("hmac-secret", "PUT", "/api/v1/cache/key", time.Now().Unix(), "nonce", "value")
+
+	var codes []int
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("PUT", "/api/v1/cache/key", strings.NewReader("value"))
+		req.Header.Set("Authorization", authorization)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		codes = append(codes, rr.Code)
+	}
+
+	if codes[0] != http.StatusOK || codes[1] != http.StatusUnauthorized {
+		t.Errorf("want: [200 401]; got: %v", codes)
+	}
+	if len(bodies) != 1 || bodies[0] != "value" {
+		t.Errorf("handler should read the signed body once; got: %q", bodies)
+	}
+}
+
+func TestSecurityServicesLimitUnauthorizedRequests(t *testing.T) {
+	t.Parallel()
+	limits, _ := bigcache.NewBigCache(bigcache.DefaultConfig(time.Minute))
+	handler := serviceLoader(okHandler(), securityServices(limits, 2, "secret-token", "", nil)...)
+
+	// even if the requests span two seconds, one of them has more than 2 requests.
+	limited := 0
+	for i := 0; i < 10; i++ {
+		req := httptest.NewRequest("GET", "/api/v1/cache/key", nil)
+		req.Header.Set("Authorization", "Bearer wrong")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code == http.StatusTooManyRequests {
+			limited++
+		}
+	}
+
+	if limited < 6 {
+		t.Errorf("want: at least 6 limited requests; got: %d", limited)
+	}
+}
+
+func TestAuthenticateDisabled(t *testing.T) {
+	t.Parallel()
+	req := httptest.NewRequest("GET", "/api/v1/cache/key", nil)
+	rr := httptest.NewRecorder()
+
+	serviceLoader(okHandler(), authenticate("", "", nil)).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("want: 200; got: %d", rr.Code)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	t.Parallel()
+	limits, _ := bigcache.NewBigCache(bigcache.DefaultConfig(time.Minute))
+	handler := serviceLoader(okHandler(), rateLimit(limits, 2))
+
+	// even if the requests span two seconds, one of them has more than 2 requests.
+	limited := 0
+	for i := 0; i < 5; i++ {
+		req := httptest.NewRequest("GET", "/api/v1/cache/key", nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code == http.StatusTooManyRequests {
+			limited++
+		}
+	}
+
+	if limited == 0 || limited > 3 {
+		t.Errorf("want: 1 to 3 limited requests; got: %d", limited)
+	}
+}
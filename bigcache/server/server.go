@@ -1,12 +1,17 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"strconv"
+	"time"
 
 	"github.com/allegro/bigcache/v2"
 )
@@ -25,9 +30,21 @@ const (
 )
 
 var (
-	port    int
-	logfile string
-	ver     bool
+	port     int
+	logfile  string
+	logLevel string
+	logJSON  bool
+	ver      bool
+	logger   bigcache.LeveledLogger
+
+	// security settings.
+	tlsCert         string
+	tlsKey          string
+	tlsClientCA     string
+	authToken       string
+	hmacSecret      string
+	clientRateLimit int64
+	maxBodySize     int64
 
 	// cache-specific settings.
 	cache  *bigcache.BigCache
@@ -35,7 +52,7 @@ var (
 )
 
 func init() {
-	flag.BoolVar(&config.Verbose, "v", false, "Verbose logging.")
+	flag.BoolVar(&config.Verbose, "v", false, "Verbose logging, same as -logLevel debug.")
 	flag.IntVar(&config.Shards, "shards", 1024, "Number of shards for the cache.")
 	flag.IntVar(&config.MaxEntriesInWindow, "maxInWindow", 1000*10*60, "Used only in initial memory allocation.")
 	flag.DurationVar(&config.LifeWindow, "lifetime", 100000*100000*60, "Lifetime of each cache object.")
@@ -43,7 +60,16 @@ func init() {
 	flag.IntVar(&config.MaxEntrySize, "maxShardEntrySize", 500, "The maximum size of each object stored in a shard. Used only in initial memory allocation.")
 	flag.IntVar(&port, "port", 9090, "The port to listen on.")
 	flag.StringVar(&logfile, "logfile", "", "Location of the logfile.")
+	flag.StringVar(&logLevel, "logLevel", "info", "Minimum level of logged messages: debug, info, warn or error.")
+	flag.BoolVar(&logJSON, "logJSON", false, "Write logs as JSON lines.")
 	flag.BoolVar(&ver, "version", false, "Print server version.")
+	flag.StringVar(&tlsCert, "tlsCert", "", "Location of the TLS certificate. Serves HTTPS when set with -tlsKey.")
+	flag.StringVar(&tlsKey, "tlsKey", "", "Location of the TLS private key.")
+	flag.StringVar(&tlsClientCA, "tlsClientCA", "", "Location of the CA certificates that must sign client certificates (mutual TLS).")
+	flag.StringVar(&authToken, "authToken", "", "Bearer token required in the Authorization header of every request.")
+	flag.StringVar(&hmacSecret, "hmacSecret", "", "Secret of HMAC-SHA256 signatures accepted in the Authorization header.")
+	flag.Int64Var(&clientRateLimit, "rateLimit", 0, "Maximum number of requests per second of a client, 0 for no limit.")
+	flag.Int64Var(&maxBodySize, "maxBodySize", 0, "Maximum size of a PUT or PATCH request body in bytes, 0 for no limit.")
 }
 
 func main() {
@@ -54,32 +80,95 @@ func main() {
 		os.Exit(0)
 	}
 
-	var logger *log.Logger
-
-	if logfile == "" {
-		logger = log.New(os.Stdout, "", log.LstdFlags)
-	} else {
+	var out io.Writer = os.Stdout
+	if logfile != "" {
 		f, err := os.OpenFile(logfile, os.O_APPEND|os.O_WRONLY, 0600)
 		if err != nil {
 			panic(err)
 		}
-		logger = log.New(f, "", log.LstdFlags)
+		out = f
+	}
+	if config.Verbose {
+		logLevel = "debug"
 	}
 
 	var err error
+	logger, err = newLogger(out, logLevel, logJSON)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	config.LeveledLogger = logger
+
 	cache, err = bigcache.NewBigCache(config)
 	if err != nil {
-		logger.Fatal(err)
+		logger.Error("cannot initialise cache", "error", err)
+		os.Exit(1)
+	}
+
+	logger.Info("cache initialised.")
+
+	// requests of a client are counted in their own cache, entries live for a window of one second.
+	limits, err := bigcache.NewBigCache(bigcache.Config{
+		Shards:             64,
+		LifeWindow:         2 * time.Second,
+		CleanWindow:        time.Second,
+		MaxEntriesInWindow: 1024 * 64,
+		MaxEntrySize:       64,
+	})
+	if err != nil {
+		logger.Error("cannot initialise rate limits", "error", err)
+		os.Exit(1)
 	}
 
-	logger.Print("cache initialised.")
+	// nonces of HMAC signed requests are remembered until their signatures are stale.
+	nonces, err := bigcache.NewBigCache(bigcache.Config{
+		Shards:             64,
+		LifeWindow:         2 * hmacMaxSkew,
+		CleanWindow:        time.Minute,
+		MaxEntriesInWindow: 1024 * 64,
+		MaxEntrySize:       64,
+	})
+	if err != nil {
+		logger.Error("cannot initialise nonces", "error", err)
+		os.Exit(1)
+	}
 
-	// let the middleware log.
-	http.Handle(cachePath, serviceLoader(cacheIndexHandler(), requestMetrics(logger)))
-	http.Handle(statsPath, serviceLoader(statsIndexHandler(), requestMetrics(logger)))
+	security := append(securityServices(limits, clientRateLimit, authToken, hmacSecret, nonces), requestMetrics(logger))
+	http.Handle(cachePath, serviceLoader(cacheIndexHandler(), security...))
+	http.Handle(statsPath, serviceLoader(statsIndexHandler(), security...))
 
-	logger.Printf("starting server on :%d", port)
+	server := &http.Server{Addr: ":" + strconv.Itoa(port)}
+	if tlsCert != "" || tlsKey != "" {
+		if server.TLSConfig, err = newTLSConfig(tlsClientCA); err != nil {
+			logger.Error("cannot configure TLS", "error", err)
+			os.Exit(1)
+		}
+		logger.Info("starting server", "port", port, "tls", true, "mutualTLS", tlsClientCA != "")
+		err = server.ListenAndServeTLS(tlsCert, tlsKey)
+	} else {
+		logger.Info("starting server", "port", port)
+		err = server.ListenAndServe()
+	}
+	logger.Error("ListenAndServe", "error", err)
+	os.Exit(1)
+}
 
-	strPort := ":" + strconv.Itoa(port)
-	log.Fatal("ListenAndServe: ", http.ListenAndServe(strPort, nil))
+// TLS configuration requiring client certificates signed by the CAs in clientCA, if it is set.
+func newTLSConfig(clientCA string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if clientCA == "" {
+		return config, nil
+	}
+	pem, err := ioutil.ReadFile(clientCA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no CA certificate found in " + clientCA)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return config, nil
 }
@@ -2,10 +2,21 @@ package main
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"io/ioutil"
+	"math/big"
+	"net/http"
 	"net/http/httptest"
+	"os"
+	"strconv"
 	"testing"
 	"time"
 
@@ -29,6 +40,7 @@ func testCacheSetup() {
 }
 
 func TestMain(m *testing.M) {
+	logger, _ = newLogger(ioutil.Discard, "debug", false)
 	testCacheSetup()
 	m.Run()
 }
@@ -281,3 +293,222 @@ type errReader int
 func (errReader) Read([]byte) (int, error) {
 	return 0, errors.New("test read error")
 }
+
+func TestPutKeyWithTooLargeBody(t *testing.T) {
+	defer func(previous int64) { maxBodySize = previous }(maxBodySize)
+	maxBodySize = 3
+
+	for body, want := range map[string]int{"123": 201, "1234": 413} {
+		req := httptest.NewRequest("PUT", testBaseString+"/api/v1/cache/bodySize"+body, bytes.NewBufferString(body))
+		rr := httptest.NewRecorder()
+
+		putCacheHandler(rr, req)
+
+		if rr.Code != want {
+			t.Errorf("body %q; want: %d; got: %d", body, want, rr.Code)
+		}
+	}
+	if _, err := cache.Get("bodySize1234"); err != bigcache.ErrEntryNotFound {
+		t.Errorf("want: too large body not stored; got: %v", err)
+	}
+}
+
+func TestGetKeyMetadata(t *testing.T) {
+	t.Parallel()
+	req := httptest.NewRequest("GET", testBaseString+"/api/v1/cache/metadataKey", nil)
+	rr := httptest.NewRecorder()
+
+	cache.Set("metadataKey", []byte("123"))
+
+	getCacheHandler(rr, req)
+	resp := rr.Result()
+
+	if resp.Header.Get("ETag") != etag([]byte("123")) {
+		t.Errorf("want: %s; got: %s", etag([]byte("123")), resp.Header.Get("ETag"))
+	}
+	modified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil || time.Since(modified) > time.Minute {
+		t.Errorf("want: a recent Last-Modified; got: %q", resp.Header.Get("Last-Modified"))
+	}
+	if age, err := strconv.Atoi(resp.Header.Get("Age")); err != nil || age < 0 || age > 60 {
+		t.Errorf("want: Age in seconds; got: %q", resp.Header.Get("Age"))
+	}
+}
+
+func TestGetKeyIfNoneMatch(t *testing.T) {
+	t.Parallel()
+	cache.Set("ifNoneMatchKey", []byte("123"))
+
+	req := httptest.NewRequest("GET", testBaseString+"/api/v1/cache/ifNoneMatchKey", nil)
+	req.Header.Set("If-None-Match", `"other", `+etag([]byte("123")))
+	rr := httptest.NewRecorder()
+	getCacheHandler(rr, req)
+	resp := rr.Result()
+
+	if resp.StatusCode != 304 {
+		t.Errorf("want: 304; got: %d", resp.StatusCode)
+	}
+	if rr.Body.Len() != 0 {
+		t.Errorf("want: no body; got: %s", rr.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", testBaseString+"/api/v1/cache/ifNoneMatchKey", nil)
+	req.Header.Set("If-None-Match", `"other"`)
+	rr = httptest.NewRecorder()
+	getCacheHandler(rr, req)
+
+	if rr.Code != 200 || rr.Body.String() != "123" {
+		t.Errorf("want: 200 and 123; got: %d and %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestHeadKey(t *testing.T) {
+	t.Parallel()
+	cache.Set("headKey", []byte("123"))
+
+	req := httptest.NewRequest("HEAD", testBaseString+"/api/v1/cache/headKey", nil)
+	rr := httptest.NewRecorder()
+	cacheIndexHandler().ServeHTTP(rr, req)
+
+	if rr.Code != 200 {
+		t.Errorf("want: 200; got: %d", rr.Code)
+	}
+	if rr.Header().Get("Content-Length") != "3" || rr.Body.Len() != 0 {
+		t.Errorf("want: Content-Length 3 and no body; got: %s and %s", rr.Header().Get("Content-Length"), rr.Body.String())
+	}
+
+	req = httptest.NewRequest("HEAD", testBaseString+"/api/v1/cache/missingHeadKey", nil)
+	rr = httptest.NewRecorder()
+	cacheIndexHandler().ServeHTTP(rr, req)
+
+	if rr.Code != 404 {
+		t.Errorf("want: 404; got: %d", rr.Code)
+	}
+}
+
+func TestPutKeyIfMatch(t *testing.T) {
+	t.Parallel()
+	cache.Set("ifMatchKey", []byte("123"))
+
+	req := httptest.NewRequest("PUT", testBaseString+"/api/v1/cache/ifMatchKey", bytes.NewBuffer([]byte("456")))
+	req.Header.Set("If-Match", etag([]byte("123")))
+	rr := httptest.NewRecorder()
+	putCacheHandler(rr, req)
+
+	if rr.Code != 201 || rr.Header().Get("ETag") != etag([]byte("456")) {
+		t.Errorf("want: 201 and the new ETag; got: %d and %s", rr.Code, rr.Header().Get("ETag"))
+	}
+
+	// the stored value changed, so the old ETag does not match any more.
+	req = httptest.NewRequest("PUT", testBaseString+"/api/v1/cache/ifMatchKey", bytes.NewBuffer([]byte("789")))
+	req.Header.Set("If-Match", etag([]byte("123")))
+	rr = httptest.NewRecorder()
+	putCacheHandler(rr, req)
+
+	if rr.Code != 412 {
+		t.Errorf("want: 412; got: %d", rr.Code)
+	}
+	if value, _ := cache.Get("ifMatchKey"); string(value) != "456" {
+		t.Errorf("want: 456; got: %s", value)
+	}
+
+	req = httptest.NewRequest("PUT", testBaseString+"/api/v1/cache/missingIfMatchKey", bytes.NewBuffer([]byte("123")))
+	req.Header.Set("If-Match", "*")
+	rr = httptest.NewRecorder()
+	putCacheHandler(rr, req)
+
+	if rr.Code != 412 {
+		t.Errorf("want: 412 for a missing key; got: %d", rr.Code)
+	}
+}
+
+func TestPutKeyIfNoneMatch(t *testing.T) {
+	t.Parallel()
+	putIfAbsent := func(value string) int {
+		req := httptest.NewRequest("PUT", testBaseString+"/api/v1/cache/ifAbsentKey", bytes.NewBuffer([]byte(value)))
+		req.Header.Set("If-None-Match", "*")
+		rr := httptest.NewRecorder()
+		putCacheHandler(rr, req)
+		return rr.Code
+	}
+
+	if code := putIfAbsent("123"); code != 201 {
+		t.Errorf("want: 201; got: %d", code)
+	}
+	if code := putIfAbsent("456"); code != 412 {
+		t.Errorf("want: 412; got: %d", code)
+	}
+	if value, _ := cache.Get("ifAbsentKey"); string(value) != "123" {
+		t.Errorf("want: 123; got: %s", value)
+	}
+}
+
+func TestPatchKey(t *testing.T) {
+	t.Parallel()
+	patch := func(value string) int {
+		req := httptest.NewRequest("PATCH", testBaseString+"/api/v1/cache/patchKey", bytes.NewBuffer([]byte(value)))
+		rr := httptest.NewRecorder()
+		cacheIndexHandler().ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := patch("123"); code != 204 {
+		t.Errorf("want: 204; got: %d", code)
+	}
+	patch("456")
+
+	if value, _ := cache.Get("patchKey"); string(value) != "123456" {
+		t.Errorf("want: 123456; got: %s", value)
+	}
+}
+
+func TestUnsupportedMethod(t *testing.T) {
+	t.Parallel()
+	req := httptest.NewRequest("POST", testBaseString+"/api/v1/cache/postKey", nil)
+	rr := httptest.NewRecorder()
+
+	cacheIndexHandler().ServeHTTP(rr, req)
+
+	if rr.Code != 405 || rr.Header().Get("Allow") == "" {
+		t.Errorf("want: 405 with Allow; got: %d", rr.Code)
+	}
+}
+
+func TestNewTLSConfigWithClientCA(t *testing.T) {
+	t.Parallel()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := ioutil.TempFile("", "bigcache-ca-*.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	pem.Encode(file, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	file.Close()
+
+	config, err := newTLSConfig(file.Name())
+
+	if err != nil {
+		t.Fatalf("want: no error; got: %s", err)
+	}
+	if config.ClientAuth != tls.RequireAndVerifyClientCert || config.ClientCAs == nil {
+		t.Errorf("want: client certificates required; got: %v", config.ClientAuth)
+	}
+	if _, err := newTLSConfig(os.DevNull); err == nil {
+		t.Errorf("want: error for a file without certificates")
+	}
+}
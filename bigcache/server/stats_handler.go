@@ -2,7 +2,6 @@ package main
 
 import (
 	"encoding/json"
-	"log"
 	"net/http"
 )
 
@@ -23,7 +22,7 @@ func getCacheStatsHandler(w http.ResponseWriter, r *http.Request) {
 	target, err := json.Marshal(cache.Stats())
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		log.Printf("cannot marshal cache stats. error: %s", err)
+		logger.Error("cannot marshal cache stats", "error", err)
 		return
 	}
 	// since we're sending a struct, make it easy for consumers to interface.
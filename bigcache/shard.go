@@ -1,15 +1,21 @@
 package bigcache
 
 import (
+	"container/heap"
 	"fmt"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/allegro/bigcache/v2/queue"
 )
 
 type onRemoveCallback func(wrappedEntry []byte, reason RemoveReason)
 
+// evictionBurst is the number of entries evicted to make room for a single entry that gets logged
+// 一次push淘汰这么多entry就输出日志
+const evictionBurst = 16
+
 // Metadata contains information of a specific entry
 // Metadata 包含 指定key的information
 type Metadata struct {
@@ -23,38 +29,73 @@ type cacheShard struct {
 	entryBuffer []byte
 	onRemove    onRemoveCallback
 
-	isVerbose    bool
+	// collisions holds entries of keys whose hash slot in hashmap is taken by another key.
+	// It is nil unless Config.ResolveCollisions is set.
+	// 冲突模式下，hash槽已经被别的key占用的key存在这里：key -> value的偏移
+	collisions map[string]uint32
+
+	// accessed marks entries read since they were last considered for eviction.
+	// It is nil unless Config.EvictionPolicy is ClockEviction.
+	// CLOCK淘汰模式下记录entry是否被访问过，FIFO模式下是nil
+	accessed      *accessBits
+	requeueBuffer []byte       // 重新入队时暂存entry，不能用 entryBuffer，因为push新entry的时候它还在用
+	requeued      requeuedHeap // 重新入队过的entry，它们过期时要单独删除
+
+	overflow *overflowStore // 磁盘层，所有shard共用，nil表示没有开启
+
+	// spill holds copies of entries evicted for lack of space. They are written to the disk tier after the
+	// write lock is released, under spillLock, which is taken before the write lock is released so that
+	// deleting from the disk tier can wait for the entries evicted before it.
+	// 因空间不足淘汰的entry先拷贝到spill里，释放写锁之后再写到磁盘层，不在写锁下做文件IO。
+	// spillLock 在释放写锁之前拿到，从磁盘层删除之前等它，这样删除不会被之前淘汰的entry覆盖
+	spill     [][]byte
+	spillLock sync.Mutex
+
+	storage queue.Storage // entries 的内存从这里分配，compact 重建队列时用
+
+	codec              Codec // 压缩value用的，nil表示不压缩
+	compressionMinSize int   // 比这个短的value不压缩
+	compressBuffer     []byte
+
 	statsEnabled bool
-	logger       Logger
-	clock        clock
-	lifeWindow   uint64 //每个key的生存时间（就过期时间）
+	logger       LeveledLogger // 每条日志都带着shard的序号
+	// verboseLogger gets collisions in the format Logger always had when only Verbose is set, otherwise nil
+	// 只设置了 Verbose 的时候，碰撞日志还按 Logger 原来的格式输出，否则是nil
+	verboseLogger Logger
+	clock         Clock
+	lifeWindow    uint64 //每个key的生存时间（就过期时间）
+
+	maxSize             int     // entries 的最大容量，compact 重建队列时用
+	compactionThreshold float64 // 已删除的entry占容量的比例超过它就compact，0表示不compact
+	deadBytes           int     // 已删除（被覆盖）但还在 entries 里的entry的字节数
+	closed              bool    // free 之后就不能再分配内存了
 
 	hashmapStats map[uint64]uint32 //就记录了一下 hit 的次数，然后会在delete key的时候删除掉（记录了当前所有key的hit次数）
 	stats        Stats
+	removals     RemovalCounts // 按原因统计的删除次数
+	removedBytes RemovalCounts // 按原因统计的删除的字节数
+
+	clockResolution time.Duration // 时钟的单位，把时间戳的差转换成时间
 }
 
 //从 shard 中get值，用key和hashedkey，拿到 entry ， Response， err。 Response会告知是否过期
 func (s *cacheShard) getWithInfo(key string, hashedKey uint64) (entry []byte, resp Response, err error) {
-	currentTime := uint64(s.clock.Epoch())            //这个就是当前时间
-	s.lock.RLock()                                    //加读锁
-	wrappedEntry, err := s.getWrappedEntry(hashedKey) //获取到从[]byte中存的entry
+	currentTime := uint64(s.clock.Epoch())                       //这个就是当前时间
+	s.lock.RLock()                                               //加读锁
+	wrappedEntry, err := s.getWrappedEntryForKey(key, hashedKey) //获取到从[]byte中存的entry，会检查key是否一致，不一致就是发生了hash碰撞
 	if err != nil {
 		s.lock.RUnlock()
 		return nil, resp, err
 	}
-	if entryKey := readKeyFromEntry(wrappedEntry); key != entryKey { //从entry中读取 key，判断key是否一致。不一致就是发生了hash碰撞（这里涉及到一个如何解决hash碰撞的问题）
-		s.lock.RUnlock()
-		s.collision()    //记录一下发生了hash碰撞
-		if s.isVerbose { //打日志
-			s.logger.Printf("Collision detected. Both %q and %q have the same hash %x", key, entryKey, hashedKey)
-		}
-		return nil, resp, ErrEntryNotFound
-	}
 
-	entry = readEntry(wrappedEntry)                         //读出entry
+	entry, err = readEntryWithCodec(wrappedEntry, s.codec)  //读出entry
 	oldestTimeStamp := readTimestampFromEntry(wrappedEntry) //从entry中读出时间戳
 	s.lock.RUnlock()
+	if err != nil {
+		return nil, resp, err
+	}
 	s.hit(hashedKey) //缓存命中
+	resp.Timestamp = oldestTimeStamp
 	if currentTime-oldestTimeStamp >= s.lifeWindow {
 		resp.EntryStatus = Expired //提示过期
 	}
@@ -64,24 +105,62 @@ func (s *cacheShard) getWithInfo(key string, hashedKey uint64) (entry []byte, re
 //从 shard 中 get值，过期的也会返回。
 func (s *cacheShard) get(key string, hashedKey uint64) ([]byte, error) {
 	s.lock.RLock()
-	wrappedEntry, err := s.getWrappedEntry(hashedKey)
+	wrappedEntry, err := s.getWrappedEntryForKey(key, hashedKey)
 	if err != nil {
 		s.lock.RUnlock()
 		return nil, err
 	}
-	if entryKey := readKeyFromEntry(wrappedEntry); key != entryKey {
+	entry, err := readEntryWithCodec(wrappedEntry, s.codec)
+	s.lock.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	s.hit(hashedKey)
+
+	return entry, nil
+}
+
+// getFunc calls fn with a view of the value stored under key while holding the read lock
+// 在读锁下把指向queue内存的value交给fn，不拷贝
+func (s *cacheShard) getFunc(key string, hashedKey uint64, fn func(value []byte) error) error {
+	s.lock.RLock()
+	wrappedEntry, err := s.getWrappedEntryForKey(key, hashedKey)
+	if err != nil {
 		s.lock.RUnlock()
-		s.collision()
-		if s.isVerbose {
-			s.logger.Printf("Collision detected. Both %q and %q have the same hash %x", key, entryKey, hashedKey)
+		return err
+	}
+	value, codec := readValueView(wrappedEntry, s.codec)
+	if codec != 0 {
+		// 压缩过的只能解压到新开辟的内存里
+		if value, err = appendEntryWithCodec(nil, wrappedEntry, s.codec); err != nil {
+			s.lock.RUnlock()
+			return err
 		}
-		return nil, ErrEntryNotFound
 	}
-	entry := readEntry(wrappedEntry)
+	err = fn(value)
 	s.lock.RUnlock()
 	s.hit(hashedKey)
 
-	return entry, nil
+	return err
+}
+
+// getInto appends the value stored under key to dst
+// 把value追加到调用方的buffer后面，buffer够大就不用开辟内存
+func (s *cacheShard) getInto(key string, hashedKey uint64, dst []byte) ([]byte, error) {
+	s.lock.RLock()
+	wrappedEntry, err := s.getWrappedEntryForKey(key, hashedKey)
+	if err != nil {
+		s.lock.RUnlock()
+		return dst, err
+	}
+	dst, err = appendEntryWithCodec(dst, wrappedEntry, s.codec)
+	s.lock.RUnlock()
+	if err != nil {
+		return dst, err
+	}
+	s.hit(hashedKey)
+
+	return dst, nil
 }
 
 //用hashedKey获取到存在[]byte数组中的entry
@@ -103,8 +182,13 @@ func (s *cacheShard) getWrappedEntry(hashedKey uint64) ([]byte, error) {
 	return wrappedEntry, err
 }
 
-//用hashedKey获取到存在[]byte数组中的合法的entry，合法就是说key和取出的key是否一致。不一致就是冲突了
-func (s *cacheShard) getValidWrapEntry(key string, hashedKey uint64) ([]byte, error) {
+//用key和hashedKey获取到存在[]byte数组中的entry，并检查key和取出的key是否一致。不一致就是冲突了
+//冲突模式下，hash槽被别的key占了的话，会去 collisions 里找
+func (s *cacheShard) getWrappedEntryForKey(key string, hashedKey uint64) ([]byte, error) {
+	if s.collisions != nil {
+		return s.getCollidingWrappedEntry(key, hashedKey)
+	}
+
 	wrappedEntry, err := s.getWrappedEntry(hashedKey)
 	if err != nil {
 		return nil, err
@@ -112,55 +196,289 @@ func (s *cacheShard) getValidWrapEntry(key string, hashedKey uint64) ([]byte, er
 
 	if !compareKeyFromEntry(wrappedEntry, key) {
 		s.collision()
-		if s.isVerbose {
-			s.logger.Printf("Collision detected. Both %q and %q have the same hash %x", key, readKeyFromEntry(wrappedEntry), hashedKey)
-		}
+		s.logCollision(key, wrappedEntry, hashedKey)
 
 		return nil, ErrEntryNotFound
 	}
-	s.hitWithoutLock(hashedKey)
+	s.touch(s.hashmap[hashedKey])
 
 	return wrappedEntry, nil
 }
 
-//放进byte数组中。在set的时候，会检查entries中最老的entry是否已经过期，如果过期就删除最老的key
-//如果没有空间存新的entry了，会一次次删除最老的entry，直到能够存的下
-//这里要注意一点，如果存的entry过大，导致整个shard都存不下了，会直接导致shard被清空，shard被扩容到最大，然后才会报错整个shard都存不下（todo 是不是可以提前判断？）
-func (s *cacheShard) set(key string, hashedKey uint64, entry []byte) error {
-	currentTimestamp := uint64(s.clock.Epoch()) //当前时间
+// getCollidingWrappedEntry looks key up in hashmap and then in collisions.
+// 冲突模式下的查找：先看hash槽里的是不是这个key，不是再去 collisions 找
+func (s *cacheShard) getCollidingWrappedEntry(key string, hashedKey uint64) ([]byte, error) {
+	itemIndex := s.hashmap[hashedKey]
+	if itemIndex != 0 {
+		if wrappedEntry, err := s.entries.Get(int(itemIndex)); err == nil && compareKeyFromEntry(wrappedEntry, key) {
+			s.touch(itemIndex)
+			return wrappedEntry, nil
+		}
+	}
+	if itemIndex = s.collisions[key]; itemIndex == 0 {
+		s.miss()
+		return nil, ErrEntryNotFound
+	}
 
-	s.lock.Lock()
+	wrappedEntry, err := s.entries.Get(int(itemIndex))
+	if err != nil {
+		s.miss()
+		return nil, err
+	}
+	s.touch(itemIndex)
+
+	return wrappedEntry, nil
+}
+
+//用hashedKey获取到存在[]byte数组中的合法的entry，合法就是说key和取出的key是否一致。不一致就是冲突了
+func (s *cacheShard) getValidWrapEntry(key string, hashedKey uint64) ([]byte, error) {
+	wrappedEntry, err := s.getWrappedEntryForKey(key, hashedKey)
+	if err != nil {
+		return nil, err
+	}
+	s.hitWithoutLock(hashedKey)
+
+	return wrappedEntry, nil
+}
+
+// resetPreviousEntry marks the entry currently stored for key as deleted.
+// 把key之前的entry标记成不可用（重置entry中的hash）
+func (s *cacheShard) resetPreviousEntry(key string, hashedKey uint64) {
+	if s.collisions == nil {
+		if previousIndex := s.hashmap[hashedKey]; previousIndex != 0 {
+			if previousEntry, err := s.entries.Get(int(previousIndex)); err == nil {
+				s.markDeleted(previousEntry)
+			}
+		}
+		return
+	}
 
-	//如果原来已经存在该hashedKey，就取出原来的entry，然后将entry中存的key重置了（就是置成了空数组）
 	if previousIndex := s.hashmap[hashedKey]; previousIndex != 0 {
+		if previousEntry, err := s.entries.Get(int(previousIndex)); err == nil && compareKeyFromEntry(previousEntry, key) {
+			s.markDeleted(previousEntry)
+			delete(s.hashmap, hashedKey)
+			return
+		}
+	}
+	if previousIndex := s.collisions[key]; previousIndex != 0 {
 		if previousEntry, err := s.entries.Get(int(previousIndex)); err == nil {
-			resetKeyFromEntry(previousEntry) //这里就是标记一下，entries中该entry已经不可用了。todo ，那onEvict的时候是不是发现不可用可以删？现在只是通过过期时间删除
+			s.markDeleted(previousEntry)
 		}
+		delete(s.collisions, key)
 	}
+}
 
-	//这个意思就是，在每次set操作的时候，都会从entries中拿出最老的，判断是否过期，如果过期就删除，不过期就啥都不做
-	if oldestEntry, err := s.entries.Peek(); err == nil {
-		s.onEvict(oldestEntry, currentTimestamp, s.removeOldestEntry)
+// setIndex records the queue index of the entry just pushed for key. In collision
+// resolving mode a key whose hash slot holds another key goes to collisions.
+// 记录key的entry在queue中的位置。冲突模式下hash槽被别的key占了，就记到 collisions 里
+func (s *cacheShard) setIndex(key string, hashedKey uint64, index uint32) {
+	if s.collisions != nil {
+		if previousIndex := s.hashmap[hashedKey]; previousIndex != 0 {
+			if previousEntry, err := s.entries.Get(int(previousIndex)); err == nil && !compareKeyFromEntry(previousEntry, key) {
+				s.collisions[key] = index
+				s.collision()
+				return
+			}
+		}
 	}
+	s.hashmap[hashedKey] = index
+}
 
-	//encode
-	w := wrapEntry(currentTimestamp, hashedKey, key, entry, &s.entryBuffer)
+// promote moves an entry read from the disk tier back to the shard unless key was set in the meantime
+// 把从磁盘层读回来的entry放回内存。如果这期间key又被set了，就用内存里的
+func (s *cacheShard) promote(key string, hashedKey uint64, wrappedEntry []byte) error {
+	currentTimestamp := uint64(s.clock.Epoch())
+
+	s.lock.Lock()
+	if s.containsWithoutLock(key, hashedKey) {
+		s.lock.Unlock()
+		return nil
+	}
+	err := s.setWrappedEntryWithoutLock(currentTimestamp, wrappedEntry, key, hashedKey)
+	s.unlockAndSpill()
+
+	return err
+}
+
+// containsWithoutLock reports whether key has an entry, without counting a hit or a miss
+func (s *cacheShard) containsWithoutLock(key string, hashedKey uint64) bool {
+	if itemIndex := s.hashmap[hashedKey]; itemIndex != 0 {
+		if wrappedEntry, err := s.entries.Get(int(itemIndex)); err == nil && compareKeyFromEntry(wrappedEntry, key) {
+			return true
+		}
+	}
+	_, ok := s.collisions[key]
+	return ok
+}
+
+// wrap encodes entry for the queue, compressed if the shard has a codec. The result is only valid until the next call.
+// encode entry，设置了codec的话先压缩
+func (s *cacheShard) wrap(timestamp uint64, key string, hashedKey uint64, entry []byte) []byte {
+	if s.codec == nil {
+		return wrapEntry(timestamp, hashedKey, key, entry, &s.entryBuffer)
+	}
+	value, codec := s.compress(entry)
+	return wrapEntryWithCodec(timestamp, hashedKey, key, value, codec, &s.entryBuffer)
+}
+
+// compress returns the value to store for entry and the ID of the codec it was compressed with,
+// 0 if it is stored as is. The returned value is only valid until the next call.
+// 压缩value。太短的或者压缩后没有变小的就原样存，返回的codec是0
+func (s *cacheShard) compress(entry []byte) ([]byte, byte) {
+	if len(entry) < s.compressionMinSize {
+		return entry, 0
+	}
+	s.compressBuffer = s.codec.Encode(s.compressBuffer[:0], entry)
+	if len(s.compressBuffer) >= len(entry) {
+		s.compressed(len(entry), len(entry))
+		return entry, 0
+	}
+	s.compressed(len(entry), len(s.compressBuffer))
+	return s.compressBuffer, s.codec.ID()
+}
+
+// touch marks the entry at index as read, for ClockEviction
+func (s *cacheShard) touch(index uint32) {
+	if s.accessed != nil {
+		s.accessed.set(index)
+	}
+}
+
+// markDeleted resets the hash of an entry that stays in the queue until it is popped or compacted away.
+// 标记entry已删除（重置hash），并记下它占用的字节数
+func (s *cacheShard) markDeleted(wrappedEntry []byte) {
+	resetKeyFromEntry(wrappedEntry)
+	s.deadBytes += len(wrappedEntry)
+}
 
+// push stores a wrapped entry, making room by compacting the queue or evicting the oldest entries.
+// 把encode好的entry放进queue。空间不够的话，如果已删除的entry够多就先compact，否则一次次删除最老的entry，直到能够存的下
+func (s *cacheShard) push(key string, hashedKey uint64, w []byte) error {
+	if s.closed {
+		return ErrCacheClosed
+	}
+	evicted := 0
 	for {
 		if index, err := s.entries.Push(w); err == nil {
-			//push成功，记录一下，返回
-			s.hashmap[hashedKey] = uint32(index)
-			s.lock.Unlock()
+			if s.accessed != nil {
+				// 这个位置之前的entry可能被访问过，queue扩容了的话bitmap也要跟着扩
+				s.accessed.fit(s.entries.Capacity())
+				s.accessed.clear(uint32(index))
+			}
+			s.setIndex(key, hashedKey, uint32(index))
+			if evicted >= evictionBurst {
+				s.logger.Info("Evicted entries to make room", "evicted", evicted, "entrySize", len(w), "capacity", s.entries.Capacity())
+			}
 			return nil
 		}
+		if s.needsCompaction() {
+			s.compact()
+			continue
+		}
 		//因没有空间删除。也就是如果新加入的key没有了空间，会删除最老的entry，直到有空间存新的entry为止。
 		if s.removeOldestEntry(NoSpace) != nil {
-			s.lock.Unlock()
 			return fmt.Errorf("entry is bigger than max shard size")
 		}
+		evicted++
 	}
 }
 
+// needsCompaction reports whether deleted entries take up more of the queue than the configured threshold.
+func (s *cacheShard) needsCompaction() bool {
+	return s.compactionThreshold > 0 && s.deadBytes > 0 &&
+		float64(s.deadBytes) >= s.compactionThreshold*float64(s.entries.Capacity())
+}
+
+// compact rewrites live entries, oldest first, into a fresh queue and drops deleted ones.
+// 把还有效的entry按从老到新的顺序重新写到一个新的queue里，已删除的entry的空间就被回收了，然后更新 hashmap 中的偏移
+func (s *cacheShard) compact() {
+	if s.closed {
+		return
+	}
+	start := time.Now()
+	fresh, err := queue.NewBytesQueueWithStorage(s.entries.Capacity(), s.maxSize, false, s.storage)
+	if err != nil {
+		s.logger.Error("Could not allocate queue to compact shard", "capacity", s.entries.Capacity(), "error", err)
+		return
+	}
+	fresh.SetLogger(s.logger)
+	old := s.entries
+	s.entries = *fresh
+
+	var reclaimed int
+	for {
+		wrappedEntry, err := old.Pop()
+		if err != nil {
+			break
+		}
+		hash := readHashFromEntry(wrappedEntry)
+		if hash == 0 {
+			reclaimed += len(wrappedEntry)
+			continue
+		}
+
+		index, err := s.entries.Push(wrappedEntry)
+		if s.collisions != nil {
+			key := readKeyFromEntry(wrappedEntry)
+			if _, ok := s.collisions[key]; ok {
+				if err != nil {
+					delete(s.collisions, key)
+					s.removed(wrappedEntry, NoSpace)
+				} else {
+					s.collisions[key] = uint32(index)
+				}
+				continue
+			}
+		}
+		if err != nil {
+			// 新queue和原来的容量一样，理论上存得下
+			delete(s.hashmap, hash)
+			s.removed(wrappedEntry, NoSpace)
+			continue
+		}
+		s.hashmap[hash] = uint32(index)
+	}
+
+	old.Free()
+	s.deadBytes = 0
+	if s.accessed != nil {
+		// entry都挪了位置，访问标记作废
+		s.accessed.reset()
+	}
+	atomic.AddInt64(&s.stats.Compactions, 1)
+	atomic.AddInt64(&s.stats.ReclaimedBytes, int64(reclaimed))
+	s.logger.Debug("Compacted shard", "duration", time.Since(start), "reclaimed", reclaimed, "capacity", s.entries.Capacity())
+}
+
+//放进byte数组中。在set的时候，会检查entries中最老的entry是否已经过期，如果过期就删除最老的key
+//如果没有空间存新的entry了，会一次次删除最老的entry，直到能够存的下
+//这里要注意一点，如果存的entry过大，导致整个shard都存不下了，会直接导致shard被清空，shard被扩容到最大，然后才会报错整个shard都存不下（todo 是不是可以提前判断？）
+func (s *cacheShard) set(key string, hashedKey uint64, entry []byte) error {
+	currentTimestamp := uint64(s.clock.Epoch()) //当前时间
+
+	s.lock.Lock()
+	err := s.setWithoutLock(currentTimestamp, key, hashedKey, entry)
+	s.unlockAndSpill()
+	return err
+}
+
+// set 不加锁，替换key原来的entry
+func (s *cacheShard) setWithoutLock(currentTimestamp uint64, key string, hashedKey uint64, entry []byte) error {
+	//如果原来已经存在该hashedKey，就取出原来的entry，然后将entry中存的key重置了（就是置成了空数组）
+	//这里就是标记一下，entries中该entry已经不可用了。todo ，那onEvict的时候是不是发现不可用可以删？现在只是通过过期时间删除
+	s.resetPreviousEntry(key, hashedKey)
+
+	//这个意思就是，在每次set操作的时候，都会从entries中拿出最老的，判断是否过期，如果过期就删除，不过期就啥都不做
+	if oldestEntry, err := s.entries.Peek(); err == nil {
+		s.onEvict(oldestEntry, currentTimestamp, s.removeOldestEntry)
+	}
+
+	//encode
+	w := s.wrap(currentTimestamp, key, hashedKey, entry)
+
+	return s.push(key, hashedKey, w)
+}
+
 // set 不加锁。加的都是新的
 func (s *cacheShard) addNewWithoutLock(key string, hashedKey uint64, entry []byte) error {
 	currentTimestamp := uint64(s.clock.Epoch())
@@ -169,40 +487,20 @@ func (s *cacheShard) addNewWithoutLock(key string, hashedKey uint64, entry []byt
 		s.onEvict(oldestEntry, currentTimestamp, s.removeOldestEntry)
 	}
 
-	w := wrapEntry(currentTimestamp, hashedKey, key, entry, &s.entryBuffer)
+	w := s.wrap(currentTimestamp, key, hashedKey, entry)
 
-	for {
-		if index, err := s.entries.Push(w); err == nil {
-			s.hashmap[hashedKey] = uint32(index)
-			return nil
-		}
-		if s.removeOldestEntry(NoSpace) != nil {
-			return fmt.Errorf("entry is bigger than max shard size")
-		}
-	}
+	return s.push(key, hashedKey, w)
 }
 
 // 直接给encode好的entry，然后不加锁set
-func (s *cacheShard) setWrappedEntryWithoutLock(currentTimestamp uint64, w []byte, hashedKey uint64) error {
-	if previousIndex := s.hashmap[hashedKey]; previousIndex != 0 {
-		if previousEntry, err := s.entries.Get(int(previousIndex)); err == nil {
-			resetKeyFromEntry(previousEntry)
-		}
-	}
+func (s *cacheShard) setWrappedEntryWithoutLock(currentTimestamp uint64, w []byte, key string, hashedKey uint64) error {
+	s.resetPreviousEntry(key, hashedKey)
 
 	if oldestEntry, err := s.entries.Peek(); err == nil {
 		s.onEvict(oldestEntry, currentTimestamp, s.removeOldestEntry)
 	}
 
-	for {
-		if index, err := s.entries.Push(w); err == nil {
-			s.hashmap[hashedKey] = uint32(index)
-			return nil
-		}
-		if s.removeOldestEntry(NoSpace) != nil {
-			return fmt.Errorf("entry is bigger than max shard size")
-		}
-	}
+	return s.push(key, hashedKey, w)
 }
 
 func (s *cacheShard) append(key string, hashedKey uint64, entry []byte) error {
@@ -212,7 +510,7 @@ func (s *cacheShard) append(key string, hashedKey uint64, entry []byte) error {
 	if err == ErrEntryNotFound {
 		//如果本来就没有，就新增一个key。因为本身加锁了，所以这里调用的是不加锁的函数
 		err = s.addNewWithoutLock(key, hashedKey, entry)
-		s.lock.Unlock()
+		s.unlockAndSpill()
 		return err
 	}
 	if err != nil {
@@ -222,18 +520,58 @@ func (s *cacheShard) append(key string, hashedKey uint64, entry []byte) error {
 
 	currentTimestamp := uint64(s.clock.Epoch())
 
-	//todo 这里没看懂，干嘛要这样？
-	w := appendToWrappedEntry(currentTimestamp, wrappedEntry, entry, &s.entryBuffer)
+	var w []byte
+	if s.codec != nil {
+		// 压缩过的value不能直接拼接，要解压出来拼上新的，再重新压缩
+		value, err := appendEntryWithCodec(nil, wrappedEntry, s.codec)
+		if err != nil {
+			s.lock.Unlock()
+			return err
+		}
+		w = s.wrap(currentTimestamp, key, hashedKey, append(value, entry...))
+	} else {
+		//todo 这里没看懂，干嘛要这样？
+		w = appendToWrappedEntry(currentTimestamp, wrappedEntry, entry, &s.entryBuffer)
+	}
 
 	//将已经warp的存起来
-	err = s.setWrappedEntryWithoutLock(currentTimestamp, w, hashedKey)
-	s.lock.Unlock()
+	err = s.setWrappedEntryWithoutLock(currentTimestamp, w, key, hashedKey)
+	s.unlockAndSpill()
 
 	return err
 }
 
+// update calls fn with a copy of the value of key, or nil and false when there is none, and stores the value fn
+// returns when it also returns true. Both happen under the write lock, so no other write to the shard comes between.
+// 在写锁下读出key的value交给fn，fn返回true的话把它返回的值存回去，中间不会有别的写操作
+func (s *cacheShard) update(key string, hashedKey uint64, fn func(value []byte, found bool) ([]byte, bool, error)) error {
+	s.lock.Lock()
+	defer s.unlockAndSpill()
+
+	var value []byte
+	wrappedEntry, err := s.getValidWrapEntry(key, hashedKey)
+	found := err == nil
+	if found {
+		if value, err = readEntryWithCodec(wrappedEntry, s.codec); err != nil {
+			return err
+		}
+	} else if err != ErrEntryNotFound {
+		return err
+	}
+
+	entry, store, err := fn(value, found)
+	if err != nil || !store {
+		return err
+	}
+	return s.setWithoutLock(uint64(s.clock.Epoch()), key, hashedKey, entry)
+}
+
 //会先检查是否有，没有直接返回，有才会删除
-func (s *cacheShard) del(hashedKey uint64) error {
+func (s *cacheShard) del(key string, hashedKey uint64) error {
+	if s.collisions != nil {
+		return s.delCollidingKey(key, hashedKey)
+	}
+
 	// Optimistic pre-check using only readlock
 	//仅使用readlock进行乐观的预检查
 	s.lock.RLock()
@@ -275,18 +613,95 @@ func (s *cacheShard) del(hashedKey uint64) error {
 		}
 
 		delete(s.hashmap, hashedKey)
-		s.onRemove(wrappedEntry, Deleted)
-		if s.statsEnabled {
-			delete(s.hashmapStats, hashedKey)
+		s.deleted(hashedKey, wrappedEntry)
+	}
+	s.lock.Unlock()
+
+	s.delhit()
+	return nil
+}
+
+// delCollidingKey removes key in collision resolving mode, where the hash slot may belong to another key.
+// 冲突模式下的删除，要按key找到entry，不能只看hash
+func (s *cacheShard) delCollidingKey(key string, hashedKey uint64) error {
+	s.lock.Lock()
+	var wrappedEntry []byte
+	if itemIndex := s.hashmap[hashedKey]; itemIndex != 0 {
+		if entry, err := s.entries.Get(int(itemIndex)); err == nil && compareKeyFromEntry(entry, key) {
+			wrappedEntry = entry
+			delete(s.hashmap, hashedKey)
+		}
+	}
+	if wrappedEntry == nil {
+		if itemIndex := s.collisions[key]; itemIndex != 0 {
+			if entry, err := s.entries.Get(int(itemIndex)); err == nil {
+				wrappedEntry = entry
+			}
+			delete(s.collisions, key)
 		}
-		resetKeyFromEntry(wrappedEntry)
 	}
+	if wrappedEntry == nil {
+		s.lock.Unlock()
+		s.delmiss()
+		return ErrEntryNotFound
+	}
+
+	s.deleted(hashedKey, wrappedEntry)
 	s.lock.Unlock()
 
 	s.delhit()
 	return nil
 }
 
+// delMatching removes all entries whose key satisfies match and returns their number.
+// The shard stays locked for the whole scan.
+// 删除key满足match的所有entry，扫描期间一直持有shard的写锁
+func (s *cacheShard) delMatching(match func(key string) bool) int {
+	s.lock.Lock()
+	deleted := 0
+	for hashedKey, itemIndex := range s.hashmap {
+		wrappedEntry, err := s.entries.Get(int(itemIndex))
+		if err != nil || !match(readKeyFromEntry(wrappedEntry)) {
+			continue
+		}
+		delete(s.hashmap, hashedKey)
+		s.deleted(hashedKey, wrappedEntry)
+		deleted++
+	}
+	for key, itemIndex := range s.collisions {
+		wrappedEntry, err := s.entries.Get(int(itemIndex))
+		if err != nil || !match(key) {
+			continue
+		}
+		delete(s.collisions, key)
+		s.deleted(readHashFromEntry(wrappedEntry), wrappedEntry)
+		deleted++
+	}
+	if deleted > 0 && s.needsCompaction() {
+		s.compact()
+	}
+	s.lock.Unlock()
+
+	atomic.AddInt64(&s.stats.DelHits, int64(deleted))
+	return deleted
+}
+
+// deleted releases an entry already removed from the index
+func (s *cacheShard) deleted(hashedKey uint64, wrappedEntry []byte) {
+	s.removed(wrappedEntry, Deleted)
+	if s.statsEnabled {
+		delete(s.hashmapStats, hashedKey)
+	}
+	s.markDeleted(wrappedEntry)
+}
+
+// 不管阈值，直接compact
+func (s *cacheShard) forceCompact() {
+	s.lock.Lock()
+	s.compact()
+	s.lock.Unlock()
+}
+
 //删除key
 func (s *cacheShard) onEvict(oldestEntry []byte, currentTimestamp uint64, evict func(reason RemoveReason) error) bool {
 	oldestTimestamp := readTimestampFromEntry(oldestEntry)
@@ -307,6 +722,10 @@ func (s *cacheShard) cleanUp(currentTimestamp uint64) {
 			break
 		}
 	}
+	s.expireRequeued(currentTimestamp)
+	if s.needsCompaction() {
+		s.compact()
+	}
 	s.lock.Unlock()
 }
 
@@ -324,6 +743,62 @@ func (s *cacheShard) getEntry(hashedKey uint64) ([]byte, error) {
 	return newEntry, err
 }
 
+// 冲突模式下，按key从 collisions 中拿entry并拷贝一份返回
+func (s *cacheShard) getCollidedEntry(key string) ([]byte, error) {
+	s.lock.RLock()
+	itemIndex := s.collisions[key]
+	if itemIndex == 0 {
+		s.lock.RUnlock()
+		return nil, ErrEntryNotFound
+	}
+	entry, err := s.entries.Get(int(itemIndex))
+	// copy entry
+	newEntry := make([]byte, len(entry))
+	copy(newEntry, entry)
+	s.lock.RUnlock()
+
+	return newEntry, err
+}
+
+// snapshot copies all entries of the shard into data under a single read lock and returns the extended buffer
+// with the offsets of the copied entries; the i-th entry is data[offsets[i]:offsets[i+1]].
+// With keysOnly only headers and keys are copied, which is enough to read everything but values.
+// 在同一个读锁下把shard的所有entry拷贝到data里，得到这个时刻的一致快照。keysOnly 时只拷贝头和key，不拷贝value
+func (s *cacheShard) snapshot(data []byte, offsets []int, keysOnly bool) ([]byte, []int) {
+	s.lock.RLock()
+	offsets = append(offsets, len(data))
+	copyEntry := func(itemIndex uint32) {
+		entry, err := s.entries.Get(int(itemIndex))
+		if err != nil {
+			return
+		}
+		if keysOnly {
+			entry = readHeaderAndKeyView(entry)
+		}
+		data = append(data, entry...)
+		offsets = append(offsets, len(data))
+	}
+	for _, itemIndex := range s.hashmap {
+		copyEntry(itemIndex)
+	}
+	for _, itemIndex := range s.collisions {
+		copyEntry(itemIndex)
+	}
+	s.lock.RUnlock()
+	return data, offsets
+}
+
+// 冲突模式下，把 collisions 中的key拷贝出去
+func (s *cacheShard) copyCollidedKeys() []string {
+	s.lock.RLock()
+	keys := make([]string, 0, len(s.collisions))
+	for key := range s.collisions {
+		keys = append(keys, key)
+	}
+	s.lock.RUnlock()
+	return keys
+}
+
 //将hashed key拷贝出去，返回所有的hashed key，以及个数
 func (s *cacheShard) copyHashedKeys() (keys []uint64, next int) {
 	s.lock.RLock()
@@ -341,15 +816,34 @@ func (s *cacheShard) copyHashedKeys() (keys []uint64, next int) {
 //删除最老的entry
 func (s *cacheShard) removeOldestEntry(reason RemoveReason) error {
 	oldest, err := s.entries.Pop()
+	if err == nil && reason == NoSpace && s.accessed != nil {
+		oldest, reason = s.giveSecondChance(oldest)
+	}
 	if err == nil {
 		hash := readHashFromEntry(oldest) //set的时候发生碰撞后reset key是在这用到的。
 		if hash == 0 {
+			s.deadBytes -= len(oldest)
 			// entry has been explicitly deleted with resetKeyFromEntry, ignore
 			// 条目已使用resetKeyFromEntry明确删除，请忽略
 			return nil
 		}
-		delete(s.hashmap, hash)
-		s.onRemove(oldest, reason)
+		if s.collisions != nil {
+			// 没被重置的entry一定是key当前的entry，它要么在 collisions 里，要么在 hashmap 里
+			key := readKeyFromEntry(oldest)
+			if _, ok := s.collisions[key]; ok {
+				delete(s.collisions, key)
+			} else {
+				delete(s.hashmap, hash)
+			}
+		} else {
+			delete(s.hashmap, hash)
+		}
+		// 因为空间不够被淘汰的解锁后写到磁盘层，写成功了就不算删除。oldest指向queue的内存，要拷贝
+		if reason == NoSpace && s.overflow != nil {
+			s.spill = append(s.spill, append([]byte(nil), oldest...))
+		} else {
+			s.removed(oldest, reason)
+		}
 		if s.statsEnabled {
 			delete(s.hashmapStats, hash)
 		}
@@ -358,19 +852,127 @@ func (s *cacheShard) removeOldestEntry(reason RemoveReason) error {
 	return err
 }
 
+// giveSecondChance moves popped entries that were read since they were last considered for eviction
+// to the back of the queue, clearing their access bits, and returns the first entry that should be evicted
+// with the reason to remove it. Expired entries get no second chance.
+// Every entry is moved at most once per call, so a cache full of hot entries still evicts one.
+// CLOCK：弹出的entry如果被访问过，就清掉访问标记，重新放到队尾，再看下一个最老的entry。返回应该被删除的entry
+// 已经过期的entry不给第二次机会
+func (s *cacheShard) giveSecondChance(oldest []byte) ([]byte, RemoveReason) {
+	currentTimestamp := uint64(s.clock.Epoch())
+	s.expireRequeued(currentTimestamp)
+	for chances := s.entries.Len(); chances > 0; chances-- {
+		hash := readHashFromEntry(oldest)
+		if hash == 0 {
+			return oldest, NoSpace
+		}
+		timestamp := readTimestampFromEntry(oldest)
+		if currentTimestamp-timestamp > s.lifeWindow {
+			return oldest, Expired
+		}
+		if !s.accessed.testAndClear(s.indexOf(oldest, hash)) {
+			return oldest, NoSpace
+		}
+
+		// 先拷贝出来，重新push的时候可能会覆盖掉 oldest 所在的内存
+		s.requeueBuffer = append(s.requeueBuffer[:0], oldest...)
+		index, err := s.entries.Push(s.requeueBuffer)
+		if err != nil {
+			// 队尾放不下就只能删除它了
+			return s.requeueBuffer, NoSpace
+		}
+		s.accessed.clear(uint32(index))
+		s.reindex(s.requeueBuffer, hash, uint32(index))
+		requeued := requeuedEntry{timestamp: timestamp, hash: hash}
+		if s.collisions != nil {
+			requeued.key = readKeyFromEntry(s.requeueBuffer)
+		}
+		heap.Push(&s.requeued, requeued)
+
+		// 刚push过，queue不会是空的
+		oldest, _ = s.entries.Pop()
+	}
+	return oldest, NoSpace
+}
+
+// expireRequeued removes requeued entries that are older than the life window.
+// Records of entries that were removed or set again since they were requeued are dropped.
+// 删除重新入队过并且已经过期的entry。entry重新入队后被删除或者重新set过的话，记录就直接丢掉
+func (s *cacheShard) expireRequeued(currentTimestamp uint64) {
+	for len(s.requeued) > 0 && currentTimestamp-s.requeued[0].timestamp > s.lifeWindow {
+		requeued := heap.Pop(&s.requeued).(requeuedEntry)
+		index, collided := s.collisions[requeued.key]
+		if !collided {
+			index = s.hashmap[requeued.hash]
+		}
+		if index == 0 {
+			continue
+		}
+		wrappedEntry, err := s.entries.Get(int(index))
+		if err != nil || readHashFromEntry(wrappedEntry) != requeued.hash ||
+			readTimestampFromEntry(wrappedEntry) != requeued.timestamp {
+			continue
+		}
+		if collided {
+			delete(s.collisions, requeued.key)
+		} else if s.collisions != nil && !compareKeyFromEntry(wrappedEntry, requeued.key) {
+			continue
+		} else {
+			delete(s.hashmap, requeued.hash)
+		}
+		s.removed(wrappedEntry, Expired)
+		if s.statsEnabled {
+			delete(s.hashmapStats, requeued.hash)
+		}
+		s.markDeleted(wrappedEntry)
+	}
+}
+
+// indexOf returns the queue index of a live entry
+// 有效的entry一定是它的key在 hashmap 或 collisions 中记录的那个
+func (s *cacheShard) indexOf(wrappedEntry []byte, hashedKey uint64) uint32 {
+	if s.collisions != nil {
+		if index, ok := s.collisions[readKeyFromEntry(wrappedEntry)]; ok {
+			return index
+		}
+	}
+	return s.hashmap[hashedKey]
+}
+
+// reindex points the key of a live entry that was moved inside the queue to its new index
+// entry在queue中移动后，更新 hashmap 或 collisions 中的偏移
+func (s *cacheShard) reindex(wrappedEntry []byte, hashedKey uint64, index uint32) {
+	if s.collisions != nil {
+		key := readKeyFromEntry(wrappedEntry)
+		if _, ok := s.collisions[key]; ok {
+			s.collisions[key] = index
+			return
+		}
+	}
+	s.hashmap[hashedKey] = index
+}
+
 //重置
 func (s *cacheShard) reset(config Config) {
 	s.lock.Lock()
 	s.hashmap = make(map[uint64]uint32, config.initialShardSize())
+	if s.collisions != nil {
+		s.collisions = make(map[string]uint32)
+	}
 	s.entryBuffer = make([]byte, config.MaxEntrySize+headersSizeInBytes)
 	s.entries.Reset()
+	s.deadBytes = 0
+	if s.accessed != nil {
+		s.accessed.reset()
+	}
+	s.requeued = nil
 	s.lock.Unlock()
 }
 
 //返回当前存的key的个数
 func (s *cacheShard) len() int {
 	s.lock.RLock()
-	res := len(s.hashmap)
+	res := len(s.hashmap) + len(s.collisions)
 	s.lock.RUnlock()
 	return res
 }
@@ -390,10 +992,104 @@ func (s *cacheShard) getStats() Stats {
 		DelHits:    atomic.LoadInt64(&s.stats.DelHits),
 		DelMisses:  atomic.LoadInt64(&s.stats.DelMisses),
 		Collisions: atomic.LoadInt64(&s.stats.Collisions),
+
+		Compactions:    atomic.LoadInt64(&s.stats.Compactions),
+		ReclaimedBytes: atomic.LoadInt64(&s.stats.ReclaimedBytes),
+
+		UncompressedBytes: atomic.LoadInt64(&s.stats.UncompressedBytes),
+		CompressedBytes:   atomic.LoadInt64(&s.stats.CompressedBytes),
+
+		Removals:     s.removals.load(),
+		RemovedBytes: s.removedBytes.load(),
 	}
 	return stats
 }
 
+func (s *cacheShard) getShardStats() ShardStats {
+	currentTimestamp := uint64(s.clock.Epoch())
+	s.lock.RLock()
+	entries := len(s.hashmap) + len(s.collisions)
+	used := s.entries.Used()
+	capacity := s.entries.Capacity()
+	var oldestEntryAge time.Duration
+	if oldestEntry, err := s.entries.Peek(); err == nil && len(oldestEntry) >= headersSizeInBytes {
+		if oldestTimestamp := readTimestampFromEntry(oldestEntry); currentTimestamp > oldestTimestamp {
+			oldestEntryAge = time.Duration(currentTimestamp-oldestTimestamp) * s.clockResolution
+		}
+	}
+	s.lock.RUnlock()
+
+	return ShardStats{
+		Hits:       atomic.LoadInt64(&s.stats.Hits),
+		Misses:     atomic.LoadInt64(&s.stats.Misses),
+		DelHits:    atomic.LoadInt64(&s.stats.DelHits),
+		DelMisses:  atomic.LoadInt64(&s.stats.DelMisses),
+		Collisions: atomic.LoadInt64(&s.stats.Collisions),
+		Entries:    entries,
+		UsedBytes:  used,
+		Capacity:   capacity,
+
+		Removals:       s.removals.load(),
+		RemovedBytes:   s.removedBytes.load(),
+		OldestEntryAge: oldestEntryAge,
+	}
+}
+
+// hotKeys returns up to k keys of the shard with the highest request counts, most requested first.
+// Hashes without a live entry are skipped.
+// 返回请求次数最多的k个key，没有对应entry的hash跳过
+func (s *cacheShard) hotKeys(k int) []KeyStats {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	hot := make(keyStatsHeap, 0, k)
+	var colliding map[uint64]string
+	for hashedKey, count := range s.hashmapStats {
+		stats := KeyStats{Hash: hashedKey, RequestCount: count}
+		if len(hot) == k && !hotter(stats, hot[0]) {
+			continue
+		}
+		// hashmapStats 是按hash记的，key要从entry里读
+		key, ok := s.keyWithoutLock(hashedKey, &colliding)
+		if !ok {
+			continue
+		}
+		stats.Key = key
+		if len(hot) < k {
+			heap.Push(&hot, stats)
+		} else {
+			hot[0] = stats
+			heap.Fix(&hot, 0)
+		}
+	}
+	sortKeyStats(hot)
+	return hot
+}
+
+// keyWithoutLock returns the key of a live entry with hashedKey. Keys in collisions are
+// indexed by hash into colliding the first time they are needed.
+// 按hash找到一个有效entry的key。先看 hashmap，再看 collisions（第一次用到时按hash建索引）
+func (s *cacheShard) keyWithoutLock(hashedKey uint64, colliding *map[uint64]string) (string, bool) {
+	if itemIndex := s.hashmap[hashedKey]; itemIndex != 0 {
+		if wrappedEntry, err := s.entries.Get(int(itemIndex)); err == nil && readHashFromEntry(wrappedEntry) == hashedKey {
+			return readKeyFromEntry(wrappedEntry), true
+		}
+	}
+	if len(s.collisions) == 0 {
+		return "", false
+	}
+	if *colliding == nil {
+		*colliding = make(map[uint64]string, len(s.collisions))
+		for key, itemIndex := range s.collisions {
+			if wrappedEntry, err := s.entries.Get(int(itemIndex)); err == nil {
+				(*colliding)[readHashFromEntry(wrappedEntry)] = key
+			}
+		}
+	}
+	key, ok := (*colliding)[hashedKey]
+	return key, ok
+}
+
 func (s *cacheShard) getKeyMetadataWithLock(key uint64) Metadata {
 	s.lock.RLock()
 	c := s.hashmapStats[key]
@@ -437,29 +1133,123 @@ func (s *cacheShard) delmiss() {
 	atomic.AddInt64(&s.stats.DelMisses, 1)
 }
 
+// logCollision reports that key was looked up but the entry of another key holds its hash. It is logged at
+// Debug level since it happens on every read of the key.
+// 碰撞每次读这个key都会发生，所以是Debug级别
+func (s *cacheShard) logCollision(key string, wrappedEntry []byte, hashedKey uint64) {
+	if s.verboseLogger != nil {
+		s.verboseLogger.Printf("Collision detected. Both %q and %q have the same hash %x", key, readKeyFromEntry(wrappedEntry), hashedKey)
+		return
+	}
+	s.logger.Debug("Collision detected", "key", key, "storedKey", readKeyFromEntry(wrappedEntry), "hash", hashedKey)
+}
+
 func (s *cacheShard) collision() {
 	atomic.AddInt64(&s.stats.Collisions, 1)
 }
 
+// removed counts the removal of an entry and fires the OnRemove callback
+func (s *cacheShard) removed(wrappedEntry []byte, reason RemoveReason) {
+	s.removals.add(reason, 1)
+	s.removedBytes.add(reason, int64(len(wrappedEntry)))
+	s.onRemove(wrappedEntry, reason)
+}
+
+func (s *cacheShard) compressed(uncompressed, stored int) {
+	atomic.AddInt64(&s.stats.UncompressedBytes, int64(uncompressed))
+	atomic.AddInt64(&s.stats.CompressedBytes, int64(stored))
+}
+
 //在初始化bigCache的时候会调用。这里的参数callback是个函数变量。在bigcache中实现了3个该函数可以选择性传。
-func initNewShard(config Config, callback onRemoveCallback, clock clock) *cacheShard {
+func initNewShard(config Config, index int, callback onRemoveCallback, clock Clock, overflow *overflowStore) (*cacheShard, error) {
 	bytesQueueInitialCapacity := config.initialShardSize() * config.MaxEntrySize //单个shard的最大entry数+最大entry size
 	maximumShardSizeInBytes := config.maximumShardSizeInBytes()
 	if maximumShardSizeInBytes > 0 && bytesQueueInitialCapacity > maximumShardSizeInBytes {
 		bytesQueueInitialCapacity = maximumShardSizeInBytes //以maximumShardSizeInBytes为主
 	}
+	var collisions map[string]uint32
+	if config.ResolveCollisions {
+		collisions = make(map[string]uint32)
+	}
+	var accessed *accessBits
+	if config.EvictionPolicy == ClockEviction {
+		accessed = newAccessBits(bytesQueueInitialCapacity)
+	}
+	logger := withFields(newLeveledLogger(config), "shard", index)
+	entries, err := queue.NewBytesQueueWithStorage(bytesQueueInitialCapacity, maximumShardSizeInBytes, false, config.queueStorage())
+	if err != nil {
+		return nil, err
+	}
+	entries.SetLogger(logger)
+	var verboseLogger Logger
+	if config.Verbose && config.LeveledLogger == nil {
+		verboseLogger = newLogger(config.Logger)
+	}
 	return &cacheShard{
 		hashmap:      make(map[uint64]uint32, config.initialShardSize()), //单个shard的最大entry数个大小
+		collisions:   collisions,
+		accessed:     accessed,
 		hashmapStats: make(map[uint64]uint32, config.initialShardSize()),
 		//entries 是一个可扩展的byte队列，初始 bytesQueueInitialCapacity， 最大 maximumShardSizeInBytes
-		entries:     *queue.NewBytesQueue(bytesQueueInitialCapacity, maximumShardSizeInBytes, config.Verbose),
+		entries:     *entries,
 		entryBuffer: make([]byte, config.MaxEntrySize+headersSizeInBytes), //这个buffer可以存一个entry，应该是用来避免重复开辟内存的，类似缓存池
 		onRemove:    callback,                                             //删除entry后的回调
 
-		isVerbose:    config.Verbose,
-		logger:       newLogger(config.Logger),
-		clock:        clock,
-		lifeWindow:   uint64(config.LifeWindow.Seconds()),
-		statsEnabled: config.StatsEnabled,
+		logger:        logger,
+		verboseLogger: verboseLogger,
+		clock:         clock,
+		lifeWindow:    config.lifeWindowTicks(),
+		statsEnabled:  config.StatsEnabled,
+
+		maxSize:             maximumShardSizeInBytes,
+		compactionThreshold: config.CompactionThreshold,
+
+		overflow:        overflow,
+		clockResolution: config.clockResolution(),
+
+		codec:              config.Codec,
+		compressionMinSize: config.CompressionMinSize,
+		storage:            config.queueStorage(),
+	}, nil
+}
+
+// unlockAndSpill releases the write lock and writes the entries evicted under it to the disk tier.
+// Entries the disk tier does not take are counted as removed.
+// 释放写锁，然后把写锁下淘汰的entry写到磁盘层，写不进去的算作删除
+func (s *cacheShard) unlockAndSpill() {
+	if len(s.spill) == 0 {
+		s.lock.Unlock()
+		return
+	}
+	spill := s.spill
+	s.spill = nil
+	s.spillLock.Lock()
+	s.lock.Unlock()
+	defer s.spillLock.Unlock()
+
+	for _, wrappedEntry := range spill {
+		if !s.overflow.put(wrappedEntry) {
+			s.removed(wrappedEntry, NoSpace)
+		}
+	}
+}
+
+// waitForSpill waits until the entries evicted before the call are written to the disk tier
+func (s *cacheShard) waitForSpill() {
+	s.spillLock.Lock()
+	s.spillLock.Unlock()
+}
+
+// free releases the memory of the shard queue
+func (s *cacheShard) free() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	s.hashmap = make(map[uint64]uint32)
+	if s.collisions != nil {
+		s.collisions = make(map[string]uint32)
 	}
+	s.deadBytes = 0
+	s.requeued = nil
+	return s.entries.Free()
 }
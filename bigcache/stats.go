@@ -1,5 +1,12 @@
 package bigcache
 
+import (
+	"container/heap"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
 // Stats stores cache statistics
 // Stats 储存 cache 统计数据
 type Stats struct {
@@ -18,4 +25,135 @@ type Stats struct {
 	// Collisions is a number of happened key-collisions
 	// key 冲突的次数
 	Collisions int64 `json:"collisions"`
+	// Compactions is a number of times deleted entries were compacted out of shard queues
+	// 压缩queue的次数
+	Compactions int64 `json:"compactions"`
+	// ReclaimedBytes is a number of bytes of deleted entries freed by compactions
+	// 压缩回收的字节数
+	ReclaimedBytes int64 `json:"reclaimed_bytes"`
+	// UncompressedBytes is a number of bytes of values passed to Config.Codec
+	// 交给codec压缩的value的总字节数
+	UncompressedBytes int64 `json:"uncompressed_bytes"`
+	// CompressedBytes is a number of bytes stored for values passed to Config.Codec,
+	// which are kept uncompressed when compression does not make them smaller
+	// 这些value实际存下的总字节数（压缩后没变小的按原样存）
+	CompressedBytes int64 `json:"compressed_bytes"`
+	// Removals counts entries removed from the cache by reason
+	// 按原因统计的删除次数
+	Removals RemovalCounts `json:"removals"`
+	// RemovedBytes counts bytes of entries, including their headers, removed from the cache by reason
+	// 按原因统计的删除的字节数（包括entry头）
+	RemovedBytes RemovalCounts `json:"removed_bytes"`
+}
+
+// CompressionRatio returns UncompressedBytes divided by CompressedBytes, or 1 if nothing was compressed
+// 压缩率：压缩前的字节数/压缩后的字节数
+func (s Stats) CompressionRatio() float64 {
+	if s.CompressedBytes == 0 {
+		return 1
+	}
+	return float64(s.UncompressedBytes) / float64(s.CompressedBytes)
+}
+
+// RemovalCounts stores numbers of removed entries, or of their bytes, for each RemoveReason
+// 按删除原因统计的删除次数（或者字节数）
+type RemovalCounts struct {
+	// Expired counts entries removed because they were past LifeWindow
+	Expired int64 `json:"expired"`
+	// NoSpace counts entries evicted to make room for new ones
+	NoSpace int64 `json:"no_space"`
+	// Deleted counts entries removed by Delete
+	Deleted int64 `json:"deleted"`
+}
+
+func (r *RemovalCounts) add(reason RemoveReason, n int64) {
+	switch reason {
+	case Expired:
+		atomic.AddInt64(&r.Expired, n)
+	case NoSpace:
+		atomic.AddInt64(&r.NoSpace, n)
+	case Deleted:
+		atomic.AddInt64(&r.Deleted, n)
+	}
 }
+
+func (r *RemovalCounts) load() RemovalCounts {
+	return RemovalCounts{
+		Expired: atomic.LoadInt64(&r.Expired),
+		NoSpace: atomic.LoadInt64(&r.NoSpace),
+		Deleted: atomic.LoadInt64(&r.Deleted),
+	}
+}
+
+func (r *RemovalCounts) sum(other RemovalCounts) {
+	r.Expired += other.Expired
+	r.NoSpace += other.NoSpace
+	r.Deleted += other.Deleted
+}
+
+// ShardStats stores statistics of a single shard
+// 单个shard的统计数据，用来排查hash不均匀
+type ShardStats struct {
+	Hits       int64 `json:"hits"`
+	Misses     int64 `json:"misses"`
+	DelHits    int64 `json:"delete_hits"`
+	DelMisses  int64 `json:"delete_misses"`
+	Collisions int64 `json:"collisions"`
+	// Entries is a number of entries kept in the shard
+	Entries int `json:"entries"`
+	// UsedBytes is a number of bytes of the shard's queue taken by entries, including deleted ones not yet reclaimed
+	// queue中已经使用的字节数，包括已删除但还没回收的entry
+	UsedBytes int `json:"used_bytes"`
+	// Capacity is the size of the shard's queue in bytes
+	Capacity int `json:"capacity"`
+	// Removals counts entries removed from the shard by reason
+	Removals RemovalCounts `json:"removals"`
+	// RemovedBytes counts bytes of entries, including their headers, removed from the shard by reason
+	RemovedBytes RemovalCounts `json:"removed_bytes"`
+	// OldestEntryAge is the time since the oldest entry in the shard's queue was set, zero for an empty shard.
+	// An age well below LifeWindow together with NoSpace removals means the cache is too small.
+	// 队列中最老的entry写入到现在的时间。如果远小于 LifeWindow 而且有 NoSpace 删除，说明cache太小了
+	OldestEntryAge time.Duration `json:"oldest_entry_age"`
+}
+
+// KeyStats stores the request count of a key, as reported by HotKeys
+type KeyStats struct {
+	Key          string `json:"key"`
+	Hash         uint64 `json:"hash"`
+	Shard        int    `json:"shard"`
+	RequestCount uint32 `json:"request_count"`
+}
+
+// sortKeyStats orders keys by request count, most requested first, and then by hash
+func sortKeyStats(keys []KeyStats) {
+	sort.Slice(keys, func(i, j int) bool {
+		return hotter(keys[i], keys[j])
+	})
+}
+
+// hotter reports whether a goes before b in HotKeys
+func hotter(a, b KeyStats) bool {
+	if a.RequestCount != b.RequestCount {
+		return a.RequestCount > b.RequestCount
+	}
+	return a.Hash < b.Hash
+}
+
+// keyStatsHeap is a min-heap of keys with the least requested key on top, used to keep the k hottest keys
+// 小顶堆，堆顶是请求次数最少的key，用来保留请求次数最多的k个key
+type keyStatsHeap []KeyStats
+
+func (h keyStatsHeap) Len() int            { return len(h) }
+func (h keyStatsHeap) Less(i, j int) bool  { return hotter(h[j], h[i]) }
+func (h keyStatsHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *keyStatsHeap) Push(x interface{}) { *h = append(*h, x.(KeyStats)) }
+
+func (h *keyStatsHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	*h = old[:n-1]
+	return e
+}
+
+var _ heap.Interface = (*keyStatsHeap)(nil)
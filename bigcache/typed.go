@@ -0,0 +1,200 @@
+package bigcache
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+// Serializer converts values of type V to the bytes stored in the cache and back.
+// Unmarshal must not keep data after it returns.
+// 把V类型的值转换成存到cache里的字节，以及反过来
+type Serializer[V any] interface {
+	Marshal(value V) ([]byte, error)
+	Unmarshal(data []byte) (V, error)
+}
+
+// DecodeError is returned when the bytes stored for a key can not be unmarshalled, which tells a corrupted
+// or incompatible entry apart from ErrEntryNotFound.
+// 存的字节解不出来，和 ErrEntryNotFound 区分开
+type DecodeError struct {
+	Key string
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("cannot decode entry %q: %v", e.Key, e.Err)
+}
+
+// Unwrap returns the error of the serializer
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// EncodeError is returned when a value can not be marshalled before it is stored
+type EncodeError struct {
+	Key string
+	Err error
+}
+
+func (e *EncodeError) Error() string {
+	return fmt.Sprintf("cannot encode entry %q: %v", e.Key, e.Err)
+}
+
+// Unwrap returns the error of the serializer
+func (e *EncodeError) Unwrap() error {
+	return e.Err
+}
+
+// TypedCache stores values of type V in a BigCache, converting them with a Serializer.
+// It is safe for concurrent use like the BigCache it wraps.
+// 在BigCache上存V类型的值，用Serializer转换
+type TypedCache[V any] struct {
+	cache      *BigCache
+	serializer Serializer[V]
+}
+
+// NewTypedCache returns a TypedCache storing values in cache with serializer.
+// Several typed caches may share a BigCache when their keys do not overlap.
+func NewTypedCache[V any](cache *BigCache, serializer Serializer[V]) *TypedCache[V] {
+	return &TypedCache[V]{cache: cache, serializer: serializer}
+}
+
+// Cache returns the underlying BigCache
+func (c *TypedCache[V]) Cache() *BigCache {
+	return c.cache
+}
+
+// Get reads the value for the key. It returns ErrEntryNotFound when there is no entry for the key and
+// a *DecodeError when the stored bytes can not be unmarshalled.
+func (c *TypedCache[V]) Get(key string) (V, error) {
+	var value V
+	data, err := c.cache.Get(key)
+	if err != nil {
+		return value, err
+	}
+	// 在锁外面解码，Get已经拷贝过了
+	if value, err = c.serializer.Unmarshal(data); err != nil {
+		return value, &DecodeError{Key: key, Err: err}
+	}
+	return value, nil
+}
+
+// Set saves the value under the key. It returns an *EncodeError when the value can not be marshalled.
+func (c *TypedCache[V]) Set(key string, value V) error {
+	data, err := c.serializer.Marshal(value)
+	if err != nil {
+		return &EncodeError{Key: key, Err: err}
+	}
+	return c.cache.Set(key, data)
+}
+
+// Delete removes the key
+func (c *TypedCache[V]) Delete(key string) error {
+	return c.cache.Delete(key)
+}
+
+// Iterator returns an iterator over the typed entries, configured like BigCache.Iterator
+func (c *TypedCache[V]) Iterator(options ...IteratorOption) *TypedIterator[V] {
+	return &TypedIterator[V]{entries: c.cache.Iterator(options...), serializer: c.serializer}
+}
+
+// TypedIterator allows to iterate over the typed entries of a TypedCache
+type TypedIterator[V any] struct {
+	entries    *EntryInfoIterator
+	serializer Serializer[V]
+}
+
+// SetNext moves to next element and returns true if it exists.
+func (it *TypedIterator[V]) SetNext() bool {
+	return it.entries.SetNext()
+}
+
+// Value returns the key and the value at the current position. It returns a *DecodeError when the
+// stored bytes can not be unmarshalled.
+func (it *TypedIterator[V]) Value() (string, V, error) {
+	var value V
+	entry, err := it.entries.Value()
+	if err != nil {
+		return entry.Key(), value, err
+	}
+	if value, err = it.serializer.Unmarshal(entry.Value()); err != nil {
+		return entry.Key(), value, &DecodeError{Key: entry.Key(), Err: err}
+	}
+	return entry.Key(), value, nil
+}
+
+// Close stops the iteration, see EntryInfoIterator.Close
+func (it *TypedIterator[V]) Close() error {
+	return it.entries.Close()
+}
+
+// ForEach calls fn for every remaining entry and closes the iterator. It stops early and returns the error
+// when fn returns one, when an entry can not be read or decoded, or when ctx is done.
+func (it *TypedIterator[V]) ForEach(ctx context.Context, fn func(key string, value V) error) error {
+	return it.entries.ForEach(ctx, func(entry EntryInfo) error {
+		value, err := it.serializer.Unmarshal(entry.Value())
+		if err != nil {
+			return &DecodeError{Key: entry.Key(), Err: err}
+		}
+		return fn(entry.Key(), value)
+	})
+}
+
+// JSONSerializer returns a serializer encoding values with encoding/json
+func JSONSerializer[V any]() Serializer[V] {
+	return jsonSerializer[V]{}
+}
+
+type jsonSerializer[V any] struct{}
+
+func (jsonSerializer[V]) Marshal(value V) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (jsonSerializer[V]) Unmarshal(data []byte) (V, error) {
+	var value V
+	err := json.Unmarshal(data, &value)
+	return value, err
+}
+
+// GobSerializer returns a serializer encoding values with encoding/gob. Every value carries its type
+// description, so gob suits values of many fields better than small ones.
+// 每个值都带着类型描述，适合字段多的值
+func GobSerializer[V any]() Serializer[V] {
+	return gobSerializer[V]{}
+}
+
+type gobSerializer[V any] struct{}
+
+func (gobSerializer[V]) Marshal(value V) ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(value); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (gobSerializer[V]) Unmarshal(data []byte) (V, error) {
+	var value V
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&value)
+	return value, err
+}
+
+// RawSerializer returns a serializer storing byte slices as they are
+func RawSerializer() Serializer[[]byte] {
+	return rawSerializer{}
+}
+
+type rawSerializer struct{}
+
+func (rawSerializer) Marshal(value []byte) ([]byte, error) {
+	return value, nil
+}
+
+// Unmarshal copies data, which is only valid until it returns
+func (rawSerializer) Unmarshal(data []byte) ([]byte, error) {
+	return append([]byte(nil), data...), nil
+}
@@ -0,0 +1,152 @@
+package bigcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+type user struct {
+	Name string
+	Age  int
+}
+
+func newTypedTestCache(t *testing.T) *BigCache {
+	cache, err := NewBigCache(Config{
+		Shards:             8,
+		LifeWindow:         time.Minute,
+		MaxEntriesInWindow: 100,
+		MaxEntrySize:       256,
+	})
+	noError(t, err)
+	return cache
+}
+
+func TestTypedCacheSerializers(t *testing.T) {
+	t.Parallel()
+
+	for name, serializer := range map[string]Serializer[user]{
+		"json": JSONSerializer[user](),
+		"gob":  GobSerializer[user](),
+	} {
+		// given
+		cache := NewTypedCache(newTypedTestCache(t), serializer)
+
+		// when
+		noError(t, cache.Set("alice", user{Name: "Alice", Age: 30}))
+		value, err := cache.Get("alice")
+
+		// then
+		noError(t, err)
+		assertEqual(t, user{Name: "Alice", Age: 30}, value, name)
+	}
+}
+
+func TestTypedCacheWithRawSerializer(t *testing.T) {
+	t.Parallel()
+
+	// given
+	cache := NewTypedCache(newTypedTestCache(t), RawSerializer())
+	cache.Set("key", []byte("value"))
+
+	// when
+	value, err := cache.Get("key")
+
+	// then
+	noError(t, err)
+	assertEqual(t, []byte("value"), value)
+}
+
+func TestTypedCacheDistinguishesDecodeErrorFromNotFound(t *testing.T) {
+	t.Parallel()
+
+	// given
+	bigCache := newTypedTestCache(t)
+	cache := NewTypedCache(bigCache, JSONSerializer[user]())
+	bigCache.Set("corrupted", []byte("{not json"))
+
+	// when
+	_, notFoundErr := cache.Get("missing")
+	_, decodeErr := cache.Get("corrupted")
+
+	// then
+	assertEqual(t, ErrEntryNotFound, notFoundErr)
+	var err *DecodeError
+	assertEqual(t, true, errors.As(decodeErr, &err))
+	assertEqual(t, "corrupted", err.Key)
+	assertEqual(t, false, errors.Is(decodeErr, ErrEntryNotFound))
+}
+
+func TestTypedCacheReturnsEncodeError(t *testing.T) {
+	t.Parallel()
+
+	// given
+	cache := NewTypedCache(newTypedTestCache(t), JSONSerializer[func()]())
+
+	// when
+	err := cache.Set("key", func() {})
+
+	// then
+	var encodeErr *EncodeError
+	assertEqual(t, true, errors.As(err, &encodeErr))
+	_, getErr := cache.Get("key")
+	assertEqual(t, ErrEntryNotFound, getErr)
+}
+
+func TestTypedCacheDelete(t *testing.T) {
+	t.Parallel()
+
+	// given
+	cache := NewTypedCache(newTypedTestCache(t), JSONSerializer[int]())
+	cache.Set("key", 42)
+
+	// when
+	noError(t, cache.Delete("key"))
+	_, err := cache.Get("key")
+
+	// then
+	assertEqual(t, ErrEntryNotFound, err)
+}
+
+func TestTypedIterator(t *testing.T) {
+	t.Parallel()
+
+	// given
+	cache := NewTypedCache(newTypedTestCache(t), JSONSerializer[int]())
+	for i := 0; i < 10; i++ {
+		cache.Set(fmt.Sprintf("key%d", i), i)
+	}
+
+	// when
+	values := make(map[string]int)
+	it := cache.Iterator()
+	for it.SetNext() {
+		key, value, err := it.Value()
+		noError(t, err)
+		values[key] = value
+	}
+
+	// then
+	assertEqual(t, 10, len(values))
+	assertEqual(t, 7, values["key7"])
+}
+
+func TestTypedIteratorForEachStopsOnDecodeError(t *testing.T) {
+	t.Parallel()
+
+	// given
+	bigCache := newTypedTestCache(t)
+	cache := NewTypedCache(bigCache, JSONSerializer[int]())
+	bigCache.Set("corrupted", []byte("x"))
+
+	// when
+	err := cache.Iterator().ForEach(context.Background(), func(key string, value int) error {
+		return nil
+	})
+
+	// then
+	var decodeErr *DecodeError
+	assertEqual(t, true, errors.As(err, &decodeErr))
+}
@@ -0,0 +1,10 @@
+module github.com/allegro/bigcache/v2/typedproto
+
+go 1.18
+
+require (
+	github.com/allegro/bigcache/v2 v2.0.0
+	google.golang.org/protobuf v1.31.0
+)
+
+replace github.com/allegro/bigcache/v2 => ../
@@ -0,0 +1,42 @@
+// Package typedproto stores protobuf messages in a bigcache.TypedCache. It is a separate module, so the core
+// cache does not depend on protobuf.
+// 用protobuf编码TypedCache的值，单独的module，bigcache本身不依赖protobuf
+package typedproto
+
+import (
+	"errors"
+
+	"github.com/allegro/bigcache/v2"
+	"google.golang.org/protobuf/proto"
+)
+
+// errNotMessagePointer is returned by Unmarshal when V is an interface such as proto.Message,
+// which does not tell which message to decode
+var errNotMessagePointer = errors.New("typedproto: V must be a generated message pointer type such as *pb.User")
+
+// Serializer returns a serializer encoding protobuf messages in the binary wire format.
+// V must be a generated message pointer type such as *pb.User. With an interface type such as proto.Message
+// values can be marshalled, but Unmarshal returns an error since it can not tell which message to create.
+// 用protobuf的二进制格式编码，V必须是生成的message的指针类型。V是 proto.Message 这样的接口的话，
+// 不知道要创建哪种message，Unmarshal 会返回错误
+func Serializer[V proto.Message]() bigcache.Serializer[V] {
+	return serializer[V]{}
+}
+
+type serializer[V proto.Message] struct{}
+
+func (serializer[V]) Marshal(value V) ([]byte, error) {
+	return proto.Marshal(value)
+}
+
+func (serializer[V]) Unmarshal(data []byte) (V, error) {
+	var zero V
+	if any(zero) == nil {
+		// V是接口，零值是nil接口，调用 ProtoReflect 会panic
+		return zero, errNotMessagePointer
+	}
+	// 生成的message在nil指针上也能拿到类型信息
+	value := zero.ProtoReflect().New().Interface().(V)
+	err := proto.Unmarshal(data, value)
+	return value, err
+}
@@ -0,0 +1,59 @@
+package typedproto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/allegro/bigcache/v2"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func newCache(t *testing.T) *bigcache.BigCache {
+	cache, err := bigcache.NewBigCache(bigcache.DefaultConfig(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cache
+}
+
+func TestTypedCacheWithSerializer(t *testing.T) {
+	t.Parallel()
+
+	// given
+	cache := bigcache.NewTypedCache(newCache(t), Serializer[*wrapperspb.StringValue]())
+	cache.Set("key", wrapperspb.String("value"))
+
+	// when
+	value, err := cache.Get("key")
+
+	// then
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value.GetValue() != "value" {
+		t.Errorf("got %q, want %q", value.GetValue(), "value")
+	}
+}
+
+func TestUnmarshalIntoInterfaceType(t *testing.T) {
+	t.Parallel()
+
+	// given
+	serializer := Serializer[proto.Message]()
+	data, err := serializer.Marshal(wrapperspb.String("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// when
+	value, err := serializer.Unmarshal(data)
+
+	// then
+	if err != errNotMessagePointer {
+		t.Errorf("got error %v, want %v", err, errNotMessagePointer)
+	}
+	if value != nil {
+		t.Errorf("got %v, want nil", value)
+	}
+}
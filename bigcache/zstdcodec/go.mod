@@ -0,0 +1,10 @@
+module github.com/allegro/bigcache/v2/zstdcodec
+
+go 1.21
+
+require (
+	github.com/allegro/bigcache/v2 v2.0.0
+	github.com/klauspost/compress v1.17.11
+)
+
+replace github.com/allegro/bigcache/v2 => ../
@@ -0,0 +1,46 @@
+// Package zstdcodec compresses bigcache values with zstd. It is a separate module, so the core cache
+// does not depend on a zstd library.
+// zstd 压缩，单独的module，bigcache本身不依赖zstd的库
+package zstdcodec
+
+import (
+	"github.com/allegro/bigcache/v2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// ID identifies zstd compressed values in entry headers
+const ID = 3
+
+// Codec compresses values with zstd at the default level. It compresses JSON better than
+// bigcache.DeflateCodec and decompresses faster.
+var Codec = New(zstd.SpeedDefault)
+
+type codec struct {
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+// New returns a codec compressing values with zstd at the given level
+func New(level zstd.EncoderLevel) bigcache.Codec {
+	// 只有选项不对才会返回错误，这里的选项都是固定的
+	encoder, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(level), zstd.WithEncoderConcurrency(1))
+	decoder, _ := zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+	return &codec{encoder: encoder, decoder: decoder}
+}
+
+func (c *codec) ID() byte {
+	return ID
+}
+
+// Encode appends a zstd frame of src to dst. It is safe for concurrent use.
+func (c *codec) Encode(dst, src []byte) []byte {
+	return c.encoder.EncodeAll(src, dst)
+}
+
+func (c *codec) Decode(dst, src []byte) ([]byte, error) {
+	decoded, err := c.decoder.DecodeAll(src, dst)
+	if err != nil {
+		return dst, bigcache.ErrCorruptedEntry
+	}
+	return decoded, nil
+}
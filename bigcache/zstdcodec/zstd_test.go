@@ -0,0 +1,66 @@
+package zstdcodec
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/allegro/bigcache/v2"
+)
+
+func TestRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	for _, input := range [][]byte{{}, []byte("abc"), []byte(strings.Repeat(`{"id":12345,"name":"bigcache"},`, 1000))} {
+		// when
+		encoded := Codec.Encode([]byte("prefix"), input)
+		decoded, err := Codec.Decode([]byte("prefix"), encoded[len("prefix"):])
+
+		// then
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !bytes.Equal(append([]byte("prefix"), input...), decoded) {
+			t.Errorf("round trip of %d bytes returned %q", len(input), decoded)
+		}
+	}
+}
+
+func TestDetectsCorruptedFrames(t *testing.T) {
+	t.Parallel()
+
+	// when
+	_, err := Codec.Decode(nil, []byte("not a zstd frame"))
+
+	// then
+	if err != bigcache.ErrCorruptedEntry {
+		t.Errorf("expected ErrCorruptedEntry, got %v", err)
+	}
+}
+
+func TestCompressesCacheValues(t *testing.T) {
+	t.Parallel()
+
+	// given
+	cache, _ := bigcache.NewBigCache(bigcache.Config{
+		Shards:             1,
+		LifeWindow:         time.Minute,
+		MaxEntriesInWindow: 16,
+		MaxEntrySize:       256,
+		Codec:              Codec,
+	})
+	value := []byte(strings.Repeat(`{"id":12345,"name":"bigcache"},`, 1000))
+
+	// when
+	cache.Set("key", value)
+	stored, err := cache.Get("key")
+
+	// then
+	if err != nil || !bytes.Equal(value, stored) {
+		t.Errorf("expected the stored value back, got %d bytes and %v", len(stored), err)
+	}
+	if ratio := cache.Stats().CompressionRatio(); ratio < 10 {
+		t.Errorf("expected values to compress at least 10x, ratio %v", ratio)
+	}
+}
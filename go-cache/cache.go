@@ -1,18 +1,22 @@
 package cache
 
 import (
+	"context"
 	"encoding/gob"
 	"fmt"
 	"io"
 	"os"
+	"reflect"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Item struct {
-	Object     interface{}
-	Expiration int64
+	Object         interface{}
+	Expiration     int64
+	SoftExpiration int64 // 软过期时间，过了它 Get 仍返回旧值，同时在后台刷新
 }
 
 // Returns true if the item has expired. 过期返回true
@@ -23,6 +27,15 @@ func (item Item) Expired() bool {
 	return time.Now().UnixNano() > item.Expiration
 }
 
+// Returns true if the item is past its soft expiration time, i.e. it is still
+// served by Get but due for a refresh. 软过期返回true
+func (item Item) Stale() bool {
+	if item.SoftExpiration == 0 {
+		return false
+	}
+	return time.Now().UnixNano() > item.SoftExpiration
+}
+
 const (
 	// For use with functions that take an expiration time.
 	NoExpiration time.Duration = -1
@@ -44,6 +57,50 @@ type cache struct {
 	mu                sync.RWMutex              // 锁
 	onEvicted         func(string, interface{}) //逐出  删除后的回调函数呀这是
 	janitor           *janitor
+	expiry            expiryHeap // 过期时间的小顶堆，DeleteExpired 用它找过期的item
+	// 软过期后的刷新函数
+	refresher  func(context.Context, string, interface{}) (interface{}, time.Duration, error)
+	loadMu     sync.Mutex           // 保护 loads 和 loadErrors
+	loads      map[string]*loadCall // 正在进行中的 GetOrLoad 加载
+	loadErrors map[string]loadError // 被缓存的加载错误（negative cache）
+	subMu      sync.Mutex           // 保护 subs 的修改
+	subs       atomic.Value         // 事件订阅者 []*subscriber，写时复制
+}
+
+// A loadCall is an in-flight or completed loader call made by GetOrLoad.
+type loadCall struct {
+	done chan struct{}
+	val  interface{}
+	err  error
+}
+
+// A loadError is a loader error cached until its expiration time.
+type loadError struct {
+	err        error
+	expiration int64
+}
+
+// A detachedContext keeps the values of its parent but is never canceled, so
+// a load shared by several callers does not fail when the caller that started
+// it gives up.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
 }
 
 // Add an item to the cache, replacing any existing item. If the duration is 0
@@ -61,10 +118,12 @@ func (c *cache) Set(k string, x interface{}, d time.Duration) {
 		e = time.Now().Add(d).UnixNano()
 	}
 	c.mu.Lock()
+	c.publishSet(k, x)
 	c.items[k] = Item{
 		Object:     x,
 		Expiration: e,
 	}
+	c.trackExpiration(k, e)
 	// TODO: Calls to mu.Unlock are currently not deferred because defer
 	// adds ~200 ns (as of go1.)
 	// 当前不延迟对mu.Unlock的调用，因为defer会增加〜200 ns（从go1开始）。
@@ -80,10 +139,62 @@ func (c *cache) set(k string, x interface{}, d time.Duration) {
 	if d > 0 {
 		e = time.Now().Add(d).UnixNano()
 	}
+	c.publishSet(k, x)
 	c.items[k] = Item{
 		Object:     x,
 		Expiration: e,
 	}
+	c.trackExpiration(k, e)
+}
+
+// Records the expiration time of the item just stored under k in the expiry
+// index, rebuilding the index if it holds too many stale entries. The caller
+// must hold c.mu for writing.
+// 把item的过期时间记到 expiry 堆里，调用方需要持有写锁
+func (c *cache) trackExpiration(k string, e int64) {
+	if e <= 0 {
+		return
+	}
+	c.expiry.push(k, e)
+	if len(c.expiry) > 2*len(c.items)+minExpiryRebuild {
+		c.expiry.rebuild(c.items)
+	}
+}
+
+// Add an item to the cache, replacing any existing item, like Set. In addition
+// to expiring after d, the item becomes stale after soft: from then on Get
+// keeps returning it, but also starts a single background refresh using the
+// function registered with OnRefresh. The refreshed item gets the same gap
+// between its soft and hard expiration. If soft is not between zero and the
+// item's expiration duration, the item has no soft expiration.
+// 和 Set 一样，但是 soft 之后item会软过期：Get 返回旧值，并在后台调用 OnRefresh 注册的函数刷新。d 之后才真正过期。
+func (c *cache) SetWithSoftExpiration(k string, x interface{}, soft, d time.Duration) {
+	if d == DefaultExpiration {
+		d = c.defaultExpiration
+	}
+	item := newItem(x, d, d-soft)
+	c.mu.Lock()
+	c.publishSet(k, x)
+	c.items[k] = item
+	c.trackExpiration(k, item.Expiration)
+	c.mu.Unlock()
+}
+
+// 创建一个item，d 是已经处理过 DefaultExpiration 的过期时长，
+// stale 是软过期到过期之间的时长，不在 (0, d) 之间就没有软过期
+func newItem(x interface{}, d, stale time.Duration) Item {
+	var e, se int64
+	if d > 0 {
+		e = time.Now().Add(d).UnixNano()
+		if stale > 0 && stale < d {
+			se = e - int64(stale)
+		}
+	}
+	return Item{
+		Object:         x,
+		Expiration:     e,
+		SoftExpiration: se,
+	}
 }
 
 // Add an item to the cache, replacing any existing item, using the default
@@ -122,6 +233,95 @@ func (c *cache) Replace(k string, x interface{}, d time.Duration) error {
 	return nil
 }
 
+// Replace the value of an item with new only if the item exists, hasn't
+// expired, and its value is equal to old. The item keeps its expiration time.
+// Returns true if the value was swapped. Values of types that are not
+// comparable, such as slices and maps, are never equal to old, so nothing is
+// swapped.
+// 只有当item存在、未过期，并且值等于old时，才替换成new，过期时间不变。返回是否替换了。
+// old 是不可比较的类型（slice、map等）时，直接返回false，不会panic。
+func (c *cache) CompareAndSwap(k string, old, new interface{}) bool {
+	if old != nil && !reflect.TypeOf(old).Comparable() {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, found := c.items[k]
+	if !found || v.Expired() || v.Object != old {
+		return false
+	}
+	c.publish(EventReplace, k, v.Object, new)
+	v.Object = new
+	c.items[k] = v
+	return true
+}
+
+// Delete an item from the cache and return its value, and a bool indicating
+// whether an unexpired item was found and deleted.
+// 删除item并返回它的值
+func (c *cache) GetAndDelete(k string) (interface{}, bool) {
+	c.mu.Lock()
+	x, found := c.get(k)
+	if !found {
+		c.mu.Unlock()
+		return nil, false
+	}
+	c.publish(EventDelete, k, x, nil)
+	v, evicted := c.delete(k)
+	c.mu.Unlock()
+	if evicted {
+		c.onEvicted(k, v)
+	}
+	return x, true
+}
+
+// Add an item to the cache, replacing any existing item, like Set, and return
+// the previous value and a bool indicating whether an unexpired item was
+// replaced.
+// 设置新值并返回旧值
+func (c *cache) GetAndSet(k string, x interface{}, d time.Duration) (interface{}, bool) {
+	c.mu.Lock()
+	old, found := c.get(k)
+	c.set(k, x, d)
+	c.mu.Unlock()
+	return old, found
+}
+
+// Atomically update an item. f is called with the current value and a bool
+// indicating whether an unexpired item was found, and returns the new value,
+// its expiration duration (as for Set), and whether to keep it. If keep is
+// false, the item is deleted. Returns the stored value and whether an item is
+// stored.
+//
+// f is called while the cache is locked, so it must not call the cache's
+// methods.
+// 在锁内执行 读-改-写：f 拿到旧值，返回新值、过期时间和是否保留，不保留就删除。f 里不能再调用cache的方法。
+func (c *cache) Update(k string, f func(old interface{}, found bool) (new interface{}, d time.Duration, keep bool)) (interface{}, bool) {
+	x, stored, v, evicted := c.update(k, f)
+	if evicted {
+		c.onEvicted(k, v)
+	}
+	return x, stored
+}
+
+// 在锁内执行 Update 的读-改-写，用 defer 解锁，f panic 的时候也不会一直锁着。返回被删除的值，由调用方在锁外调用 onEvicted。
+func (c *cache) update(k string, f func(old interface{}, found bool) (new interface{}, d time.Duration, keep bool)) (x interface{}, stored bool, v interface{}, evicted bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	old, found := c.get(k)
+	x, d, keep := f(old, found)
+	if keep {
+		c.set(k, x, d)
+		return x, true, nil, false
+	}
+	if !found {
+		return nil, false, nil, false
+	}
+	c.publish(EventDelete, k, old, nil)
+	v, evicted = c.delete(k)
+	return nil, false, v, evicted
+}
+
 // Get an item from the cache. Returns the item or nil, and a bool indicating
 // whether the key was found.
 // 从 cache 中获取一个 item。 返回一个item或者nil，还有 一个bool代表key是否找到
@@ -134,10 +334,17 @@ func (c *cache) Get(k string) (interface{}, bool) {
 		return nil, false
 	}
 	if item.Expiration > 0 { //get的时候如果发现过期，会直接返回nil，false
-		if time.Now().UnixNano() > item.Expiration {
+		now := time.Now().UnixNano()
+		if now > item.Expiration {
 			c.mu.RUnlock()
 			return nil, false
 		}
+		if item.SoftExpiration > 0 && now > item.SoftExpiration && c.refresher != nil {
+			refresher := c.refresher
+			c.mu.RUnlock()
+			c.refresh(k, item, refresher)
+			return item.Object, true
+		}
 	}
 	c.mu.RUnlock()
 	return item.Object, true
@@ -159,13 +366,18 @@ func (c *cache) GetWithExpiration(k string) (interface{}, time.Time, bool) {
 	}
 
 	if item.Expiration > 0 {
-		if time.Now().UnixNano() > item.Expiration {
+		now := time.Now().UnixNano()
+		if now > item.Expiration {
 			c.mu.RUnlock()
 			return nil, time.Time{}, false
 		}
 
 		// Return the item and the expiration time
+		refresher := c.refresher
 		c.mu.RUnlock()
+		if item.SoftExpiration > 0 && now > item.SoftExpiration && refresher != nil {
+			c.refresh(k, item, refresher)
+		}
 		return item.Object, time.Unix(0, item.Expiration), true
 	}
 
@@ -190,6 +402,128 @@ func (c *cache) get(k string) (interface{}, bool) {
 	return item.Object, true
 }
 
+// Get an item from the cache, or load it with the given loader if it is not
+// found. Concurrent calls for the same key share a single loader call, and the
+// loaded item is added to the cache with the duration returned by the loader
+// (DefaultExpiration and NoExpiration apply as with Set).
+//
+// If the loader returns an error, the error is returned to every caller
+// waiting on that load and nothing is added to the cache. If the returned
+// duration is greater than zero, the error is also cached for that long, and
+// GetOrLoad returns it without calling the loader again until it expires or
+// the key is Set.
+//
+// The loader is called with a context that carries the values of the context
+// of the caller that started the load but is never canceled, so the load is not
+// aborted, and its error not cached, because that caller gave up. Callers whose
+// context is done before the load completes return the context's error; the
+// load itself keeps running for the remaining callers.
+// GetOrLoad 从cache中获取item，没有的话调用loader加载。同一个key并发调用只会调用一次loader（singleflight）。
+func (c *cache) GetOrLoad(ctx context.Context, k string, loader func(context.Context) (interface{}, time.Duration, error)) (interface{}, error) {
+	if x, found := c.Get(k); found {
+		return x, nil
+	}
+	c.loadMu.Lock()
+	lc, found := c.loads[k]
+	if !found {
+		// The item may have been loaded or Set between Get and acquiring
+		// loadMu, and a cached error is only valid while the key is absent.
+		// 不能用 Get：软过期的item会触发 refresh，refresh 要再拿 loadMu。刷新等释放 loadMu 之后再开始
+		c.mu.RLock()
+		item, found := c.items[k]
+		refresher := c.refresher
+		c.mu.RUnlock()
+		now := time.Now().UnixNano()
+		if found && (item.Expiration == 0 || now <= item.Expiration) {
+			c.loadMu.Unlock()
+			if item.SoftExpiration > 0 && now > item.SoftExpiration && refresher != nil {
+				c.refresh(k, item, refresher)
+			}
+			return item.Object, nil
+		}
+		if le, found := c.loadErrors[k]; found {
+			if time.Now().UnixNano() <= le.expiration {
+				c.loadMu.Unlock()
+				return nil, le.err
+			}
+			delete(c.loadErrors, k)
+		}
+		if c.loads == nil {
+			c.loads = make(map[string]*loadCall)
+		}
+		lc = &loadCall{done: make(chan struct{})}
+		c.loads[k] = lc
+		go c.load(detachedContext{ctx}, k, lc, loader, nil)
+	}
+	c.loadMu.Unlock()
+	select {
+	case <-lc.done:
+		return lc.val, lc.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// 在后台用 refresher 重新加载一个软过期的item。和 GetOrLoad 共用 loads，同一个key同时只有一个加载在进行。
+// 刷新失败的话，旧值会一直保留到它真正过期。刷新期间key被Set、Delete或者过期删除的话，结果会被丢弃。
+func (c *cache) refresh(k string, item Item, refresher func(context.Context, string, interface{}) (interface{}, time.Duration, error)) {
+	c.loadMu.Lock()
+	if _, found := c.loads[k]; found {
+		c.loadMu.Unlock()
+		return
+	}
+	if c.loads == nil {
+		c.loads = make(map[string]*loadCall)
+	}
+	lc := &loadCall{done: make(chan struct{})}
+	c.loads[k] = lc
+	c.loadMu.Unlock()
+	loader := func(ctx context.Context) (interface{}, time.Duration, error) {
+		return refresher(ctx, k, item.Object)
+	}
+	go c.load(context.Background(), k, lc, loader, &item)
+}
+
+// 调用loader，保存结果，然后唤醒所有等待这个key的GetOrLoad。from 是刷新开始时的item，GetOrLoad 加载时为nil：
+// 刷新的结果只有在key还存着这个item的时候才保存，新item软过期到过期之间的时长和它一样。
+func (c *cache) load(ctx context.Context, k string, lc *loadCall, loader func(context.Context) (interface{}, time.Duration, error), from *Item) {
+	x, d, err := loader(ctx)
+	c.loadMu.Lock()
+	if err == nil {
+		if d == DefaultExpiration {
+			d = c.defaultExpiration
+		}
+		var stale time.Duration
+		if from != nil {
+			stale = time.Duration(from.Expiration - from.SoftExpiration)
+		}
+		item := newItem(x, d, stale)
+		c.mu.Lock()
+		current, found := c.items[k]
+		if from == nil || found && current.Expiration == from.Expiration && current.SoftExpiration == from.SoftExpiration {
+			c.publishSet(k, x)
+			c.items[k] = item
+			c.trackExpiration(k, item.Expiration)
+		}
+		c.mu.Unlock()
+	} else if d > 0 {
+		if c.loadErrors == nil {
+			c.loadErrors = make(map[string]loadError)
+		}
+		c.loadErrors[k] = loadError{
+			err:        err,
+			expiration: time.Now().Add(d).UnixNano(),
+		}
+	}
+	delete(c.loads, k)
+	c.loadMu.Unlock()
+	if err == nil {
+		lc.val = x
+	}
+	lc.err = err
+	close(lc.done)
+}
+
 // Increment an item of type int, int8, int16, int32, int64, uintptr, uint,
 // uint8, uint32, or uint64, float32 or float64 by n. Returns an error if the
 // item's value is not an integer, if it was not found, or if it is not
@@ -202,6 +536,7 @@ func (c *cache) Increment(k string, n int64) error {
 		c.mu.Unlock()
 		return fmt.Errorf("Item %s not found", k)
 	}
+	old := v.Object
 	switch v.Object.(type) {
 	case int:
 		v.Object = v.Object.(int) + int(n)
@@ -233,6 +568,7 @@ func (c *cache) Increment(k string, n int64) error {
 		c.mu.Unlock()
 		return fmt.Errorf("The value for %s is not an integer", k)
 	}
+	c.publish(EventReplace, k, old, v.Object)
 	c.items[k] = v
 	c.mu.Unlock()
 	return nil
@@ -250,6 +586,7 @@ func (c *cache) IncrementFloat(k string, n float64) error {
 		c.mu.Unlock()
 		return fmt.Errorf("Item %s not found", k)
 	}
+	old := v.Object
 	switch v.Object.(type) {
 	case float32:
 		v.Object = v.Object.(float32) + float32(n)
@@ -259,6 +596,7 @@ func (c *cache) IncrementFloat(k string, n float64) error {
 		c.mu.Unlock()
 		return fmt.Errorf("The value for %s does not have type float32 or float64", k)
 	}
+	c.publish(EventReplace, k, old, v.Object)
 	c.items[k] = v
 	c.mu.Unlock()
 	return nil
@@ -281,6 +619,7 @@ func (c *cache) IncrementInt(k string, n int) (int, error) {
 	}
 	nv := rv + n
 	v.Object = nv
+	c.publish(EventReplace, k, rv, nv)
 	c.items[k] = v
 	c.mu.Unlock()
 	return nv, nil
@@ -303,6 +642,7 @@ func (c *cache) IncrementInt8(k string, n int8) (int8, error) {
 	}
 	nv := rv + n
 	v.Object = nv
+	c.publish(EventReplace, k, rv, nv)
 	c.items[k] = v
 	c.mu.Unlock()
 	return nv, nil
@@ -325,6 +665,7 @@ func (c *cache) IncrementInt16(k string, n int16) (int16, error) {
 	}
 	nv := rv + n
 	v.Object = nv
+	c.publish(EventReplace, k, rv, nv)
 	c.items[k] = v
 	c.mu.Unlock()
 	return nv, nil
@@ -347,6 +688,7 @@ func (c *cache) IncrementInt32(k string, n int32) (int32, error) {
 	}
 	nv := rv + n
 	v.Object = nv
+	c.publish(EventReplace, k, rv, nv)
 	c.items[k] = v
 	c.mu.Unlock()
 	return nv, nil
@@ -369,6 +711,7 @@ func (c *cache) IncrementInt64(k string, n int64) (int64, error) {
 	}
 	nv := rv + n
 	v.Object = nv
+	c.publish(EventReplace, k, rv, nv)
 	c.items[k] = v
 	c.mu.Unlock()
 	return nv, nil
@@ -391,6 +734,7 @@ func (c *cache) IncrementUint(k string, n uint) (uint, error) {
 	}
 	nv := rv + n
 	v.Object = nv
+	c.publish(EventReplace, k, rv, nv)
 	c.items[k] = v
 	c.mu.Unlock()
 	return nv, nil
@@ -413,6 +757,7 @@ func (c *cache) IncrementUintptr(k string, n uintptr) (uintptr, error) {
 	}
 	nv := rv + n
 	v.Object = nv
+	c.publish(EventReplace, k, rv, nv)
 	c.items[k] = v
 	c.mu.Unlock()
 	return nv, nil
@@ -435,6 +780,7 @@ func (c *cache) IncrementUint8(k string, n uint8) (uint8, error) {
 	}
 	nv := rv + n
 	v.Object = nv
+	c.publish(EventReplace, k, rv, nv)
 	c.items[k] = v
 	c.mu.Unlock()
 	return nv, nil
@@ -457,6 +803,7 @@ func (c *cache) IncrementUint16(k string, n uint16) (uint16, error) {
 	}
 	nv := rv + n
 	v.Object = nv
+	c.publish(EventReplace, k, rv, nv)
 	c.items[k] = v
 	c.mu.Unlock()
 	return nv, nil
@@ -479,6 +826,7 @@ func (c *cache) IncrementUint32(k string, n uint32) (uint32, error) {
 	}
 	nv := rv + n
 	v.Object = nv
+	c.publish(EventReplace, k, rv, nv)
 	c.items[k] = v
 	c.mu.Unlock()
 	return nv, nil
@@ -501,6 +849,7 @@ func (c *cache) IncrementUint64(k string, n uint64) (uint64, error) {
 	}
 	nv := rv + n
 	v.Object = nv
+	c.publish(EventReplace, k, rv, nv)
 	c.items[k] = v
 	c.mu.Unlock()
 	return nv, nil
@@ -523,6 +872,7 @@ func (c *cache) IncrementFloat32(k string, n float32) (float32, error) {
 	}
 	nv := rv + n
 	v.Object = nv
+	c.publish(EventReplace, k, rv, nv)
 	c.items[k] = v
 	c.mu.Unlock()
 	return nv, nil
@@ -545,6 +895,7 @@ func (c *cache) IncrementFloat64(k string, n float64) (float64, error) {
 	}
 	nv := rv + n
 	v.Object = nv
+	c.publish(EventReplace, k, rv, nv)
 	c.items[k] = v
 	c.mu.Unlock()
 	return nv, nil
@@ -564,6 +915,7 @@ func (c *cache) Decrement(k string, n int64) error {
 		c.mu.Unlock()
 		return fmt.Errorf("Item not found")
 	}
+	old := v.Object
 	switch v.Object.(type) {
 	case int:
 		v.Object = v.Object.(int) - int(n)
@@ -595,6 +947,7 @@ func (c *cache) Decrement(k string, n int64) error {
 		c.mu.Unlock()
 		return fmt.Errorf("The value for %s is not an integer", k)
 	}
+	c.publish(EventReplace, k, old, v.Object)
 	c.items[k] = v
 	c.mu.Unlock()
 	return nil
@@ -612,6 +965,7 @@ func (c *cache) DecrementFloat(k string, n float64) error {
 		c.mu.Unlock()
 		return fmt.Errorf("Item %s not found", k)
 	}
+	old := v.Object
 	switch v.Object.(type) {
 	case float32:
 		v.Object = v.Object.(float32) - float32(n)
@@ -621,6 +975,7 @@ func (c *cache) DecrementFloat(k string, n float64) error {
 		c.mu.Unlock()
 		return fmt.Errorf("The value for %s does not have type float32 or float64", k)
 	}
+	c.publish(EventReplace, k, old, v.Object)
 	c.items[k] = v
 	c.mu.Unlock()
 	return nil
@@ -643,6 +998,7 @@ func (c *cache) DecrementInt(k string, n int) (int, error) {
 	}
 	nv := rv - n
 	v.Object = nv
+	c.publish(EventReplace, k, rv, nv)
 	c.items[k] = v
 	c.mu.Unlock()
 	return nv, nil
@@ -665,6 +1021,7 @@ func (c *cache) DecrementInt8(k string, n int8) (int8, error) {
 	}
 	nv := rv - n
 	v.Object = nv
+	c.publish(EventReplace, k, rv, nv)
 	c.items[k] = v
 	c.mu.Unlock()
 	return nv, nil
@@ -687,6 +1044,7 @@ func (c *cache) DecrementInt16(k string, n int16) (int16, error) {
 	}
 	nv := rv - n
 	v.Object = nv
+	c.publish(EventReplace, k, rv, nv)
 	c.items[k] = v
 	c.mu.Unlock()
 	return nv, nil
@@ -709,6 +1067,7 @@ func (c *cache) DecrementInt32(k string, n int32) (int32, error) {
 	}
 	nv := rv - n
 	v.Object = nv
+	c.publish(EventReplace, k, rv, nv)
 	c.items[k] = v
 	c.mu.Unlock()
 	return nv, nil
@@ -731,6 +1090,7 @@ func (c *cache) DecrementInt64(k string, n int64) (int64, error) {
 	}
 	nv := rv - n
 	v.Object = nv
+	c.publish(EventReplace, k, rv, nv)
 	c.items[k] = v
 	c.mu.Unlock()
 	return nv, nil
@@ -753,6 +1113,7 @@ func (c *cache) DecrementUint(k string, n uint) (uint, error) {
 	}
 	nv := rv - n
 	v.Object = nv
+	c.publish(EventReplace, k, rv, nv)
 	c.items[k] = v
 	c.mu.Unlock()
 	return nv, nil
@@ -775,6 +1136,7 @@ func (c *cache) DecrementUintptr(k string, n uintptr) (uintptr, error) {
 	}
 	nv := rv - n
 	v.Object = nv
+	c.publish(EventReplace, k, rv, nv)
 	c.items[k] = v
 	c.mu.Unlock()
 	return nv, nil
@@ -797,6 +1159,7 @@ func (c *cache) DecrementUint8(k string, n uint8) (uint8, error) {
 	}
 	nv := rv - n
 	v.Object = nv
+	c.publish(EventReplace, k, rv, nv)
 	c.items[k] = v
 	c.mu.Unlock()
 	return nv, nil
@@ -819,6 +1182,7 @@ func (c *cache) DecrementUint16(k string, n uint16) (uint16, error) {
 	}
 	nv := rv - n
 	v.Object = nv
+	c.publish(EventReplace, k, rv, nv)
 	c.items[k] = v
 	c.mu.Unlock()
 	return nv, nil
@@ -841,6 +1205,7 @@ func (c *cache) DecrementUint32(k string, n uint32) (uint32, error) {
 	}
 	nv := rv - n
 	v.Object = nv
+	c.publish(EventReplace, k, rv, nv)
 	c.items[k] = v
 	c.mu.Unlock()
 	return nv, nil
@@ -863,6 +1228,7 @@ func (c *cache) DecrementUint64(k string, n uint64) (uint64, error) {
 	}
 	nv := rv - n
 	v.Object = nv
+	c.publish(EventReplace, k, rv, nv)
 	c.items[k] = v
 	c.mu.Unlock()
 	return nv, nil
@@ -885,6 +1251,7 @@ func (c *cache) DecrementFloat32(k string, n float32) (float32, error) {
 	}
 	nv := rv - n
 	v.Object = nv
+	c.publish(EventReplace, k, rv, nv)
 	c.items[k] = v
 	c.mu.Unlock()
 	return nv, nil
@@ -907,6 +1274,7 @@ func (c *cache) DecrementFloat64(k string, n float64) (float64, error) {
 	}
 	nv := rv - n
 	v.Object = nv
+	c.publish(EventReplace, k, rv, nv)
 	c.items[k] = v
 	c.mu.Unlock()
 	return nv, nil
@@ -916,6 +1284,11 @@ func (c *cache) DecrementFloat64(k string, n float64) (float64, error) {
 // Delete 从cache中删除一个item。 如果key不存在，就啥都不做
 func (c *cache) Delete(k string) {
 	c.mu.Lock()
+	if len(c.subscribers()) > 0 {
+		if v, found := c.items[k]; found {
+			c.publish(EventDelete, k, v.Object, nil)
+		}
+	}
 	v, evicted := c.delete(k)
 	c.mu.Unlock()
 	if evicted {
@@ -939,18 +1312,22 @@ type keyAndValue struct {
 	value interface{}
 }
 
-// Delete all expired items from the cache.
-// 从cache中删除所有过期的items，然后调用删除回调函数。
+// Delete all expired items from the cache. Only the expired items are visited:
+// they are found through an index of expiration times, so the time spent
+// holding the lock does not grow with the number of unexpired items.
+// 从cache中删除所有过期的items，然后调用删除回调函数。只会从过期时间的堆里弹出已过期的，不遍历整个map。
 func (c *cache) DeleteExpired() {
 	var evictedItems []keyAndValue
 	now := time.Now().UnixNano()
 	c.mu.Lock()
-	for k, v := range c.items {
-		// "Inlining" of expired
-		if v.Expiration > 0 && now > v.Expiration {
-			ov, evicted := c.delete(k)
+	for len(c.expiry) > 0 && now > c.expiry[0].expiration {
+		e := c.expiry.pop()
+		// 这个item可能已经被删除或者覆盖了，过期时间对不上就跳过
+		if v, found := c.items[e.key]; found && v.Expiration == e.expiration {
+			c.publish(EventExpire, e.key, v.Object, nil)
+			ov, evicted := c.delete(e.key)
 			if evicted {
-				evictedItems = append(evictedItems, keyAndValue{k, ov})
+				evictedItems = append(evictedItems, keyAndValue{e.key, ov})
 			}
 		}
 	}
@@ -970,6 +1347,19 @@ func (c *cache) OnEvicted(f func(string, interface{})) {
 	c.mu.Unlock()
 }
 
+// Sets an (optional) function that is called in the background with the key
+// and current value of an item that is past its soft expiration time (see
+// SetWithSoftExpiration). Its result replaces the item with the returned
+// expiration duration, as with Set. If it returns an error, the old value is
+// kept until it expires. Set to nil to disable; stale items are then served
+// until they expire.
+// 设置软过期后的刷新函数，设置为nil禁用。
+func (c *cache) OnRefresh(f func(ctx context.Context, k string, old interface{}) (interface{}, time.Duration, error)) {
+	c.mu.Lock()
+	c.refresher = f
+	c.mu.Unlock()
+}
+
 // Write the cache's items (using Gob) to an io.Writer.
 // 将 cache 的 items 写入到 io.Writer
 
@@ -1025,7 +1415,9 @@ func (c *cache) Load(r io.Reader) error {
 		for k, v := range items {
 			ov, found := c.items[k]
 			if !found || ov.Expired() {
+				c.publishSet(k, v.Object)
 				c.items[k] = v
+				c.trackExpiration(k, v.Expiration)
 			}
 		}
 	}
@@ -1083,8 +1475,13 @@ func (c *cache) ItemCount() int {
 // 从缓存中删除所有项目。
 func (c *cache) Flush() {
 	c.mu.Lock()
+	c.publish(EventFlush, "", nil, nil)
 	c.items = map[string]Item{}
+	c.expiry = nil
 	c.mu.Unlock()
+	c.loadMu.Lock()
+	c.loadErrors = nil
+	c.loadMu.Unlock()
 }
 
 type janitor struct {
@@ -1126,6 +1523,7 @@ func newCache(de time.Duration, m map[string]Item) *cache {
 		defaultExpiration: de,
 		items:             m,
 	}
+	c.expiry.rebuild(m)
 	return c
 }
 
@@ -1179,6 +1577,8 @@ func New(defaultExpiration, cleanupInterval time.Duration) *Cache {
 // recommended to keep any references to the map around after creating a cache.
 // If need be, the map can be accessed at a later point using c.Items() (subject
 // to the same caveat.)
+// Items added to the map directly after the cache is created are not known to
+// DeleteExpired and are not removed by the janitor.
 //
 // Note regarding serialization: When using e.g. gob, make sure to
 // gob.Register() the individual types stored in the cache before encoding a
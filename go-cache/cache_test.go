@@ -2,10 +2,14 @@ package cache
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"runtime"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -1137,6 +1141,130 @@ func TestReplace(t *testing.T) {
 	}
 }
 
+func TestCompareAndSwap(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	if tc.CompareAndSwap("foo", nil, "bar") {
+		t.Error("CompareAndSwap swapped a missing item")
+	}
+	tc.Set("foo", "bar", 50*time.Millisecond)
+	_, expiration, _ := tc.GetWithExpiration("foo")
+	if tc.CompareAndSwap("foo", "baz", "qux") {
+		t.Error("CompareAndSwap swapped a different value")
+	}
+	if !tc.CompareAndSwap("foo", "bar", "baz") {
+		t.Error("CompareAndSwap did not swap an equal value")
+	}
+	x, newExpiration, _ := tc.GetWithExpiration("foo")
+	if x.(string) != "baz" {
+		t.Error("foo is not baz:", x)
+	}
+	if !newExpiration.Equal(expiration) {
+		t.Error("CompareAndSwap changed the expiration of foo")
+	}
+	<-time.After(60 * time.Millisecond)
+	if tc.CompareAndSwap("foo", "baz", "qux") {
+		t.Error("CompareAndSwap swapped an expired item")
+	}
+}
+
+func TestCompareAndSwapNotComparable(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.Set("foo", []byte("bar"), DefaultExpiration)
+	if tc.CompareAndSwap("foo", []byte("bar"), []byte("baz")) {
+		t.Error("CompareAndSwap swapped a value that is not comparable")
+	}
+	// the cache must not be left locked
+	tc.Set("foo", "bar", DefaultExpiration)
+	if !tc.CompareAndSwap("foo", "bar", "baz") {
+		t.Error("CompareAndSwap did not swap an equal value")
+	}
+}
+
+func TestGetAndDelete(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	var evicted interface{}
+	tc.OnEvicted(func(k string, v interface{}) {
+		evicted = v
+	})
+	if x, found := tc.GetAndDelete("foo"); found || x != nil {
+		t.Error("GetAndDelete found a missing item:", x)
+	}
+	tc.Set("foo", "bar", DefaultExpiration)
+	if x, found := tc.GetAndDelete("foo"); !found || x.(string) != "bar" {
+		t.Error("GetAndDelete did not return bar:", x)
+	}
+	if _, found := tc.Get("foo"); found {
+		t.Error("foo was not deleted")
+	}
+	if evicted != "bar" {
+		t.Error("OnEvicted was not called with bar; got:", evicted)
+	}
+}
+
+func TestGetAndSet(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	if x, found := tc.GetAndSet("foo", "bar", DefaultExpiration); found || x != nil {
+		t.Error("GetAndSet found a missing item:", x)
+	}
+	if x, found := tc.GetAndSet("foo", "baz", DefaultExpiration); !found || x.(string) != "bar" {
+		t.Error("GetAndSet did not return bar:", x)
+	}
+	if x, _ := tc.Get("foo"); x.(string) != "baz" {
+		t.Error("foo is not baz:", x)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	appendBar := func(old interface{}, found bool) (interface{}, time.Duration, bool) {
+		if !found {
+			return []string{"bar"}, DefaultExpiration, true
+		}
+		return append(old.([]string), "bar"), DefaultExpiration, true
+	}
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tc.Update("foo", appendBar)
+		}()
+	}
+	wg.Wait()
+	x, found := tc.Get("foo")
+	if !found || len(x.([]string)) != 100 {
+		t.Error("foo does not have 100 elements:", x)
+	}
+
+	x, found = tc.Update("foo", func(old interface{}, found bool) (interface{}, time.Duration, bool) {
+		return nil, 0, false
+	})
+	if found || x != nil {
+		t.Error("Update did not report the deletion:", x)
+	}
+	if _, found = tc.Get("foo"); found {
+		t.Error("foo was not deleted")
+	}
+}
+
+func TestUpdatePanicUnlocks(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Update did not propagate the panic")
+			}
+		}()
+		tc.Update("foo", func(old interface{}, found bool) (interface{}, time.Duration, bool) {
+			panic("boom")
+		})
+	}()
+	tc.Set("foo", "bar", DefaultExpiration)
+	if x, found := tc.Get("foo"); !found || x.(string) != "bar" {
+		t.Error("foo is not bar after a panicking Update:", x)
+	}
+}
+
 func TestDelete(t *testing.T) {
 	tc := New(DefaultExpiration, 0)
 	tc.Set("foo", "bar", DefaultExpiration)
@@ -1247,6 +1375,557 @@ func TestOnEvicted(t *testing.T) {
 	}
 }
 
+func TestGetOrLoad(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.Set("foo", "bar", DefaultExpiration)
+	x, err := tc.GetOrLoad(context.Background(), "foo", func(context.Context) (interface{}, time.Duration, error) {
+		t.Error("loader called for a cached item")
+		return nil, 0, nil
+	})
+	if err != nil || x.(string) != "bar" {
+		t.Error("foo was not bar:", x, err)
+	}
+
+	x, err = tc.GetOrLoad(context.Background(), "baz", func(context.Context) (interface{}, time.Duration, error) {
+		return 42, 50 * time.Millisecond, nil
+	})
+	if err != nil || x.(int) != 42 {
+		t.Error("baz was not 42:", x, err)
+	}
+	_, expiration, found := tc.GetWithExpiration("baz")
+	if !found {
+		t.Error("loaded baz was not cached")
+	}
+	if expiration.IsZero() {
+		t.Error("loaded baz has no expiration")
+	}
+}
+
+func TestGetOrLoadConcurrent(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	var calls int32
+	release := make(chan struct{})
+	loader := func(context.Context) (interface{}, time.Duration, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "bar", DefaultExpiration, nil
+	}
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			x, err := tc.GetOrLoad(context.Background(), "foo", loader)
+			if err != nil || x.(string) != "bar" {
+				t.Error("foo was not bar:", x, err)
+			}
+		}()
+	}
+	<-time.After(25 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("loader was called %d times; expected 1", n)
+	}
+}
+
+func TestGetOrLoadError(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	errBackend := errors.New("backend down")
+	var calls int32
+	loader := func(context.Context) (interface{}, time.Duration, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, 0, errBackend
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := tc.GetOrLoad(context.Background(), "foo", loader); err != errBackend {
+			t.Error("expected backend error; got:", err)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("uncached error: loader was called %d times; expected 2", n)
+	}
+	if _, found := tc.Get("foo"); found {
+		t.Error("failed load added foo to the cache")
+	}
+
+	calls = 0
+	negative := func(context.Context) (interface{}, time.Duration, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, 20 * time.Millisecond, errBackend
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := tc.GetOrLoad(context.Background(), "bar", negative); err != errBackend {
+			t.Error("expected backend error; got:", err)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("cached error: loader was called %d times; expected 1", n)
+	}
+	<-time.After(30 * time.Millisecond)
+	if _, err := tc.GetOrLoad(context.Background(), "bar", negative); err != errBackend {
+		t.Error("expected backend error; got:", err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("expired error: loader was called %d times; expected 2", n)
+	}
+
+	tc.Set("bar", "baz", DefaultExpiration)
+	x, err := tc.GetOrLoad(context.Background(), "bar", negative)
+	if err != nil || x.(string) != "baz" {
+		t.Error("Set did not override the cached error:", x, err)
+	}
+}
+
+func TestGetOrLoadContextCanceled(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	release := make(chan struct{})
+	loaded := make(chan struct{})
+	go func() {
+		tc.GetOrLoad(context.Background(), "foo", func(context.Context) (interface{}, time.Duration, error) {
+			<-release
+			return "bar", DefaultExpiration, nil
+		})
+		close(loaded)
+	}()
+	<-time.After(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	x, err := tc.GetOrLoad(ctx, "foo", func(context.Context) (interface{}, time.Duration, error) {
+		t.Error("loader called while another load was in flight")
+		return nil, 0, nil
+	})
+	if err != context.DeadlineExceeded || x != nil {
+		t.Error("expected deadline exceeded; got:", x, err)
+	}
+
+	close(release)
+	<-loaded
+	if x, found := tc.Get("foo"); !found || x.(string) != "bar" {
+		t.Error("foo was not loaded after the waiter gave up:", x)
+	}
+}
+
+func TestGetOrLoadFirstCallerCanceled(t *testing.T) {
+	type ctxKey struct{}
+	tc := New(DefaultExpiration, 0)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), ctxKey{}, "value"))
+	first := make(chan error)
+	go func() {
+		_, err := tc.GetOrLoad(ctx, "foo", func(ctx context.Context) (interface{}, time.Duration, error) {
+			close(started)
+			<-release
+			if ctx.Value(ctxKey{}) != "value" {
+				t.Error("loader context lost the caller's values")
+			}
+			if err := ctx.Err(); err != nil {
+				return nil, time.Minute, err
+			}
+			return "bar", DefaultExpiration, nil
+		})
+		first <- err
+	}()
+	<-started
+
+	second := make(chan interface{})
+	go func() {
+		x, err := tc.GetOrLoad(context.Background(), "foo", func(context.Context) (interface{}, time.Duration, error) {
+			t.Error("loader called while another load was in flight")
+			return nil, 0, nil
+		})
+		if err != nil {
+			t.Error("second caller failed:", err)
+		}
+		second <- x
+	}()
+
+	cancel()
+	if err := <-first; err != context.Canceled {
+		t.Error("expected the first caller to be canceled; got:", err)
+	}
+	close(release)
+	if x := <-second; x != "bar" {
+		t.Error("second caller did not get the loaded value:", x)
+	}
+	if x, found := tc.Get("foo"); !found || x.(string) != "bar" {
+		t.Error("foo was not loaded after the first caller gave up:", x)
+	}
+}
+
+func TestSoftExpiration(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	var calls int32
+	refreshed := make(chan struct{}, 1)
+	tc.OnRefresh(func(ctx context.Context, k string, old interface{}) (interface{}, time.Duration, error) {
+		atomic.AddInt32(&calls, 1)
+		if k != "foo" || old.(int) != 1 {
+			t.Error("refresh called with unexpected key or value:", k, old)
+		}
+		defer func() { refreshed <- struct{}{} }()
+		return 2, 200 * time.Millisecond, nil
+	})
+	tc.SetWithSoftExpiration("foo", 1, 20*time.Millisecond, 100*time.Millisecond)
+
+	x, found := tc.Get("foo")
+	if !found || x.(int) != 1 {
+		t.Error("fresh foo was not 1:", x)
+	}
+	if tc.items["foo"].Stale() {
+		t.Error("foo is stale before its soft expiration")
+	}
+
+	<-time.After(30 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		x, found = tc.Get("foo")
+		if !found || x.(int) != 1 {
+			t.Error("stale foo was not served while refreshing:", x)
+		}
+	}
+	<-refreshed
+	<-time.After(5 * time.Millisecond)
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("refresh was called %d times; expected 1", n)
+	}
+	x, expiration, found := tc.GetWithExpiration("foo")
+	if !found || x.(int) != 2 {
+		t.Error("refreshed foo was not 2:", x)
+	}
+	if expiration.Before(time.Now().Add(100 * time.Millisecond)) {
+		t.Error("refreshed foo did not get the new expiration")
+	}
+	item := tc.items["foo"]
+	if gap := item.Expiration - item.SoftExpiration; gap != int64(80*time.Millisecond) {
+		t.Error("refreshed foo did not keep its stale window; got:", time.Duration(gap))
+	}
+}
+
+func TestSoftExpirationRefreshError(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	refreshed := make(chan struct{}, 1)
+	tc.OnRefresh(func(ctx context.Context, k string, old interface{}) (interface{}, time.Duration, error) {
+		defer func() { refreshed <- struct{}{} }()
+		return nil, 0, errors.New("backend down")
+	})
+	tc.SetWithSoftExpiration("foo", 1, 10*time.Millisecond, 50*time.Millisecond)
+
+	<-time.After(20 * time.Millisecond)
+	if x, found := tc.Get("foo"); !found || x.(int) != 1 {
+		t.Error("stale foo was not served:", x)
+	}
+	<-refreshed
+	if x, found := tc.Get("foo"); !found || x.(int) != 1 {
+		t.Error("foo was not kept after a failed refresh:", x)
+	}
+	<-time.After(40 * time.Millisecond)
+	if x, found := tc.Get("foo"); found {
+		t.Error("foo was served after its hard expiration:", x)
+	}
+}
+
+func TestSoftExpirationRefreshDoesNotOverwrite(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	tc.OnRefresh(func(ctx context.Context, k string, old interface{}) (interface{}, time.Duration, error) {
+		started <- struct{}{}
+		<-release
+		return "refreshed", time.Minute, nil
+	})
+	// refreshing starts a load, waits until f has changed the key, then finishes it.
+	refreshDuring := func(k string, f func()) {
+		tc.SetWithSoftExpiration(k, "old", time.Millisecond, time.Minute)
+		<-time.After(5 * time.Millisecond)
+		tc.Get(k)
+		<-started
+		tc.loadMu.Lock()
+		lc := tc.loads[k]
+		tc.loadMu.Unlock()
+		f()
+		release <- struct{}{}
+		<-lc.done
+	}
+
+	refreshDuring("foo", func() { tc.Set("foo", "new", DefaultExpiration) })
+	if x, found := tc.Get("foo"); !found || x.(string) != "new" {
+		t.Error("refresh overwrote a newer Set:", x)
+	}
+
+	refreshDuring("bar", func() { tc.Delete("bar") })
+	if x, found := tc.Get("bar"); found {
+		t.Error("refresh brought back a deleted key:", x)
+	}
+
+	refreshDuring("baz", func() {})
+	if x, found := tc.Get("baz"); !found || x.(string) != "refreshed" {
+		t.Error("unchanged baz was not refreshed:", x)
+	}
+}
+
+func TestGetOrLoadFindsSoftExpiredItemWhileWaitingForLoadMu(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	refreshed := make(chan struct{})
+	tc.OnRefresh(func(ctx context.Context, k string, old interface{}) (interface{}, time.Duration, error) {
+		close(refreshed)
+		return "refreshed", time.Minute, nil
+	})
+	// GetOrLoad misses, then waits for loadMu while a soft-expired item is set.
+	tc.loadMu.Lock()
+	type result struct {
+		x   interface{}
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		x, err := tc.GetOrLoad(context.Background(), "foo", func(ctx context.Context) (interface{}, time.Duration, error) {
+			return "loaded", DefaultExpiration, nil
+		})
+		done <- result{x, err}
+	}()
+	<-time.After(5 * time.Millisecond)
+	tc.SetWithSoftExpiration("foo", "old", time.Nanosecond, time.Minute)
+	<-time.After(time.Millisecond)
+	tc.loadMu.Unlock()
+
+	select {
+	case r := <-done:
+		if r.err != nil || r.x.(string) != "old" {
+			t.Error("GetOrLoad did not return the item that was set:", r.x, r.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("GetOrLoad deadlocked on loadMu")
+	}
+	select {
+	case <-refreshed:
+	case <-time.After(time.Second):
+		t.Error("soft-expired item was not refreshed")
+	}
+}
+
+func TestSoftExpirationWithoutRefresher(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.SetWithSoftExpiration("foo", 1, 10*time.Millisecond, 50*time.Millisecond)
+	tc.SetWithSoftExpiration("bar", 1, 50*time.Millisecond, 10*time.Millisecond)
+	if tc.items["bar"].SoftExpiration != 0 {
+		t.Error("bar has a soft expiration after its expiration")
+	}
+
+	<-time.After(20 * time.Millisecond)
+	if !tc.items["foo"].Stale() {
+		t.Error("foo is not stale after its soft expiration")
+	}
+	if x, found := tc.Get("foo"); !found || x.(int) != 1 {
+		t.Error("stale foo was not served:", x)
+	}
+}
+
+func TestDeleteExpired(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	var evicted []string
+	tc.OnEvicted(func(k string, v interface{}) {
+		evicted = append(evicted, k)
+	})
+	tc.Set("a", 1, 10*time.Millisecond)
+	tc.Set("b", 2, NoExpiration)
+	tc.Set("c", 3, 10*time.Millisecond)
+	tc.Set("c", 3, 50*time.Millisecond) // overwritten with a later expiration
+	tc.Set("d", 4, 10*time.Millisecond)
+	tc.Delete("d")
+	tc.Set("e", 5, 10*time.Millisecond)
+	evicted = nil
+
+	<-time.After(20 * time.Millisecond)
+	tc.DeleteExpired()
+	if len(evicted) != 2 || evicted[0] != "a" && evicted[1] != "a" {
+		t.Error("expected a and e to be evicted; got:", evicted)
+	}
+	if n := tc.ItemCount(); n != 2 {
+		t.Errorf("expected 2 items after DeleteExpired; got %d", n)
+	}
+	if _, found := tc.Get("c"); !found {
+		t.Error("c was deleted using its overwritten expiration")
+	}
+
+	<-time.After(40 * time.Millisecond)
+	tc.DeleteExpired()
+	if _, found := tc.items["c"]; found {
+		t.Error("c was not deleted after it expired")
+	}
+	if len(tc.expiry) != 0 {
+		t.Errorf("expected an empty expiry index; got %d entries", len(tc.expiry))
+	}
+}
+
+func TestDeleteExpiredNewFrom(t *testing.T) {
+	m := map[string]Item{
+		"a": {Object: 1, Expiration: time.Now().Add(-time.Second).UnixNano()},
+		"b": {Object: 2, Expiration: time.Now().Add(time.Minute).UnixNano()},
+		"c": {Object: 3},
+	}
+	tc := NewFrom(DefaultExpiration, 0, m)
+	tc.DeleteExpired()
+	if _, found := tc.items["a"]; found {
+		t.Error("expired a from NewFrom was not deleted")
+	}
+	if n := tc.ItemCount(); n != 2 {
+		t.Errorf("expected 2 items after DeleteExpired; got %d", n)
+	}
+}
+
+func TestExpiryIndexRebuild(t *testing.T) {
+	tc := New(time.Minute, 0)
+	for i := 0; i < 10*minExpiryRebuild; i++ {
+		tc.Set("foo", i, DefaultExpiration)
+	}
+	if n := len(tc.expiry); n > 2+minExpiryRebuild {
+		t.Errorf("expiry index was not rebuilt; it has %d entries for 1 item", n)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	ch := tc.Subscribe(EventFilter{})
+	tc.Set("a", 1, DefaultExpiration)
+	tc.Set("a", 2, DefaultExpiration)
+	tc.Replace("a", 3, DefaultExpiration)
+	tc.Add("b", 4, time.Nanosecond)
+	tc.Delete("a")
+	tc.Delete("c")
+	<-time.After(time.Millisecond)
+	tc.DeleteExpired()
+	tc.Flush()
+
+	expected := []Event{
+		{Type: EventSet, Key: "a", NewValue: 1},
+		{Type: EventReplace, Key: "a", OldValue: 1, NewValue: 2},
+		{Type: EventReplace, Key: "a", OldValue: 2, NewValue: 3},
+		{Type: EventSet, Key: "b", NewValue: 4},
+		{Type: EventDelete, Key: "a", OldValue: 3},
+		{Type: EventExpire, Key: "b", OldValue: 4},
+		{Type: EventFlush},
+	}
+	for _, want := range expected {
+		select {
+		case e := <-ch:
+			if e.Type != want.Type || e.Key != want.Key || e.OldValue != want.OldValue || e.NewValue != want.NewValue {
+				t.Errorf("expected %s event %+v; got %s event %+v", want.Type, want, e.Type, e)
+			}
+			if e.Time.IsZero() {
+				t.Error("event has no timestamp")
+			}
+		default:
+			t.Fatalf("missing %s event for %q", want.Type, want.Key)
+		}
+	}
+
+	tc.Unsubscribe(ch)
+	tc.Set("a", 1, DefaultExpiration)
+	if _, ok := <-ch; ok {
+		t.Error("channel received an event after Unsubscribe")
+	}
+}
+
+func TestSubscribeIncrementDecrement(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	tc.Set("int", 1, DefaultExpiration)
+	tc.Set("int64", int64(10), DefaultExpiration)
+	tc.Set("float", 1.5, DefaultExpiration)
+	ch := tc.Subscribe(EventFilter{})
+	defer tc.Unsubscribe(ch)
+	tc.Increment("int", 2)
+	tc.DecrementInt64("int64", 3)
+	tc.IncrementFloat("float", 1)
+	tc.Increment("missing", 1)
+
+	expected := []Event{
+		{Type: EventReplace, Key: "int", OldValue: 1, NewValue: 3},
+		{Type: EventReplace, Key: "int64", OldValue: int64(10), NewValue: int64(7)},
+		{Type: EventReplace, Key: "float", OldValue: 1.5, NewValue: 2.5},
+	}
+	for _, want := range expected {
+		select {
+		case e := <-ch:
+			if e.Type != want.Type || e.Key != want.Key || e.OldValue != want.OldValue || e.NewValue != want.NewValue {
+				t.Errorf("expected %s event %+v; got %s event %+v", want.Type, want, e.Type, e)
+			}
+		default:
+			t.Fatalf("missing %s event for %q", want.Type, want.Key)
+		}
+	}
+	if len(ch) != 0 {
+		t.Errorf("expected no more events; got %d", len(ch))
+	}
+}
+
+func TestSubscribeFilter(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	ch := tc.Subscribe(EventFilter{
+		Types: EventDelete | EventFlush,
+		Keys: func(k string) bool {
+			return k == "a"
+		},
+	})
+	defer tc.Unsubscribe(ch)
+	tc.Set("a", 1, DefaultExpiration)
+	tc.Set("b", 2, DefaultExpiration)
+	tc.Delete("b")
+	tc.Delete("a")
+	tc.Flush()
+	if e := <-ch; e.Type != EventDelete || e.Key != "a" {
+		t.Error("expected delete event for a; got:", e.Type, e.Key)
+	}
+	if e := <-ch; e.Type != EventFlush {
+		t.Error("expected flush event; got:", e.Type, e.Key)
+	}
+	if len(ch) != 0 {
+		t.Errorf("expected no more events; got %d", len(ch))
+	}
+}
+
+func TestSubscribeOverflow(t *testing.T) {
+	tc := New(DefaultExpiration, 0)
+	dropping := tc.Subscribe(EventFilter{BufferSize: 2})
+	defer tc.Unsubscribe(dropping)
+	for i := 0; i < 5; i++ {
+		tc.Set(strconv.Itoa(i), i, DefaultExpiration)
+	}
+	if len(dropping) != 2 {
+		t.Errorf("expected 2 buffered events; got %d", len(dropping))
+	}
+
+	blocking := tc.Subscribe(EventFilter{BufferSize: 1, Overflow: BlockWriters})
+	tc.Set("a", 1, DefaultExpiration)
+	done := make(chan struct{})
+	go func() {
+		tc.Set("b", 2, DefaultExpiration)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Set did not wait for a full blocking subscriber")
+	case <-time.After(10 * time.Millisecond):
+	}
+	if e := <-blocking; e.Key != "a" {
+		t.Error("expected event for a; got:", e.Key)
+	}
+	<-done
+	if e := <-blocking; e.Key != "b" {
+		t.Error("expected event for b; got:", e.Key)
+	}
+
+	tc.Set("c", 3, DefaultExpiration)
+	go func() {
+		tc.Set("d", 4, DefaultExpiration)
+	}()
+	<-time.After(10 * time.Millisecond)
+	tc.Unsubscribe(blocking)
+	if x, found := tc.Get("d"); !found || x.(int) != 4 {
+		t.Error("blocked Set did not complete after Unsubscribe:", x)
+	}
+}
+
 func TestCacheSerialization(t *testing.T) {
 	tc := New(DefaultExpiration, 0)
 	testFillAndSerialize(t, tc)
@@ -1677,6 +2356,39 @@ func BenchmarkDeleteExpiredLoop(b *testing.B) {
 	}
 }
 
+// Measures how long DeleteExpired holds the write lock to remove 100 expired
+// items from caches of increasing size.
+func BenchmarkDeleteExpiredHoldTime(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000, 1000000} {
+		b.Run(fmt.Sprintf("items=%d", n), func(b *testing.B) {
+			benchmarkDeleteExpiredHoldTime(b, n, 100)
+		})
+	}
+}
+
+func benchmarkDeleteExpiredHoldTime(b *testing.B, n, expired int) {
+	b.StopTimer()
+	tc := New(5*time.Minute, 0)
+	tc.mu.Lock()
+	for i := 0; i < n; i++ {
+		tc.set(strconv.Itoa(i), "bar", DefaultExpiration)
+	}
+	tc.mu.Unlock()
+	keys := make([]string, expired)
+	for i := range keys {
+		keys[i] = "expired" + strconv.Itoa(i)
+	}
+	for i := 0; i < b.N; i++ {
+		for _, k := range keys {
+			tc.Set(k, "bar", time.Nanosecond)
+		}
+		<-time.After(time.Microsecond)
+		b.StartTimer()
+		tc.DeleteExpired()
+		b.StopTimer()
+	}
+}
+
 func TestGetWithExpiration(t *testing.T) {
 	tc := New(DefaultExpiration, 0)
 
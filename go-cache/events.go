@@ -0,0 +1,216 @@
+package cache
+
+import (
+	"time"
+)
+
+// An EventType identifies what happened to a cache item. Event types are bit
+// flags, so several of them can be combined in an EventFilter.
+type EventType int
+
+const (
+	// An item was added under a key that had no unexpired item.
+	EventSet EventType = 1 << iota
+	// An unexpired item was overwritten, or its number incremented or
+	// decremented.
+	EventReplace
+	// An item was deleted with Delete.
+	EventDelete
+	// An expired item was removed by DeleteExpired (or the janitor.)
+	EventExpire
+	// All items were removed with Flush.
+	EventFlush
+
+	// All event types.
+	AllEvents = EventSet | EventReplace | EventDelete | EventExpire | EventFlush
+)
+
+// String returns the name of the event type.
+func (t EventType) String() string {
+	switch t {
+	case EventSet:
+		return "set"
+	case EventReplace:
+		return "replace"
+	case EventDelete:
+		return "delete"
+	case EventExpire:
+		return "expire"
+	case EventFlush:
+		return "flush"
+	}
+	return "unknown"
+}
+
+// An Event describes a change to the cache. OldValue is nil for EventSet and
+// NewValue is nil for EventDelete and EventExpire. Flush events have neither a
+// key nor values.
+type Event struct {
+	Type     EventType
+	Key      string
+	OldValue interface{}
+	NewValue interface{}
+	Time     time.Time
+}
+
+// An OverflowPolicy decides what happens to an event when a subscriber's
+// buffer is full.
+type OverflowPolicy int
+
+const (
+	// Discard the event. Writers never wait for subscribers.
+	// 缓冲满了就丢弃新事件，写操作不会等待订阅者
+	DropEvents OverflowPolicy = iota
+	// Make the write that caused the event wait until the subscriber has
+	// room for it. The subscriber must keep reading its channel and must not
+	// call the cache from the goroutine that reads it, since the waiting
+	// writer holds the cache's lock.
+	// 缓冲满了就阻塞写操作（写操作持有锁），订阅者读channel的goroutine里不能再调用cache
+	BlockWriters
+)
+
+// DefaultEventBuffer is the channel buffer size used by Subscribe when the
+// filter does not set one.
+const DefaultEventBuffer = 64
+
+// An EventFilter selects the events delivered to a subscriber and how they are
+// buffered.
+type EventFilter struct {
+	// Event types to deliver. Zero means AllEvents.
+	Types EventType
+	// If set, only events for keys it returns true for are delivered. Flush
+	// events are delivered regardless. Keys is called while the change is
+	// being made, with the cache's lock held for writing, so it must be fast
+	// and must not call the cache's methods, which would deadlock.
+	// Keys 在持有写锁时调用，要足够快，并且不能调用cache的方法，否则会死锁
+	Keys func(k string) bool
+	// Size of the subscriber's channel buffer. Zero means
+	// DefaultEventBuffer.
+	BufferSize int
+	// What to do with events that do not fit in the buffer.
+	Overflow OverflowPolicy
+}
+
+type subscriber struct {
+	ch     chan Event
+	done   chan struct{} // 取消订阅时关闭，唤醒阻塞在 ch 上的写操作
+	filter EventFilter
+}
+
+// Returns a channel that receives the cache's events matching the filter, in
+// the order the changes were made. Events are sent while the change is being
+// made, so a subscriber sees an event before any later change to the same key.
+// Increment and Decrement (and their typed variants) publish EventReplace with
+// the old and the new number.
+//
+// Call Unsubscribe with the returned channel to stop receiving events and
+// close it.
+// 订阅cache的变更事件：set、replace、delete、expire、flush
+func (c *cache) Subscribe(filter EventFilter) <-chan Event {
+	if filter.Types == 0 {
+		filter.Types = AllEvents
+	}
+	if filter.BufferSize <= 0 {
+		filter.BufferSize = DefaultEventBuffer
+	}
+	s := &subscriber{
+		ch:     make(chan Event, filter.BufferSize),
+		done:   make(chan struct{}),
+		filter: filter,
+	}
+	c.subMu.Lock()
+	old := c.subscribers()
+	subs := make([]*subscriber, len(old), len(old)+1)
+	copy(subs, old)
+	c.subs.Store(append(subs, s))
+	c.subMu.Unlock()
+	return s.ch
+}
+
+// Stops delivering events to a channel returned by Subscribe and closes it.
+// Does nothing if the channel is not subscribed.
+// 取消订阅，并关闭channel
+func (c *cache) Unsubscribe(ch <-chan Event) {
+	c.subMu.Lock()
+	old := c.subscribers()
+	var s *subscriber
+	subs := make([]*subscriber, 0, len(old))
+	for _, v := range old {
+		if v.ch == ch {
+			s = v
+			continue
+		}
+		subs = append(subs, v)
+	}
+	if s == nil {
+		c.subMu.Unlock()
+		return
+	}
+	c.subs.Store(subs)
+	c.subMu.Unlock()
+	// 先唤醒可能阻塞在发送上的写操作，然后在写锁下关闭channel，这样不会有人往关闭的channel里发送
+	close(s.done)
+	c.mu.Lock()
+	close(s.ch)
+	c.mu.Unlock()
+}
+
+func (c *cache) subscribers() []*subscriber {
+	subs, _ := c.subs.Load().([]*subscriber)
+	return subs
+}
+
+// Sends an event to every matching subscriber. The caller must hold c.mu for
+// writing.
+// 发送事件给订阅者，调用方需要持有写锁
+func (c *cache) publish(t EventType, k string, old, new interface{}) {
+	subs := c.subscribers()
+	if len(subs) == 0 {
+		return
+	}
+	e := Event{
+		Type:     t,
+		Key:      k,
+		OldValue: old,
+		NewValue: new,
+		Time:     time.Now(),
+	}
+	for _, s := range subs {
+		s.send(e)
+	}
+}
+
+// Publishes the event for storing x under k: EventReplace if k holds an
+// unexpired item, EventSet otherwise. Must be called before the item is
+// stored, with c.mu held for writing.
+// 在写入 k 之前调用：k 存在且未过期就是 EventReplace，否则是 EventSet
+func (c *cache) publishSet(k string, x interface{}) {
+	if len(c.subscribers()) == 0 {
+		return
+	}
+	if old, found := c.get(k); found {
+		c.publish(EventReplace, k, old, x)
+	} else {
+		c.publish(EventSet, k, nil, x)
+	}
+}
+
+func (s *subscriber) send(e Event) {
+	if s.filter.Types&e.Type == 0 {
+		return
+	}
+	if e.Type != EventFlush && s.filter.Keys != nil && !s.filter.Keys(e.Key) {
+		return
+	}
+	if s.filter.Overflow == BlockWriters {
+		select {
+		case s.ch <- e:
+		case <-s.done:
+		}
+		return
+	}
+	select {
+	case s.ch <- e:
+	default:
+	}
+}
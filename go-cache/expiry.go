@@ -0,0 +1,89 @@
+package cache
+
+// An expiryEntry records that the item stored under key expires at
+// expiration, as of the time the entry was pushed.
+type expiryEntry struct {
+	key        string
+	expiration int64
+}
+
+// expiryHeap is a min-heap of expiry entries ordered by expiration time. It is
+// the cache's index of items with an expiration: DeleteExpired pops entries
+// until the earliest one is in the future, so a cleanup only touches items
+// that have actually expired instead of scanning the whole items map.
+//
+// Entries are not removed when an item is overwritten or deleted. A popped
+// entry whose expiration no longer matches the stored item is stale and is
+// skipped, and the heap is rebuilt from the items map once stale entries
+// outnumber the items.
+//
+// 过期时间的小顶堆。janitor 清理时只需要从堆顶弹出已过期的entry，不用再遍历整个map。
+// 覆盖和删除item时不会去堆里删除对应的entry，弹出时发现过期时间对不上就跳过；
+// 堆里无效的entry太多时，会从items重建堆。
+type expiryHeap []expiryEntry
+
+// minExpiryRebuild is the number of stale entries the heap tolerates on top of
+// the number of items before it is rebuilt.
+const minExpiryRebuild = 1024
+
+func (h *expiryHeap) push(k string, e int64) {
+	*h = append(*h, expiryEntry{key: k, expiration: e})
+	h.up(len(*h) - 1)
+}
+
+// Removes and returns the entry with the earliest expiration. The heap must
+// not be empty.
+func (h *expiryHeap) pop() expiryEntry {
+	old := *h
+	n := len(old) - 1
+	top := old[0]
+	old[0] = old[n]
+	old[n] = expiryEntry{} // 释放 key，避免底层数组一直引用它
+	*h = old[:n]
+	h.down(0)
+	return top
+}
+
+// Replaces the heap's contents with one entry per item that has an
+// expiration.
+func (h *expiryHeap) rebuild(items map[string]Item) {
+	entries := make(expiryHeap, 0, len(items))
+	for k, v := range items {
+		if v.Expiration > 0 {
+			entries = append(entries, expiryEntry{key: k, expiration: v.Expiration})
+		}
+	}
+	for i := len(entries)/2 - 1; i >= 0; i-- {
+		entries.down(i)
+	}
+	*h = entries
+}
+
+func (h expiryHeap) up(i int) {
+	for i > 0 {
+		parent := (i - 1) / 2
+		if h[parent].expiration <= h[i].expiration {
+			return
+		}
+		h[parent], h[i] = h[i], h[parent]
+		i = parent
+	}
+}
+
+func (h expiryHeap) down(i int) {
+	n := len(h)
+	for {
+		smallest := i
+		if l := 2*i + 1; l < n && h[l].expiration < h[smallest].expiration {
+			smallest = l
+		}
+		if r := 2*i + 2; r < n && h[r].expiration < h[smallest].expiration {
+			smallest = r
+		}
+		if smallest == i {
+			return
+		}
+		h[i], h[smallest] = h[smallest], h[i]
+		i = smallest
+	}
+}
@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"context"
 	"crypto/rand"
 	"math"
 	"math/big"
@@ -70,6 +71,10 @@ func (sc *shardedCache) Set(k string, x interface{}, d time.Duration) {
 	sc.bucket(k).Set(k, x, d)
 }
 
+func (sc *shardedCache) SetWithSoftExpiration(k string, x interface{}, soft, d time.Duration) {
+	sc.bucket(k).SetWithSoftExpiration(k, x, soft, d)
+}
+
 func (sc *shardedCache) Add(k string, x interface{}, d time.Duration) error {
 	return sc.bucket(k).Add(k, x, d)
 }
@@ -78,10 +83,30 @@ func (sc *shardedCache) Replace(k string, x interface{}, d time.Duration) error
 	return sc.bucket(k).Replace(k, x, d)
 }
 
+func (sc *shardedCache) CompareAndSwap(k string, old, new interface{}) bool {
+	return sc.bucket(k).CompareAndSwap(k, old, new)
+}
+
+func (sc *shardedCache) GetAndDelete(k string) (interface{}, bool) {
+	return sc.bucket(k).GetAndDelete(k)
+}
+
+func (sc *shardedCache) GetAndSet(k string, x interface{}, d time.Duration) (interface{}, bool) {
+	return sc.bucket(k).GetAndSet(k, x, d)
+}
+
+func (sc *shardedCache) Update(k string, f func(old interface{}, found bool) (new interface{}, d time.Duration, keep bool)) (interface{}, bool) {
+	return sc.bucket(k).Update(k, f)
+}
+
 func (sc *shardedCache) Get(k string) (interface{}, bool) {
 	return sc.bucket(k).Get(k)
 }
 
+func (sc *shardedCache) GetOrLoad(ctx context.Context, k string, loader func(context.Context) (interface{}, time.Duration, error)) (interface{}, error) {
+	return sc.bucket(k).GetOrLoad(ctx, k, loader)
+}
+
 func (sc *shardedCache) Increment(k string, n int64) error {
 	return sc.bucket(k).Increment(k, n)
 }
@@ -117,6 +142,12 @@ func (sc *shardedCache) Items() []map[string]Item {
 	return res
 }
 
+func (sc *shardedCache) OnRefresh(f func(ctx context.Context, k string, old interface{}) (interface{}, time.Duration, error)) {
+	for _, v := range sc.cs {
+		v.OnRefresh(f)
+	}
+}
+
 func (sc *shardedCache) Flush() {
 	for _, v := range sc.cs {
 		v.Flush()
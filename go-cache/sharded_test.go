@@ -33,6 +33,28 @@ func TestShardedCache(t *testing.T) {
 	}
 }
 
+func TestShardedCacheAtomic(t *testing.T) {
+	tc := unexportedNewSharded(DefaultExpiration, 0, 13)
+	for _, v := range shardedKeys {
+		tc.Set(v, 1, DefaultExpiration)
+		if !tc.CompareAndSwap(v, 1, 2) {
+			t.Error("CompareAndSwap did not swap", v)
+		}
+		if x, found := tc.GetAndSet(v, 3, DefaultExpiration); !found || x.(int) != 2 {
+			t.Error("GetAndSet did not return 2 for", v, x)
+		}
+		tc.Update(v, func(old interface{}, found bool) (interface{}, time.Duration, bool) {
+			return old.(int) + 1, DefaultExpiration, true
+		})
+		if x, found := tc.GetAndDelete(v); !found || x.(int) != 4 {
+			t.Error("GetAndDelete did not return 4 for", v, x)
+		}
+		if _, found := tc.Get(v); found {
+			t.Error(v, "was not deleted")
+		}
+	}
+}
+
 func BenchmarkShardedCacheGetExpiring(b *testing.B) {
 	benchmarkShardedCacheGet(b, 5*time.Minute)
 }